@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var errUnauthorized = newError(http.StatusUnauthorized, "unauthorized", "a valid admin token is required")
+
+// requireAdmin allows only requests bearing one of cfg.AdminTokens, recording
+// the token's owner as the actor for auditing.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := adminActor(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, r, errUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), actorKey, actor)))
+	}
+}
+
+// adminActor returns the name of the admin authenticated by r, if any.
+func adminActor(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+	for name, want := range cfg.AdminTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// actor returns who is making the request, for the audit log.
+func actor(r *http.Request) string {
+	if name, ok := r.Context().Value(actorKey).(string); ok {
+		return name
+	}
+	return "anonymous"
+}
+
+// audit records an action in the audit log as part of tx.
+func audit(ctx context.Context, tx *sql.Tx, actor, action, resource string, resourceID int, detail any) error {
+	data, err := json.Marshal(detail)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO audit_log (actor, action, resource, resource_id, detail) VALUES ($1, $2, $3, $4, $5)`,
+		actor, action, resource, resourceID, data,
+	)
+	return err
+}
+
+// auditResources are the resource types recorded in the audit log.
+var auditResources = []string{"user", "address"}
+
+type auditEntry struct {
+	ID         int             `json:"id"`
+	Actor      string          `json:"actor"`
+	Action     string          `json:"action"`
+	Resource   string          `json:"resource"`
+	ResourceID int             `json:"resource_id"`
+	Detail     json.RawMessage `json:"detail,omitempty"`
+	CreatedAt  timestamp       `json:"created_at"`
+}
+
+// listAudit lists the audit log entries of ?actor=, optionally only those for
+// one ?resource= type, most recent first.
+func listAudit(w http.ResponseWriter, r *http.Request) {
+	p, err := parsePage(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	actor, err := textParam(r, "actor")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if actor == "" {
+		writeError(w, r, newError(http.StatusBadRequest, "invalid_actor", "actor is required"))
+		return
+	}
+	var where whereClause
+	where.and("actor = " + where.arg(actor))
+	if resource := r.URL.Query().Get("resource"); resource != "" {
+		if !slices.Contains(auditResources, resource) {
+			writeError(w, r, newError(http.StatusBadRequest, "invalid_resource", "resource must be one of "+strings.Join(auditResources, ", ")))
+			return
+		}
+		where.and("resource = " + where.arg(resource))
+	}
+	var total int
+	if err := queryRowContext(r.Context(), "SELECT count(*) FROM audit_log"+where.String(), where.args...).Scan(&total); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	query := "SELECT id, actor, action, resource, resource_id, detail, created_at FROM audit_log" + where.String() +
+		" ORDER BY created_at DESC, id DESC LIMIT " + where.arg(p.Limit) + " OFFSET " + where.arg(p.Offset)
+	rows, err := queryContext(r.Context(), query, where.args...)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	entries, err := scanAll(rows, func(rows *sql.Rows) (auditEntry, error) {
+		var e auditEntry
+		var detail []byte
+		err := rows.Scan(&e.ID, &e.Actor, &e.Action, &e.Resource, &e.ResourceID, &detail, &e.CreatedAt)
+		e.Detail = detail
+		return e, err
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	setPageHeaders(w, r, p, total)
+	writeJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+var errBatchTooLarge = newError(http.StatusRequestEntityTooLarge, "batch_too_large", "the batch has too many items")
+
+// decodeBatch decodes a JSON array of at most max items from the request body.
+// The array is decoded an item at a time, so an oversized batch is rejected as
+// soon as the item over the limit is reached rather than after reading it all
+// into memory.
+func decodeBatch[T any](r *http.Request, max int) ([]T, error) {
+	dec := json.NewDecoder(newDepthLimitReader(r.Body, cfg.MaxJSONDepth))
+	dec.UseNumber()
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, jsonError(err)
+	}
+	if tok != json.Delim('[') {
+		return nil, newError(http.StatusBadRequest, "invalid_json", "expected a JSON array")
+	}
+	var items []T
+	for dec.More() {
+		if len(items) == max {
+			return nil, errBatchTooLarge
+		}
+		var item T
+		if err := dec.Decode(&item); err != nil {
+			return nil, jsonError(fmt.Errorf("item %d: %w", len(items), err))
+		}
+		items = append(items, item)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, jsonError(err)
+	}
+	if dec.More() {
+		return nil, newError(http.StatusBadRequest, "invalid_json", "unexpected data after the JSON value")
+	}
+	return items, nil
+}
+
+// indexErrors adds the field errors in err, if any, to errs with their fields
+// prefixed by the index of the batch item they belong to, such as "2.email".
+// It returns other errors unchanged.
+func indexErrors(errs fieldErrors, i int, err error) error {
+	apiErr, ok := err.(*apiError)
+	if !ok || apiErr.Fields == nil {
+		return err
+	}
+	for field, msg := range apiErr.Fields {
+		errs[fmt.Sprintf("%d.%s", i, field)] = msg
+	}
+	return nil
+}
+
+// Values of the batch ?on_error= parameter.
+const (
+	onErrorAbort    = "abort"
+	onErrorContinue = "continue"
+)
+
+// createUsers inserts a batch of users in a single transaction, so either all
+// of them are created or none are.
+//
+// With ?on_error=continue the users that can be created are, and those that
+// can't are reported individually, with a 207 Multi-Status. See
+// createUsersPartially.
+func createUsers(w http.ResponseWriter, r *http.Request) {
+	onError := r.URL.Query().Get("on_error")
+	if onError != "" && onError != onErrorAbort && onError != onErrorContinue {
+		writeError(w, r, newError(http.StatusBadRequest, "invalid_on_error", "on_error must be abort or continue"))
+		return
+	}
+	inputs, err := decodeBatch[userInput](r, cfg.MaxBatchSize)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if onError == onErrorContinue {
+		createUsersPartially(w, r, inputs)
+		return
+	}
+	users := make([]User, len(inputs))
+	errs := fieldErrors{}
+	for i, in := range inputs {
+		users[i] = in.user()
+		if err := indexErrors(errs, i, prepareUser(&users[i])); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	if err := errs.err(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	for _, u := range users {
+		if err := checkPreCreateHook(r.Context(), u); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	ctx := r.Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+	for i := range users {
+		err := tx.QueryRowContext(ctx,
+			"INSERT INTO users (name, email, email_hash) VALUES ($1, $2, $3) RETURNING "+userColumns,
+			users[i].Name, storedEmail(users[i].Email), emailHash(users[i].Email),
+		).Scan(users[i].fields()...)
+		if isUniqueViolation(err) {
+			writeError(w, r, errEmailTaken)
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	for _, u := range users {
+		events.Publish(event{Type: "user.saved", Data: u})
+	}
+	writeJSON(w, http.StatusCreated, users)
+}
+
+// batchError is why one item of a batch failed.
+type batchError struct {
+	Index  int               `json:"index"`
+	Code   string            `json:"code"`
+	Reason string            `json:"reason"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+type partialUsers struct {
+	Created []User       `json:"created"`
+	Errors  []batchError `json:"errors"`
+}
+
+// createUsersPartially creates each user in the batch that is valid, accepted
+// by the pre-create hook, and doesn't have a taken email, reporting the rest.
+// Each insert has its own savepoint so that a failure doesn't abort the
+// transaction. Errors that aren't the fault of an item, such as the database
+// being unavailable, still fail the whole batch.
+func createUsersPartially(w http.ResponseWriter, r *http.Request, inputs []userInput) {
+	result := partialUsers{Created: []User{}, Errors: []batchError{}}
+	// itemFailed records err against item i if it is specific to the item,
+	// and reports whether it was.
+	itemFailed := func(i int, err error) bool {
+		apiErr, ok := err.(*apiError)
+		if !ok || apiErr.Status >= http.StatusInternalServerError {
+			return false
+		}
+		result.Errors = append(result.Errors, batchError{Index: i, Code: apiErr.Code, Reason: apiErr.Message, Fields: apiErr.Fields})
+		return true
+	}
+	ctx := r.Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+	for i, in := range inputs {
+		u := in.user()
+		err := prepareUser(&u)
+		if err == nil {
+			err = checkPreCreateHook(ctx, u)
+		}
+		if err == nil {
+			err = insertUserSavepoint(ctx, tx, &u)
+		}
+		if err == nil {
+			result.Created = append(result.Created, u)
+			continue
+		}
+		if !itemFailed(i, err) {
+			writeError(w, r, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	for _, u := range result.Created {
+		events.Publish(event{Type: "user.saved", Data: u})
+	}
+	writeJSON(w, http.StatusMultiStatus, result)
+}
+
+// insertUserSavepoint inserts u as part of tx, rolling back only the insert
+// if it fails.
+func insertUserSavepoint(ctx context.Context, tx *sql.Tx, u *User) error {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT batch_item"); err != nil {
+		return err
+	}
+	err := tx.QueryRowContext(ctx,
+		"INSERT INTO users (name, email, email_hash) VALUES ($1, $2, $3) RETURNING "+userColumns,
+		u.Name, storedEmail(u.Email), emailHash(u.Email),
+	).Scan(u.fields()...)
+	if err != nil {
+		if _, rbErr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT batch_item"); rbErr != nil {
+			return rbErr
+		}
+		if isUniqueViolation(err) {
+			return errEmailTaken
+		}
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT batch_item")
+	return err
+}
+
+// usersExist reports which of a list of user ids exist, as a map from id, as
+// given, to whether it does. Deleted users don't exist.
+func usersExist(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs []bodyID `json:"ids"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if len(req.IDs) > cfg.MaxBatchSize {
+		writeError(w, r, errBatchTooLarge)
+		return
+	}
+	given := slices.Clone(req.IDs)
+	ids, err := resolveIDList(r.Context(), "users", "ids", req.IDs)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	rows, err := queryContext(r.Context(), "SELECT id FROM users WHERE id = ANY($1) AND deleted_at IS NULL", ids)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	found, err := collectIDs(rows)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	live := make(map[int]bool, len(found))
+	for _, id := range found {
+		live[id] = true
+	}
+	exists := make(map[bodyID]bool, len(given))
+	for i, id := range ids {
+		exists[given[i]] = live[id]
+	}
+	writeJSON(w, http.StatusOK, exists)
+}
+
+type usersBatch struct {
+	Users []User `json:"users"`
+	// NotFound and Invalid are the ids that weren't found, and that aren't
+	// ids at all, as they were given.
+	NotFound []any `json:"not_found"`
+	Invalid  []any `json:"invalid"`
+}
+
+// getUsersBatch reads the users with a list of ids, given as integers or
+// strings, reporting the ids that weren't found or aren't valid separately
+// rather than failing the request. Inactive users aren't found unless
+// ?include_inactive=true.
+func getUsersBatch(w http.ResponseWriter, r *http.Request) {
+	inactive, err := includeInactive(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	loc, err := timeZoneParam(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var req struct {
+		IDs []any `json:"ids"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if len(req.IDs) > cfg.MaxBatchSize {
+		writeError(w, r, errBatchTooLarge)
+		return
+	}
+	result := usersBatch{Users: []User{}, NotFound: []any{}, Invalid: []any{}}
+	var given []any
+	for _, v := range req.IDs {
+		if id, ok := batchID(v); ok {
+			given = append(given, id)
+		} else {
+			result.Invalid = append(result.Invalid, v)
+		}
+	}
+	bodyIDs := make([]bodyID, len(given))
+	for i, id := range given {
+		bodyIDs[i] = bodyID(fmt.Sprint(id))
+	}
+	ids, err := resolveIDList(r.Context(), "users", "ids", bodyIDs)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	query := "SELECT " + userColumns + " FROM users WHERE id = ANY($1) AND deleted_at IS NULL"
+	if !inactive {
+		query += " AND active"
+	}
+	rows, err := queryContext(r.Context(), query, ids)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	users, err := scanAll(rows, scanUser)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	byID := make(map[int]User, len(users))
+	for _, u := range users {
+		u.inZone(loc)
+		byID[u.ID] = u
+	}
+	// Results follow the order of the request, each id once.
+	seen := make(map[any]bool, len(given))
+	for i, id := range ids {
+		if seen[given[i]] {
+			continue
+		}
+		seen[given[i]] = true
+		if u, ok := byID[id]; ok {
+			result.Users = append(result.Users, u)
+		} else {
+			result.NotFound = append(result.NotFound, given[i])
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// batchID converts an id given as a JSON number or string to an int, or with
+// ID_TYPE=uuid, a string to a UUID.
+func batchID(v any) (any, bool) {
+	var s string
+	switch v := v.(type) {
+	case json.Number:
+		s = v.String()
+	case string:
+		s = v
+	default:
+		return nil, false
+	}
+	if uuidIDs() {
+		u, err := parseUUID(s)
+		return u, err == nil
+	}
+	id, err := strconv.Atoi(s)
+	return id, err == nil
+}
+
+type emailValidation struct {
+	Email string `json:"email"`
+	Valid bool   `json:"valid"`
+	// Normalized is the email as createUser would store it.
+	Normalized string `json:"normalized"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// validateEmails checks a list of emails as createUser would, without
+// touching the database, so that a list can be checked before it's imported.
+// An email that normalizes to the same as an earlier one in the list is
+// invalid, as importing both would fail.
+func validateEmails(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Emails []string `json:"emails"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if len(req.Emails) > cfg.MaxBatchSize {
+		writeError(w, r, errBatchTooLarge)
+		return
+	}
+	results := make([]emailValidation, len(req.Emails))
+	first := make(map[string]int, len(req.Emails))
+	for i, email := range req.Emails {
+		normalized := normalizeEmail(email)
+		results[i] = emailValidation{Email: email, Valid: true, Normalized: normalized}
+		errs := fieldErrors{}
+		errs.email("email", normalized)
+		if reason, ok := errs["email"]; ok {
+			results[i].Valid, results[i].Reason = false, reason
+		} else if j, ok := first[normalized]; ok {
+			results[i].Valid, results[i].Reason = false, fmt.Sprintf("duplicates the email at index %d", j)
+		} else {
+			first[normalized] = i
+		}
+	}
+	writeJSON(w, http.StatusOK, results)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// endlessArray is a JSON array of users that never ends, counting how much of
+// it has been read.
+type endlessArray struct {
+	read    int
+	started bool
+}
+
+func (a *endlessArray) Read(p []byte) (int, error) {
+	item := `{"name":"Alice","email":"alice@example.com"},`
+	if !a.started {
+		a.started = true
+		item = "[" + item
+	}
+	n := copy(p, item)
+	a.read += n
+	return n, nil
+}
+
+func TestDecodeBatchStopsAtLimit(t *testing.T) {
+	body := &endlessArray{}
+	r := httptest.NewRequest("POST", "/users/batch", io.NopCloser(body))
+	if _, err := decodeBatch[userInput](r, 3); err != errBatchTooLarge {
+		t.Fatalf("got %v, want errBatchTooLarge", err)
+	}
+	// The decoder reads ahead in small chunks, so little more than the
+	// allowed items should have been read.
+	if body.read > 8<<10 {
+		t.Errorf("read %d bytes before rejecting the batch", body.read)
+	}
+}
+
+func TestDecodeBatch(t *testing.T) {
+	items := strings.Repeat(`{"name":"Alice","email":"alice@example.com"},`, 3)
+	body := "[" + strings.TrimSuffix(items, ",") + "]"
+	got, err := decodeBatch[userInput](httptest.NewRequest("POST", "/users/batch", strings.NewReader(body)), 3)
+	if err != nil || len(got) != 3 || got[2].Name != "Alice" {
+		t.Errorf("got %+v, %v", got, err)
+	}
+	for _, body := range []string{`{"name":"Alice"}`, `[{"name":"Alice"}`, `[] []`} {
+		_, err := decodeBatch[userInput](httptest.NewRequest("POST", "/users/batch", strings.NewReader(body)), 3)
+		if e, ok := err.(*apiError); !ok || e.Status != http.StatusBadRequest {
+			t.Errorf("%s: got %v, want a 400", body, err)
+		}
+	}
+}
+
+func TestCreateUsersRejectsOversizedBatch(t *testing.T) {
+	setConfig(t, func(c *config) { c.MaxBatchSize = 2 })
+	h := newHandler(newMux())
+	body := `[{"name":"A","email":"a@example.com"},{"name":"B","email":"b@example.com"},{"name":"C","email":"c@example.com"}]`
+	w := serve(h, jsonRequest("POST", "/users/batch", body))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got %d %s, want 413", w.Code, w.Body)
+	}
+}
+
+func TestUsersExist(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	alice := createTestUser(t, h, "Alice", "alice@example.com")
+	bob := createTestUser(t, h, "Bob", "bob@example.com")
+	if w := serve(h, httptest.NewRequest("DELETE", userPath(bob.ID), nil)); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	missing := bob.ID + 1
+	body := fmt.Sprintf(`{"ids":[%d,%d,%d,%d]}`, alice.ID, bob.ID, missing, alice.ID)
+	w := serve(h, jsonRequest("POST", "/users/exists", body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	want := map[string]bool{strconv.Itoa(alice.ID): true, strconv.Itoa(bob.ID): false, strconv.Itoa(missing): false}
+	if got := responseAs[map[string]bool](t, w); !maps.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	w = serve(h, jsonRequest("POST", "/users/exists", `{"ids":[]}`))
+	if got := responseAs[map[string]bool](t, w); w.Code != http.StatusOK || len(got) != 0 {
+		t.Errorf("no ids: got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestUsersExistRejectsOversizedBatch(t *testing.T) {
+	setConfig(t, func(c *config) { c.MaxBatchSize = 2 })
+	h := newHandler(newMux())
+	if w := serve(h, jsonRequest("POST", "/users/exists", `{"ids":[1,2,3]}`)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got %d %s, want 413", w.Code, w.Body)
+	}
+	if w := serve(h, jsonRequest("POST", "/users/exists", `{"ids":["one"]}`)); w.Code != http.StatusBadRequest {
+		t.Errorf("non-integer id: got %d %s, want 400", w.Code, w.Body)
+	}
+}
+
+func TestCreateUsersRejectsUnknownOnError(t *testing.T) {
+	h := newHandler(newMux())
+	w := serve(h, jsonRequest("POST", "/users/batch?on_error=skip", `[{"name":"A","email":"a@example.com"}]`))
+	if w.Code != http.StatusBadRequest || responseAs[errorBody](t, w).Error.Code != "invalid_on_error" {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestGetUsersBatch(t *testing.T) {
+	now := time.Now()
+	// Users 1 and 2 are the only ones.
+	fakeDB(t, scriptedDriver{func(query string) *scriptedRows {
+		return &scriptedRows{
+			columns: strings.Split(userColumns, ", "),
+			values: [][]driver.Value{
+				{int64(1), "Alice", "alice@example.com", true, now, now, "0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d90"},
+				{int64(2), "Bob", "bob@example.com", true, now, now, "0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d91"},
+			},
+		}
+	}})
+	h := newHandler(newMux())
+	w := serve(h, jsonRequest("POST", "/users/batch-get", `{"ids":[2, 9, "abc", "1", 1.5, null, 10, 1, {}]}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	var got struct {
+		Users    []User `json:"users"`
+		NotFound []int  `json:"not_found"`
+		Invalid  []any  `json:"invalid"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	// Users follow the order of the request, each once.
+	if len(got.Users) != 2 || got.Users[0].Name != "Bob" || got.Users[1].Name != "Alice" {
+		t.Errorf("users: got %+v", got.Users)
+	}
+	if !slices.Equal(got.NotFound, []int{9, 10}) {
+		t.Errorf("not found: got %v", got.NotFound)
+	}
+	if want := []any{"abc", 1.5, nil, map[string]any{}}; fmt.Sprint(got.Invalid) != fmt.Sprint(want) {
+		t.Errorf("invalid: got %v, want %v", got.Invalid, want)
+	}
+
+	w = serve(h, jsonRequest("POST", "/users/batch-get", `{"ids":[]}`))
+	if w.Code != http.StatusOK || w.Body.String() != `{"users":[],"not_found":[],"invalid":[]}`+"\n" {
+		t.Errorf("no ids: got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestGetUsersBatchRejectsOversizedBatch(t *testing.T) {
+	setConfig(t, func(c *config) { c.MaxBatchSize = 2 })
+	h := newHandler(newMux())
+	// Malformed ids count towards the limit too.
+	if w := serve(h, jsonRequest("POST", "/users/batch-get", `{"ids":[1,"two",3]}`)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got %d %s, want 413", w.Code, w.Body)
+	}
+}
+
+func TestValidateEmails(t *testing.T) {
+	// It mustn't touch the database.
+	fakeDB(t, scriptedDriver{func(query string) *scriptedRows {
+		t.Errorf("queried %s", query)
+		return &scriptedRows{}
+	}})
+	h := newHandler(newMux())
+	emails := []string{
+		"Alice@Example.com",
+		" bob@example.com ",
+		"nope",
+		"",
+		"Alice <alice@example.com>",
+		"alice@example.COM",
+		"carol+tag@example.com",
+		"carol@example.com",
+		strings.Repeat("a", 250) + "@example.com",
+	}
+	body, _ := json.Marshal(map[string]any{"emails": emails})
+	w := serve(h, jsonRequest("POST", "/users/validate-emails", string(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	got := responseAs[[]emailValidation](t, w)
+	want := []emailValidation{
+		{Email: emails[0], Valid: true, Normalized: "alice@example.com"},
+		{Email: emails[1], Valid: true, Normalized: "bob@example.com"},
+		{Email: emails[2], Normalized: "nope", Reason: "must be a valid email address"},
+		{Email: emails[3], Reason: "is required"},
+		{Email: emails[4], Normalized: "alice <alice@example.com>", Reason: "must be a valid email address"},
+		{Email: emails[5], Normalized: "alice@example.com", Reason: "duplicates the email at index 0"},
+		{Email: emails[6], Valid: true, Normalized: "carol+tag@example.com"},
+		{Email: emails[7], Valid: true, Normalized: "carol@example.com"},
+		{Email: emails[8], Normalized: strings.ToLower(emails[8]), Reason: "must be at most 254 characters"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+
+	// The results agree with createUser.
+	useMemoryRepositories(t)
+	for _, v := range got {
+		body, _ := json.Marshal(map[string]string{"name": "User", "email": v.Email})
+		w := serve(h, jsonRequest("POST", "/users", string(body)))
+		if created := w.Code == http.StatusCreated; created != v.Valid {
+			t.Errorf("%q: valid %v, but creating it got %d %s", v.Email, v.Valid, w.Code, w.Body)
+		} else if created && responseAs[User](t, w).Email != v.Normalized {
+			t.Errorf("%q: normalized to %q, but created %s", v.Email, v.Normalized, w.Body)
+		}
+	}
+}
+
+func TestValidateEmailsRejectsOversizedBatch(t *testing.T) {
+	setConfig(t, func(c *config) { c.MaxBatchSize = 2 })
+	h := newHandler(newMux())
+	if w := serve(h, jsonRequest("POST", "/users/validate-emails", `{"emails":["a@example.com","b@example.com","c@example.com"]}`)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got %d %s, want 413", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruCache is a size-bounded, TTL-expiring cache safe for concurrent use.
+//
+// A nil *lruCache is a valid, permanently empty cache.
+type lruCache[K comparable, V any] struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[K]*list.Element
+	// gen is bumped on every Delete so that a value read from the database
+	// before an invalidation is never stored after it.
+	gen uint64
+}
+
+type lruEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+// newLRUCache returns a cache holding at most size entries, or nil if size is
+// not positive.
+func newLRUCache[K comparable, V any](size int, ttl time.Duration) *lruCache[K, V] {
+	if size <= 0 {
+		return nil
+	}
+	return &lruCache[K, V]{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: map[K]*list.Element{},
+	}
+}
+
+func (c *lruCache[K, V]) Get(key K) (V, bool) {
+	var zero V
+	if c == nil {
+		return zero, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return zero, false
+	}
+	entry := el.Value.(*lruEntry[K, V])
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return zero, false
+	}
+	c.ll.MoveToFront(el)
+	return entry.value, true
+}
+
+// Generation returns a token to pass to Set. Take it before reading the value
+// being cached.
+func (c *lruCache[K, V]) Generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// Set stores value under key, unless the cache has been invalidated since gen
+// was obtained.
+func (c *lruCache[K, V]) Set(key K, value V, gen uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	expires := time.Now().Add(c.ttl)
+	if el, ok := c.items[key]; ok {
+		el.Value = &lruEntry[K, V]{key: key, value: value, expires: expires}
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry[K, V]{key: key, value: value, expires: expires})
+	for c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry[K, V]).key)
+	}
+}
+
+func (c *lruCache[K, V]) Delete(key K) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+// DeleteFunc deletes the entries for which match returns true.
+func (c *lruCache[K, V]) DeleteFunc(match func(K, V) bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for key, el := range c.items {
+		if match(key, el.Value.(*lruEntry[K, V]).value) {
+			c.ll.Remove(el)
+			delete(c.items, key)
+		}
+	}
+}
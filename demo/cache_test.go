@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLRUCache[int, string](2, time.Minute)
+	c.Set(1, "a", c.Generation())
+	c.Set(2, "b", c.Generation())
+	c.Get(1)
+	c.Set(3, "c", c.Generation())
+	if _, ok := c.Get(2); ok {
+		t.Error("2 was not evicted")
+	}
+	for _, key := range []int{1, 3} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%d was evicted", key)
+		}
+	}
+}
+
+func TestLRUCacheExpires(t *testing.T) {
+	c := newLRUCache[int, string](2, time.Millisecond)
+	c.Set(1, "a", c.Generation())
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.Get(1); ok {
+		t.Error("expired entry was returned")
+	}
+}
+
+func TestLRUCacheDropsValuesReadBeforeDelete(t *testing.T) {
+	c := newLRUCache[int, string](2, time.Minute)
+	gen := c.Generation()
+	// The value is read, then invalidated by a concurrent write, before it
+	// is stored.
+	c.Delete(1)
+	c.Set(1, "stale", gen)
+	if v, ok := c.Get(1); ok {
+		t.Errorf("got %q after invalidation", v)
+	}
+}
+
+func TestLRUCacheDeleteFunc(t *testing.T) {
+	c := newLRUCache[int, string](3, time.Minute)
+	for key, v := range map[int]string{1: "a", 2: "b", 3: "a"} {
+		c.Set(key, v, c.Generation())
+	}
+	gen := c.Generation()
+	c.DeleteFunc(func(_ int, v string) bool { return v == "a" })
+	for key, want := range map[int]bool{1: false, 2: true, 3: false} {
+		if _, ok := c.Get(key); ok != want {
+			t.Errorf("%d: present %v, want %v", key, ok, want)
+		}
+	}
+	c.Set(1, "stale", gen)
+	if v, ok := c.Get(1); ok {
+		t.Errorf("got %q after invalidation", v)
+	}
+}
+
+func TestLRUCacheDisabled(t *testing.T) {
+	c := newLRUCache[int, string](0, time.Minute)
+	if c != nil {
+		t.Fatal("size 0 should disable the cache")
+	}
+	c.Set(1, "a", c.Generation())
+	c.Delete(1)
+	c.DeleteFunc(func(int, string) bool { return true })
+	if _, ok := c.Get(1); ok {
+		t.Error("disabled cache returned a value")
+	}
+}
+
+func TestLRUCacheConcurrent(t *testing.T) {
+	c := newLRUCache[int, int](10, time.Minute)
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Go(func() {
+			for j := range 1000 {
+				key := (i + j) % 20
+				if v, ok := c.Get(key); ok && v != key {
+					t.Errorf("got %d for %d", v, key)
+				}
+				c.Set(key, key, c.Generation())
+				if j%10 == 0 {
+					c.Delete(key)
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cachePolicy is how responses from a route may be cached.
+type cachePolicy struct {
+	// cacheControl is the Cache-Control of successful responses. Error
+	// responses are never stored.
+	cacheControl string
+	// vary lists the request headers the response depends on, besides
+	// Accept-Encoding and Origin, which withCompression and withCORS add.
+	// Query parameters are part of the URL that caches key on, so a
+	// response that depends on one, such as ?tz, needs no Vary.
+	vary []string
+}
+
+// defaultCachePolicy is the policy of routes not in cachePolicies. Every
+// error can be negotiated as application/problem+json, so every route varies
+// on Accept.
+var defaultCachePolicy = cachePolicy{cacheControl: "no-store", vary: []string{"Accept"}}
+
+// maxAge returns a Cache-Control allowing a response to be cached for d.
+func maxAge(d time.Duration) string {
+	return "max-age=" + strconv.Itoa(int(d.Seconds()))
+}
+
+// cachePolicies are the policies of routes that differ from
+// defaultCachePolicy, by route pattern without cfg.BasePath.
+var cachePolicies = map[string]cachePolicy{
+	"GET /events":                 {cacheControl: "no-cache", vary: []string{"Accept"}},
+	"GET /stats":                  {cacheControl: maxAge(statsMaxAge), vary: []string{"Accept"}},
+	"GET /stats/users-by-country": {cacheControl: maxAge(statsMaxAge), vary: []string{"Accept"}},
+	"GET /addresses/by-country":   {cacheControl: maxAge(countryCountMaxAge), vary: []string{"Accept"}},
+	// These have ETags, so clients may keep them as long as they revalidate
+	// them. Admins may see inactive users and their addresses, so they vary
+	// on Authorization. GET /users/{id}/{sub} serves both
+	// /users/{id}/summary and /users/by-email/{email}.
+	"GET /users/{id}":       {cacheControl: "private, no-cache", vary: []string{"Accept", "Authorization"}},
+	"GET /users/{id}/{sub}": {cacheControl: "private, no-cache", vary: []string{"Accept", "Authorization"}},
+	"GET /addresses/{id}":   {cacheControl: "private, no-cache", vary: []string{"Accept", "Authorization"}},
+}
+
+// withCachePolicy sets the Cache-Control and Vary headers of each response
+// according to its route's cachePolicy, so that caching is decided in one
+// place rather than by each handler.
+func withCachePolicy(next http.Handler) http.Handler {
+	policies := make(map[string]cachePolicy, len(cachePolicies))
+	for pattern, policy := range cachePolicies {
+		policies[route(pattern)] = policy
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy, ok := policies[routePattern(r)]
+		if !ok {
+			policy = defaultCachePolicy
+		}
+		if len(policy.vary) > 0 {
+			w.Header().Add("Vary", strings.Join(policy.vary, ", "))
+		}
+		next.ServeHTTP(&cachePolicyWriter{ResponseWriter: w, cacheControl: policy.cacheControl}, r)
+	})
+}
+
+// cachePolicyWriter sets Cache-Control just before the response header is
+// sent, once the status is known.
+type cachePolicyWriter struct {
+	http.ResponseWriter
+	cacheControl string
+	wroteHeader  bool
+}
+
+func (c *cachePolicyWriter) WriteHeader(status int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		cacheControl := c.cacheControl
+		if status >= http.StatusBadRequest {
+			cacheControl = "no-store"
+		}
+		c.Header().Set("Cache-Control", cacheControl)
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *cachePolicyWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *cachePolicyWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
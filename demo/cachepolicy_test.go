@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCachePolicy(t *testing.T) {
+	setConfig(t, func(c *config) { c.BasePath = "/api" })
+	mux := testMux(t)
+	status := http.StatusOK
+	h := withRoute(mux, withCachePolicy(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})))
+	want := map[string]struct{ cacheControl, vary string }{
+		"GET /events":                 {"no-cache", "Accept"},
+		"GET /stats":                  {"max-age=60", "Accept"},
+		"GET /stats/users-by-country": {"max-age=60", "Accept"},
+		"GET /addresses/by-country":   {"max-age=60", "Accept"},
+		"GET /users/{id}":             {"private, no-cache", "Accept, Authorization"},
+		"GET /users/{id}/{sub}":       {"private, no-cache", "Accept, Authorization"},
+		"GET /addresses/{id}":         {"private, no-cache", "Accept, Authorization"},
+	}
+	for _, pattern := range testRoutes {
+		method, _, _ := strings.Cut(pattern, " ")
+		target := "/api" + samplePath(pattern)
+		policy, ok := want[pattern]
+		if !ok {
+			policy.cacheControl, policy.vary = "no-store", "Accept"
+		}
+
+		status = http.StatusOK
+		w := serve(h, httptest.NewRequest(method, target, nil))
+		if got := w.Header().Get("Cache-Control"); got != policy.cacheControl {
+			t.Errorf("%s: Cache-Control %q, want %q", pattern, got, policy.cacheControl)
+		}
+		if got := strings.Join(w.Header().Values("Vary"), ", "); got != policy.vary {
+			t.Errorf("%s: Vary %q, want %q", pattern, got, policy.vary)
+		}
+
+		// Errors are never stored, but still vary like successes.
+		status = http.StatusNotFound
+		w = serve(h, httptest.NewRequest(method, target, nil))
+		if got := w.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("%s: error Cache-Control %q", pattern, got)
+		}
+		if got := strings.Join(w.Header().Values("Vary"), ", "); got != policy.vary {
+			t.Errorf("%s: error Vary %q, want %q", pattern, got, policy.vary)
+		}
+	}
+}
+
+func TestCachePolicyVaryWithCompression(t *testing.T) {
+	useMemoryRepositories(t)
+	h := newHandler(newMux())
+	u := createTestUser(t, h, "Alice", "alice@example.com")
+	r := httptest.NewRequest("GET", userPath(u.ID), nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := serve(h, r)
+	if got := w.Header().Get("Cache-Control"); got != "private, no-cache" {
+		t.Errorf("Cache-Control %q", got)
+	}
+	vary := strings.Join(w.Header().Values("Vary"), ", ")
+	for _, header := range []string{"Accept", "Authorization", "Accept-Encoding"} {
+		if !strings.Contains(vary, header) {
+			t.Errorf("Vary %q lacks %s", vary, header)
+		}
+	}
+}
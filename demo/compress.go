@@ -0,0 +1,163 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// supportedEncodings are the response encodings we can produce, in order of
+// preference when the client has no preference between them.
+var supportedEncodings = []string{"br", "gzip", "identity"}
+
+// withCompression compresses responses with the client's most preferred
+// supported Accept-Encoding.
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "identity" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+var (
+	errUnsupportedEncoding = newError(http.StatusUnsupportedMediaType, "unsupported_encoding", "Content-Encoding must be gzip or identity")
+	errBodyTooLarge        = newError(http.StatusRequestEntityTooLarge, "body_too_large", "the request body is too large")
+)
+
+// withRequestDecompression decompresses gzip request bodies, and limits every
+// body to cfg.MaxBodyBytes. The limit applies after decompression, so a small
+// compressed body can't expand without bound.
+func withRequestDecompression(next http.Handler) http.Handler {
+	// Imports are expected to be large, and are admin only.
+	exempt := route("POST /admin/import")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+		case "", "identity":
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				writeError(w, r, newError(http.StatusBadRequest, "invalid_body", "invalid gzip body: "+err.Error()))
+				return
+			}
+			defer zr.Close()
+			r.Body = zr
+			r.Header.Del("Content-Encoding")
+			r.ContentLength = -1
+		default:
+			w.Header().Set("Accept-Encoding", "gzip")
+			writeError(w, r, errUnsupportedEncoding)
+			return
+		}
+		if cfg.MaxBodyBytes > 0 && routePattern(r) != exempt {
+			r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBodyBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// negotiateEncoding picks the supported encoding with the highest q-value in
+// an Accept-Encoding header, falling back to identity if none is acceptable.
+func negotiateEncoding(header string) string {
+	q := map[string]float64{}
+	wildcard := -1.0
+	for part := range strings.SplitSeq(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				weight = f
+			}
+		}
+		if name == "*" {
+			wildcard = weight
+		} else {
+			q[name] = weight
+		}
+	}
+	best, bestQ := "identity", 0.0
+	for _, encoding := range supportedEncodings {
+		weight, ok := q[encoding]
+		if !ok {
+			weight = wildcard
+		}
+		if weight > bestQ {
+			best, bestQ = encoding, weight
+		}
+	}
+	return best
+}
+
+// compressWriter compresses the body unless the handler's response is
+// unsuitable for compression.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	enc         io.WriteCloser
+	wroteHeader bool
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+	h := c.Header()
+	if status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && !strings.HasPrefix(h.Get("Content-Type"), "text/event-stream") {
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+		if c.encoding == "br" {
+			c.enc = brotli.NewWriterLevel(c.ResponseWriter, cfg.BrotliLevel)
+		} else {
+			c.enc, _ = gzip.NewWriterLevel(c.ResponseWriter, cfg.GzipLevel)
+		}
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.enc != nil {
+		return c.enc.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// FlushError flushes buffered compressed data to the client. It is used by
+// http.ResponseController.
+func (c *compressWriter) FlushError() error {
+	if f, ok := c.enc.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+func (c *compressWriter) Close() error {
+	if c.enc == nil {
+		return nil
+	}
+	return c.enc.Close()
+}
+
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header, want string
+	}{
+		{"", "identity"},
+		{"gzip", "gzip"},
+		{"gzip, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"GZIP;q=0.8, identity;q=0.9", "identity"},
+		{"*", "br"},
+		{"*;q=0.5, br;q=0", "gzip"},
+		{"deflate, compress", "identity"},
+		{"gzip;q=0", "identity"},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.header); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestWithCompression(t *testing.T) {
+	body := strings.Repeat(`{"name":"Alice"}`, 100)
+	handler := withCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	}))
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"gzip":     func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"br":       func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		"identity": func(r io.Reader) (io.Reader, error) { return r, nil },
+	}
+	for encoding, decoder := range decoders {
+		r := httptest.NewRequest("GET", "/users", nil)
+		r.Header.Set("Accept-Encoding", encoding)
+		w := serve(handler, r)
+		got := w.Header().Get("Content-Encoding")
+		if encoding == "identity" && got != "" || encoding != "identity" && got != encoding {
+			t.Errorf("%s: Content-Encoding %q", encoding, got)
+		}
+		if vary := w.Header().Get("Vary"); vary != "Accept-Encoding" {
+			t.Errorf("%s: Vary %q", encoding, vary)
+		}
+		dec, err := decoder(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := io.ReadAll(dec); err != nil || string(data) != body {
+			t.Errorf("%s: decoded %d bytes, %v", encoding, len(data), err)
+		}
+	}
+}
+
+func TestWithCompressionSkipsUnsuitableResponses(t *testing.T) {
+	tests := map[string]http.HandlerFunc{
+		"no content": func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) },
+		"event stream": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: {}\n\n")
+		},
+	}
+	for name, h := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		if got := serve(withCompression(h), r).Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s: Content-Encoding %q", name, got)
+		}
+	}
+}
+
+func TestRequestDecompression(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.WriteString(zw, `{"name":"Alice"}`)
+	zw.Close()
+	var got string
+	handler := withRequestDecompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		got = string(data)
+	}))
+	r := httptest.NewRequest("POST", "/users", &buf)
+	r.Header.Set("Content-Encoding", "gzip")
+	serve(handler, r)
+	if got != `{"name":"Alice"}` {
+		t.Errorf("got %q", got)
+	}
+
+	r = httptest.NewRequest("POST", "/users", strings.NewReader("x"))
+	r.Header.Set("Content-Encoding", "br")
+	if w := serve(handler, r); w.Code != http.StatusUnsupportedMediaType || w.Header().Get("Accept-Encoding") != "gzip" {
+		t.Errorf("br body: %d, Accept-Encoding %q", w.Code, w.Header().Get("Accept-Encoding"))
+	}
+}
+
+// gzipRequest returns a POST request with body gzipped.
+func gzipRequest(target, body string) *http.Request {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.WriteString(zw, body)
+	zw.Close()
+	r := httptest.NewRequest("POST", target, &buf)
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Content-Encoding", "gzip")
+	return r
+}
+
+func TestRequestDecompressionLimitsExpandedBody(t *testing.T) {
+	setConfig(t, func(c *config) { c.MaxBodyBytes = 1024 })
+	h := newHandler(testMux(t))
+	// Compresses to far less than the limit, but expands to more than it.
+	body := `{"name":"` + strings.Repeat("a", 4096) + `","email":"a@example.com"}`
+	r := gzipRequest("/users", body)
+	if r.ContentLength >= cfg.MaxBodyBytes {
+		t.Fatalf("compressed body is %d bytes", r.ContentLength)
+	}
+	w := serve(h, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got %d %s, want 413", w.Code, w.Body)
+	}
+
+	r = gzipRequest("/users", "not gzip")
+	r.Body = io.NopCloser(strings.NewReader("not gzip"))
+	if w := serve(h, r); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid gzip: got %d %s, want 400", w.Code, w.Body)
+	}
+}
+
+func TestCreateUserGzipBody(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	w := serve(h, gzipRequest("/users", `{"name":"Alice","email":"alice@example.com"}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	if u := responseAs[User](t, w); u.Name != "Alice" || u.Email != "alice@example.com" {
+		t.Errorf("got %+v", u)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	setConfig(t, func(c *config) {
+		c.CORSAllowedOrigins = []string{"https://app.example.com"}
+		c.CORSMaxAge = time.Hour
+	})
+	handler := withCORS(http.NotFoundHandler())
+	r := httptest.NewRequest("OPTIONS", "/users", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", "PATCH")
+	r.Header.Set("Access-Control-Request-Headers", "Content-Type")
+	w := serve(handler, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("status %d", w.Code)
+	}
+	for name, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example.com",
+		"Access-Control-Allow-Headers": "Content-Type",
+		"Access-Control-Max-Age":       "3600",
+	} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestCORSExposeHeaders(t *testing.T) {
+	setConfig(t, func(c *config) {
+		c.CORSAllowedOrigins = []string{"*"}
+		c.CORSExposeHeaders = []string{"ETag", "X-Total-Count"}
+	})
+	handler := withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest("GET", "/users", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	if got := serve(handler, r).Header().Get("Access-Control-Expose-Headers"); got != "ETag, X-Total-Count" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestCORSDisallowedOrigin(t *testing.T) {
+	setConfig(t, func(c *config) { c.CORSAllowedOrigins = []string{"https://app.example.com"} })
+	handler := withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest("GET", "/users", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	w := serve(handler, r)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("allowed origin %q", got)
+	}
+	if got := w.Header().Get("Vary"); got != "Origin" {
+		t.Errorf("Vary %q", got)
+	}
+}
+
+func TestCORSDefaultExposeHeaders(t *testing.T) {
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.CORSMaxAge != 600*time.Second {
+		t.Errorf("CORS_MAX_AGE defaults to %v", c.CORSMaxAge)
+	}
+	for _, name := range []string{"ETag", "Link", "X-Total-Count", "X-Request-ID", "X-Cache"} {
+		if !slices.Contains(c.CORSExposeHeaders, name) {
+			t.Errorf("%s isn't exposed by default", name)
+		}
+	}
+}
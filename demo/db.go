@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	retryBaseDelay = 50 * time.Millisecond
+	retryMaxDelay  = time.Second
+)
+
+// replica is the read replica pool, or nil if there isn't one.
+var replica *sql.DB
+
+var replicaFallbacks = expvar.NewInt("db_replica_fallbacks_total")
+
+// queryContext runs a read-only query, retrying transient connection errors.
+// It runs on the replica if there is one, falling back to the primary if the
+// replica can't be reached and cfg.ReplicaFallback is set.
+//
+// Writes must not use this unless they are idempotent.
+func queryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	var rows *sql.Rows
+	err := onReplica(ctx, func(pool *sql.DB) error {
+		return retry(ctx, func() (err error) {
+			rows, err = pool.QueryContext(ctx, query, args...)
+			return err
+		})
+	})
+	return rows, err
+}
+
+// queryRowContext is the single row equivalent of queryContext.
+func queryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	var row *sql.Row
+	onReplica(ctx, func(pool *sql.DB) error {
+		return retry(ctx, func() error {
+			row = pool.QueryRowContext(ctx, query, args...)
+			return row.Err()
+		})
+	})
+	return row
+}
+
+// primaryQueryRowContext is queryRowContext on the primary, for reads that
+// are cached. A lagging replica could return a row older than the one whose
+// cache entry a write just invalidated, which would then be cached until it
+// expires.
+func primaryQueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	var row *sql.Row
+	retry(ctx, func() error {
+		row = db.QueryRowContext(ctx, query, args...)
+		return row.Err()
+	})
+	return row
+}
+
+// onReplica calls fn with the pool reads should use, and again with the
+// primary if that was the replica and it couldn't be reached.
+func onReplica(ctx context.Context, fn func(pool *sql.DB) error) error {
+	if replica == nil {
+		return fn(db)
+	}
+	err := fn(replica)
+	if err == nil || !cfg.ReplicaFallback || !isConnectionFailure(err) || ctx.Err() != nil {
+		return err
+	}
+	replicaFallbacks.Add(1)
+	log.Printf("WARN: replica unavailable, reading from primary: %v", err)
+	return fn(db)
+}
+
+// isConnectionFailure reports whether err means the database couldn't be
+// reached, rather than that the query failed.
+func isConnectionFailure(err error) bool {
+	var connectErr *pgconn.ConnectError
+	return errors.As(err, &connectErr) || isTransient(err)
+}
+
+// retry calls fn up to cfg.DBRetryAttempts times while it fails with a
+// transient error, sleeping with capped exponential backoff and full jitter
+// between attempts.
+func retry(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || !isTransient(err) || attempt+1 >= cfg.DBRetryAttempts {
+			return err
+		}
+		delay := min(retryBaseDelay<<attempt, retryMaxDelay)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(rand.N(delay)):
+		}
+	}
+}
+
+// pacer spaces out events so that at most a given number happen per second.
+type pacer struct {
+	mu       sync.Mutex
+	interval time.Duration
+	// next is when the next event may happen.
+	next time.Time
+}
+
+func newPacer(perSecond int) *pacer {
+	return &pacer{interval: time.Second / time.Duration(perSecond)}
+}
+
+// wait blocks until the caller's turn, or until ctx is done.
+func (p *pacer) wait(ctx context.Context) error {
+	p.mu.Lock()
+	now := time.Now()
+	at := p.next
+	if at.Before(now) {
+		at = now
+	}
+	p.next = at.Add(p.interval)
+	p.mu.Unlock()
+	if at.Equal(now) {
+		return nil
+	}
+	t := time.NewTimer(at.Sub(now))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// warmPool opens up to n connections at once, within the pool's open
+// connection limit, and returns them to the pool idle. It returns how many
+// were opened successfully.
+func warmPool(ctx context.Context, n int) int {
+	if limit := db.Stats().MaxOpenConnections; limit > 0 {
+		n = min(n, limit)
+	}
+	// The pool only keeps two idle connections by default, and would close
+	// the rest as soon as they were returned.
+	db.SetMaxIdleConns(max(n, 2))
+	conns := make([]*sql.Conn, n)
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Go(func() {
+			conn, err := db.Conn(ctx)
+			if err != nil {
+				log.Printf("warm database connection: %v", err)
+				return
+			}
+			if err := conn.PingContext(ctx); err != nil {
+				log.Printf("warm database connection: %v", err)
+				conn.Close()
+				return
+			}
+			conns[i] = conn
+		})
+	}
+	wg.Wait()
+	warmed := 0
+	for _, conn := range conns {
+		if conn != nil {
+			conn.Close()
+			warmed++
+		}
+	}
+	return warmed
+}
+
+// isTransient reports whether err is a connection failure that is likely to
+// succeed on a fresh connection, such as after a failover.
+func isTransient(err error) bool {
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "57P01", // admin_shutdown
+			"57P02", // crash_shutdown
+			"57P03", // cannot_connect_now
+			"08000", // connection_exception
+			"08003", // connection_does_not_exist
+			"08006": // connection_failure
+			return true
+		}
+		return false
+	}
+	return pgconn.SafeToRetry(err)
+}
+
+// isStatementTimeout reports whether err is a query cancelled by the server,
+// which is due to statement_timeout unless the query's context was cancelled.
+func isStatementTimeout(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "57014" // query_canceled
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// scanAll reads every row with scan, then closes rows. Unlike a bare
+// rows.Next loop, it reports errors that end iteration early.
+//
+// The result is never nil, so that no rows is encoded as [] rather than null.
+func scanAll[T any](rows *sql.Rows, scan func(*sql.Rows) (T, error)) ([]T, error) {
+	defer rows.Close()
+	all := []T{}
+	for rows.Next() {
+		v, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// collectIDs reads and closes rows of a single integer column.
+func collectIDs(rows *sql.Rows) ([]int, error) {
+	return scanAll(rows, func(rows *sql.Rows) (int, error) {
+		var id int
+		err := rows.Scan(&id)
+		return id, err
+	})
+}
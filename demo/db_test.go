@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// flakyDriver is a database driver whose queries fail with err until fails
+// reaches zero, and then return a single row holding 1.
+type flakyDriver struct {
+	err     error
+	fails   atomic.Int32
+	queries atomic.Int32
+}
+
+func (d *flakyDriver) Open(string) (driver.Conn, error) { return flakyConn{d}, nil }
+
+type flakyConn struct{ d *flakyDriver }
+
+func (c flakyConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	c.d.queries.Add(1)
+	if c.d.fails.Add(-1) >= 0 {
+		return nil, c.d.err
+	}
+	return &oneRow{}, nil
+}
+
+func (flakyConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (flakyConn) Close() error                        { return nil }
+func (flakyConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+type oneRow struct{ done bool }
+
+func (*oneRow) Columns() []string { return []string{"n"} }
+func (*oneRow) Close() error      { return nil }
+func (r *oneRow) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = int64(1)
+	return nil
+}
+
+// flakyDB replaces db with a pool whose queries fail fails times with err.
+func flakyDB(t *testing.T, err error, fails int32) *flakyDriver {
+	t.Helper()
+	d := &flakyDriver{err: err}
+	d.fails.Store(fails)
+	fakeDB(t, d)
+	return d
+}
+
+// fakeDB replaces db with a pool using d.
+func fakeDB(t *testing.T, d driver.Driver) {
+	t.Helper()
+	saved := db
+	db = sql.OpenDB(driverConnector{d})
+	t.Cleanup(func() {
+		db.Close()
+		db = saved
+	})
+}
+
+// fakeReplica makes a pool using d the read replica.
+func fakeReplica(t *testing.T, d driver.Driver) {
+	t.Helper()
+	saved := replica
+	replica = sql.OpenDB(driverConnector{d})
+	t.Cleanup(func() {
+		replica.Close()
+		replica = saved
+	})
+}
+
+// scriptedDriver is a database driver whose queries return the rows chosen
+// for them by rows.
+type scriptedDriver struct {
+	rows func(query string) *scriptedRows
+}
+
+func (d scriptedDriver) Open(string) (driver.Conn, error) { return scriptedConn(d), nil }
+
+type scriptedConn scriptedDriver
+
+func (c scriptedConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	return c.rows(query), nil
+}
+
+// CheckNamedValue accepts arguments of any type, such as the slices pgx
+// would send as arrays.
+func (scriptedConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+func (scriptedConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (scriptedConn) Close() error                        { return nil }
+func (scriptedConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+// scriptedRows returns values, and then fails with err if it isn't nil.
+type scriptedRows struct {
+	columns []string
+	values  [][]driver.Value
+	err     error
+}
+
+func (r *scriptedRows) Columns() []string { return r.columns }
+func (r *scriptedRows) Close() error      { return nil }
+func (r *scriptedRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		if r.err != nil {
+			return r.err
+		}
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+type driverConnector struct{ d driver.Driver }
+
+func (c driverConnector) Connect(context.Context) (driver.Conn, error) { return c.d.Open("") }
+func (c driverConnector) Driver() driver.Driver                        { return c.d }
+
+func TestQueryContextRetriesTransientErrors(t *testing.T) {
+	setConfig(t, func(c *config) { c.DBRetryAttempts = 3 })
+	for _, err := range []error{syscall.ECONNRESET, &pgconn.PgError{Code: "57P01"}} {
+		d := flakyDB(t, err, 1)
+		rows, err := queryContext(context.Background(), "SELECT 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids, err := collectIDs(rows); err != nil || len(ids) != 1 {
+			t.Errorf("got %v, %v", ids, err)
+		}
+		if n := d.queries.Load(); n != 2 {
+			t.Errorf("%d attempts, want 2", n)
+		}
+	}
+}
+
+func TestQueryRowContextRetriesTransientErrors(t *testing.T) {
+	setConfig(t, func(c *config) { c.DBRetryAttempts = 3 })
+	d := flakyDB(t, syscall.ECONNRESET, 2)
+	var n int
+	if err := queryRowContext(context.Background(), "SELECT 1").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.queries.Load(); n != 3 {
+		t.Errorf("%d attempts, want 3", n)
+	}
+}
+
+func TestQueryContextGivesUp(t *testing.T) {
+	setConfig(t, func(c *config) { c.DBRetryAttempts = 3 })
+	d := flakyDB(t, syscall.ECONNRESET, 10)
+	if _, err := queryContext(context.Background(), "SELECT 1"); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("got %v", err)
+	}
+	if n := d.queries.Load(); n != 3 {
+		t.Errorf("%d attempts, want 3", n)
+	}
+}
+
+func TestQueryContextDoesNotRetryQueryErrors(t *testing.T) {
+	setConfig(t, func(c *config) { c.DBRetryAttempts = 3 })
+	d := flakyDB(t, &pgconn.PgError{Code: "42P01"}, 1) // undefined_table
+	if _, err := queryContext(context.Background(), "SELECT 1"); err == nil {
+		t.Error("expected an error")
+	}
+	if n := d.queries.Load(); n != 1 {
+		t.Errorf("%d attempts, want 1", n)
+	}
+}
+
+func TestReplicaFallback(t *testing.T) {
+	setConfig(t, func(c *config) {
+		c.DBRetryAttempts = 1
+		c.ReplicaFallback = true
+	})
+	primary := flakyDB(t, nil, 0)
+	down := &flakyDriver{err: syscall.ECONNREFUSED}
+	down.fails.Store(1000)
+	fakeReplica(t, down)
+
+	fallbacks := replicaFallbacks.Value()
+	var n int
+	if err := queryRowContext(context.Background(), "SELECT 1").Scan(&n); err != nil || n != 1 {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	rows, err := queryContext(context.Background(), "SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	if got := primary.queries.Load(); got != 2 {
+		t.Errorf("primary served %d reads, want 2", got)
+	}
+	if got := replicaFallbacks.Value() - fallbacks; got != 2 {
+		t.Errorf("counted %d fallbacks, want 2", got)
+	}
+
+	// Queries that fail on the replica, rather than failing to reach it,
+	// would fail on the primary too.
+	broken := &flakyDriver{err: &pgconn.PgError{Code: "42P01"}} // undefined_table
+	broken.fails.Store(1000)
+	fakeReplica(t, broken)
+	if err := queryRowContext(context.Background(), "SELECT 1").Scan(&n); err == nil {
+		t.Error("query error: expected an error")
+	}
+	if got := primary.queries.Load(); got != 2 {
+		t.Errorf("query error: primary served %d reads, want 2", got)
+	}
+
+	setConfig(t, func(c *config) { c.ReplicaFallback = false })
+	fakeReplica(t, down)
+	if err := queryRowContext(context.Background(), "SELECT 1").Scan(&n); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("without fallback: got %v", err)
+	}
+	if got := primary.queries.Load(); got != 2 {
+		t.Errorf("without fallback: primary served %d reads, want 2", got)
+	}
+}
+
+func TestCachedReadsUsePrimary(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	const userUUID, addressUUID = "0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d90", "0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d91"
+	// The replica lags, still having the user's old name and address.
+	rows := func(name, street string) driver.Driver {
+		return scriptedDriver{func(query string) *scriptedRows {
+			if strings.Contains(query, "FROM addresses") {
+				return &scriptedRows{
+					columns: strings.Split(addressColumns, ", "),
+					values:  [][]driver.Value{{int64(1), int64(1), street, "Springfield", "US", "", nil, nil, now, now, addressUUID, userUUID}},
+				}
+			}
+			return &scriptedRows{
+				columns: strings.Split(userColumns, ", "),
+				values:  [][]driver.Value{{int64(1), name, "alice@example.com", true, now, now, userUUID}},
+			}
+		}}
+	}
+	fakeDB(t, rows("Alice", "2 New St"))
+	fakeReplica(t, rows("Old Alice", "1 Old St"))
+	saved := userCache
+	t.Cleanup(func() { userCache = saved })
+	userCache = newLRUCache[int, User](10, time.Minute)
+
+	h := newHandler(newMux())
+	if got := responseAs[User](t, serve(h, httptest.NewRequest("GET", "/users/1", nil))); got.Name != "Alice" {
+		t.Errorf("got user %q from the replica", got.Name)
+	}
+	if u, ok := userCache.Get(1); !ok || u.Name != "Alice" {
+		t.Errorf("cached %+v", u)
+	}
+	if got := responseAs[Address](t, serve(h, httptest.NewRequest("GET", "/addresses/1", nil))); got.Street != "2 New St" {
+		t.Errorf("got address %q from the replica", got.Street)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{syscall.ECONNRESET, true},
+		{&pgconn.PgError{Code: "57P01"}, true},
+		{&pgconn.PgError{Code: "08006"}, true},
+		{&pgconn.PgError{Code: "23505"}, false},
+		{sql.ErrNoRows, false},
+	}
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%v) = %v", tt.err, got)
+		}
+	}
+}
+
+func TestScanAllReportsIterationErrors(t *testing.T) {
+	errLost := errors.New("connection lost")
+	fakeDB(t, scriptedDriver{func(string) *scriptedRows {
+		return &scriptedRows{columns: []string{"id"}, values: [][]driver.Value{{int64(1)}, {int64(2)}}, err: errLost}
+	}})
+	rows, err := db.Query("SELECT id FROM users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := collectIDs(rows); !errors.Is(err, errLost) || ids != nil {
+		t.Errorf("got %v, %v; want no ids and the iteration error", ids, err)
+	}
+}
+
+func TestListAddressesReportsRowErrors(t *testing.T) {
+	now := time.Now()
+	address := func(id int64) []driver.Value {
+		return []driver.Value{id, int64(1), "1 Main St", "Springfield", "US", "", nil, nil, now, now}
+	}
+	fakeDB(t, scriptedDriver{func(query string) *scriptedRows {
+		if strings.HasPrefix(query, "SELECT count(*)") {
+			return &scriptedRows{columns: []string{"count"}, values: [][]driver.Value{{int64(3)}}}
+		}
+		return &scriptedRows{
+			columns: strings.Split(addressColumns, ", "),
+			values:  [][]driver.Value{address(1), address(2)},
+			err:     errors.New("connection lost"),
+		}
+	}})
+	w := httptest.NewRecorder()
+	listAddresses(w, httptest.NewRequest("GET", "/addresses", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got %d %s, want a 500 rather than a truncated list", w.Code, w.Body)
+	}
+}
+
+func TestListUsersReportsRowErrors(t *testing.T) {
+	now := time.Now()
+	users := func() [][]driver.Value {
+		return [][]driver.Value{{int64(1), "Alice", "alice@example.com", true, now, now}}
+	}
+	errLost := errors.New("connection lost")
+	tests := []struct {
+		name              string
+		target            string
+		usersErr, addrErr error
+	}{
+		{"users", "/users", errLost, nil},
+		{"addresses", "/users?include=addresses", nil, errLost},
+	}
+	for _, tt := range tests {
+		fakeDB(t, scriptedDriver{func(query string) *scriptedRows {
+			switch {
+			case strings.HasPrefix(query, "SELECT count(*)"):
+				return &scriptedRows{columns: []string{"count"}, values: [][]driver.Value{{int64(2)}}}
+			case strings.Contains(query, "FROM addresses"):
+				return &scriptedRows{columns: strings.Split(addressColumns, ", "), err: tt.addrErr}
+			default:
+				return &scriptedRows{columns: strings.Split(userColumns, ", "), values: users(), err: tt.usersErr}
+			}
+		}})
+		w := httptest.NewRecorder()
+		listUsers(w, httptest.NewRequest("GET", tt.target, nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%s: got %d %s, want a 500", tt.name, w.Code, w.Body)
+		}
+	}
+}
+
+// openCountingDriver is a database driver that counts the connections opened.
+type openCountingDriver struct {
+	opens atomic.Int32
+}
+
+func (d *openCountingDriver) Open(string) (driver.Conn, error) {
+	d.opens.Add(1)
+	return scriptedConn{}, nil
+}
+
+func TestWarmPool(t *testing.T) {
+	d := &openCountingDriver{}
+	fakeDB(t, d)
+	if got := warmPool(context.Background(), 5); got != 5 {
+		t.Errorf("warmed %d, want 5", got)
+	}
+	if got := d.opens.Load(); got != 5 {
+		t.Errorf("opened %d connections, want 5", got)
+	}
+	// They're kept, idle, for the first requests.
+	if got := db.Stats().Idle; got != 5 {
+		t.Errorf("%d idle connections, want 5", got)
+	}
+
+	d = &openCountingDriver{}
+	fakeDB(t, d)
+	db.SetMaxOpenConns(3)
+	if got := warmPool(context.Background(), 5); got != 3 {
+		t.Errorf("with a limit of 3: warmed %d", got)
+	}
+	if got := d.opens.Load(); got != 3 {
+		t.Errorf("with a limit of 3: opened %d connections", got)
+	}
+}
+
+func TestPacer(t *testing.T) {
+	p := newPacer(100)
+	start := time.Now()
+	for range 5 {
+		if err := p.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first goes straight away, and each after 10ms later.
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("5 events took %v, want at least 40ms", elapsed)
+	}
+
+	// Waiting is abandoned with the context, still giving up the turn.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p = newPacer(1)
+	p.wait(context.Background())
+	if err := p.wait(ctx); err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// encryptedEmailPrefix marks an email column value as encrypted, and with
+// which version of the scheme. Values without it are plaintext, as stored
+// before encryption was enabled.
+const encryptedEmailPrefix = "enc:v1:"
+
+var errEmailEncrypted = newError(http.StatusBadRequest, "email_encrypted", "emails are encrypted, so can't be searched or sorted")
+
+// emailCipher encrypts emails at rest when cfg.EncryptionKey is set, and is
+// nil otherwise.
+//
+// Encrypted emails can't be compared by the database, so each user also has
+// an email_hash, a keyed hash of their normalized email, which is unique
+// among live users and used to look them up by email instead.
+var emailCipher *emailCrypto
+
+type emailCrypto struct {
+	aead    cipher.AEAD
+	hashKey []byte
+}
+
+// newEmailCrypto derives separate encryption and hashing keys from key, which
+// must be 32 bytes.
+func newEmailCrypto(key []byte) (*emailCrypto, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+	derive := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(purpose))
+		return mac.Sum(nil)
+	}
+	block, err := aes.NewCipher(derive("email encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &emailCrypto{aead: aead, hashKey: derive("email hash")}, nil
+}
+
+// storedEmail returns the value to store in the email column for email.
+func storedEmail(email string) string {
+	if emailCipher == nil {
+		return email
+	}
+	nonce := make([]byte, emailCipher.aead.NonceSize())
+	rand.Read(nonce)
+	sealed := emailCipher.aead.Seal(nonce, nonce, []byte(email), nil)
+	return encryptedEmailPrefix + base64.RawStdEncoding.EncodeToString(sealed)
+}
+
+// emailHash returns the value to store in the email_hash column for email,
+// which is NULL when emails aren't encrypted.
+func emailHash(email string) any {
+	if emailCipher == nil {
+		return nil
+	}
+	mac := hmac.New(sha256.New, emailCipher.hashKey)
+	mac.Write([]byte(normalizeEmail(email)))
+	return mac.Sum(nil)
+}
+
+// emailMatch returns a condition matching users with email, and its argument,
+// given the placeholder for it.
+func emailMatch(email string, placeholder string) (string, any) {
+	if emailCipher == nil {
+		// Matches the users_email_live_idx partial expression index.
+		return "lower(email) = " + placeholder, normalizeEmail(email)
+	}
+	return "email_hash = " + placeholder, emailHash(email)
+}
+
+// emailConflictTarget is the ON CONFLICT target of the unique index on live
+// users' emails.
+func emailConflictTarget() string {
+	if emailCipher == nil {
+		return "(lower(email)) WHERE deleted_at IS NULL"
+	}
+	return "(email_hash) WHERE deleted_at IS NULL"
+}
+
+// decryptEmail returns the plaintext of an email column value.
+func decryptEmail(stored string) (string, error) {
+	encoded, ok := strings.CutPrefix(stored, encryptedEmailPrefix)
+	if !ok {
+		return stored, nil
+	}
+	if emailCipher == nil {
+		return "", errors.New("email is encrypted but ENCRYPTION_KEY is not set")
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("decode email: %w", err)
+	}
+	n := emailCipher.aead.NonceSize()
+	if len(sealed) < n {
+		return "", errors.New("decrypt email: too short")
+	}
+	plain, err := emailCipher.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypt email: %w", err)
+	}
+	return string(plain), nil
+}
+
+// emailColumn scans an email column value, decrypting it if necessary.
+type emailColumn struct {
+	email *string
+}
+
+func (c emailColumn) Scan(src any) error {
+	var stored string
+	switch v := src.(type) {
+	case string:
+		stored = v
+	case []byte:
+		stored = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into email", src)
+	}
+	email, err := decryptEmail(stored)
+	*c.email = email
+	return err
+}
+
+// encryptExistingEmails encrypts the emails of users stored before
+// encryption was enabled, a batch at a time, so that emails are only ever
+// plaintext until the first startup with ENCRYPTION_KEY set.
+func encryptExistingEmails(ctx context.Context) error {
+	total := 0
+	for {
+		n, err := encryptEmailBatch(ctx)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		total += n
+	}
+	if total > 0 {
+		log.Printf("Encrypted the emails of %d users", total)
+	}
+	return nil
+}
+
+func encryptEmailBatch(ctx context.Context) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, "SELECT id, email FROM users WHERE email_hash IS NULL LIMIT 1000 FOR UPDATE SKIP LOCKED")
+	if err != nil {
+		return 0, err
+	}
+	type plain struct {
+		id    int
+		email string
+	}
+	users, err := scanAll(rows, func(rows *sql.Rows) (plain, error) {
+		var u plain
+		err := rows.Scan(&u.id, emailColumn{&u.email})
+		return u, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, u := range users {
+		_, err := tx.ExecContext(ctx, "UPDATE users SET email = $2, email_hash = $3 WHERE id = $1", u.id, storedEmail(u.email), emailHash(u.email))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(users), tx.Commit()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testEmailCipher encrypts emails with a random key for the duration of the
+// test.
+func testEmailCipher(t *testing.T) {
+	t.Helper()
+	saved := emailCipher
+	t.Cleanup(func() { emailCipher = saved })
+	key := make([]byte, 32)
+	rand.Read(key)
+	var err error
+	if emailCipher, err = newEmailCrypto(key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmailEncryptionRoundTrip(t *testing.T) {
+	testEmailCipher(t)
+	stored := storedEmail("ada@example.com")
+	if !strings.HasPrefix(stored, encryptedEmailPrefix) || strings.Contains(stored, "ada") {
+		t.Fatalf("stored %q", stored)
+	}
+	if again := storedEmail("ada@example.com"); again == stored {
+		t.Error("encrypting twice gave the same value")
+	}
+	var email string
+	if err := (emailColumn{&email}).Scan([]byte(stored)); err != nil || email != "ada@example.com" {
+		t.Errorf("got %q, %v", email, err)
+	}
+	// Emails stored before encryption was enabled are read as they are.
+	if err := (emailColumn{&email}).Scan("bob@example.com"); err != nil || email != "bob@example.com" {
+		t.Errorf("plaintext: got %q, %v", email, err)
+	}
+
+	tampered := []byte(stored)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := decryptEmail(string(tampered)); err == nil {
+		t.Error("decrypted a tampered email")
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	emailCipher, _ = newEmailCrypto(key)
+	if _, err := decryptEmail(stored); err == nil {
+		t.Error("decrypted with another key")
+	}
+	emailCipher = nil
+	if _, err := decryptEmail(stored); err == nil {
+		t.Error("decrypted without a key")
+	}
+}
+
+func TestEmailHash(t *testing.T) {
+	testEmailCipher(t)
+	hash := emailHash("ada@example.com").([]byte)
+	if other := emailHash(" ADA@Example.com ").([]byte); !bytes.Equal(other, hash) {
+		t.Error("hash depends on case or whitespace")
+	}
+	if other := emailHash("bob@example.com").([]byte); bytes.Equal(other, hash) {
+		t.Error("different emails hash the same")
+	}
+	emailCipher = nil
+	if got := emailHash("ada@example.com"); got != nil {
+		t.Errorf("got %v without encryption, want nil", got)
+	}
+}
+
+func TestEncryptedEmails(t *testing.T) {
+	testDB(t)
+	testEmailCipher(t)
+	h := newHandler(newMux())
+	ada := createTestUser(t, h, "Ada", "Ada@Example.com")
+	if ada.Email != "ada@example.com" {
+		t.Errorf("created with email %q", ada.Email)
+	}
+	var stored string
+	if err := db.QueryRow("SELECT email FROM users WHERE id = $1", ada.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, encryptedEmailPrefix) {
+		t.Errorf("stored %q", stored)
+	}
+
+	w := serve(h, httptest.NewRequest("GET", userPath(ada.ID), nil))
+	if got := responseAs[User](t, w); got.Email != "ada@example.com" {
+		t.Errorf("get: got %q", got.Email)
+	}
+	w = serve(h, httptest.NewRequest("GET", "/users/by-email/ADA@example.com", nil))
+	if w.Code != http.StatusOK || responseAs[User](t, w).ID != ada.ID {
+		t.Errorf("lookup: got %d %s", w.Code, w.Body)
+	}
+	w = serve(h, jsonRequest("POST", "/users", `{"name": "Other Ada", "email": "ada@EXAMPLE.com"}`))
+	if w.Code != http.StatusConflict {
+		t.Errorf("duplicate: got %d %s", w.Code, w.Body)
+	}
+	w = serve(h, jsonRequest("PATCH", userPath(ada.ID), `{"email": "ada@lovelace.example"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: got %d %s", w.Code, w.Body)
+	}
+	w = serve(h, httptest.NewRequest("GET", "/users/by-email/ada@lovelace.example", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("lookup after update: got %d %s", w.Code, w.Body)
+	}
+	w = serve(h, httptest.NewRequest("GET", "/users?sort=email", nil))
+	if w.Code != http.StatusBadRequest || responseAs[errorBody](t, w).Error.Code != "email_encrypted" {
+		t.Errorf("sort by email: got %d %s", w.Code, w.Body)
+	}
+
+	// The export is decrypted, in the same format as without encryption.
+	w = serve(h, adminRequest(t, "GET", "/admin/export/users.csv", ""))
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1][2] != "ada@lovelace.example" || records[1][3] != "t" {
+		t.Errorf("export: got %q", records)
+	}
+}
+
+func TestEncryptExistingEmails(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	ada := createTestUser(t, h, "Ada", "ada@example.com")
+	testEmailCipher(t)
+	if err := encryptExistingEmails(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	if err := db.QueryRow("SELECT email FROM users WHERE id = $1", ada.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, encryptedEmailPrefix) {
+		t.Errorf("stored %q", stored)
+	}
+	w := serve(h, httptest.NewRequest("GET", "/users/by-email/ada@example.com", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("lookup: got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// event is a change notification streamed to /events subscribers.
+type event struct {
+	Type string
+	Data any
+}
+
+// eventBroker fans events out to connected SSE clients.
+type eventBroker struct {
+	mu      sync.Mutex
+	clients map[chan event]struct{}
+	// closing is closed when the server starts shutting down.
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{clients: map[chan event]struct{}{}, closing: make(chan struct{})}
+}
+
+// Publish sends e to every client, dropping it for clients that are not
+// keeping up.
+func (b *eventBroker) Publish(e event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.clients {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (b *eventBroker) subscribe() (<-chan event, func()) {
+	ch := make(chan event, 16)
+	b.mu.Lock()
+	b.clients[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.clients, ch)
+		b.mu.Unlock()
+	}
+}
+
+// Close tells every stream to send a final close event and disconnect, so that
+// clients reconnect to another instance. It is registered with
+// http.Server.RegisterOnShutdown, which otherwise waits for streams to end on
+// their own.
+func (b *eventBroker) Close() {
+	b.closeOnce.Do(func() { close(b.closing) })
+}
+
+func (b *eventBroker) streamEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	events, unsubscribe := b.subscribe()
+	defer unsubscribe()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-b.closing:
+			fmt.Fprint(w, "event: close\ndata: {}\n\n")
+			rc.Flush()
+			return
+		case e := <-events:
+			data, err := json.Marshal(e.Data)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventsCloseOnShutdown(t *testing.T) {
+	saved := events
+	events = newEventBroker()
+	t.Cleanup(func() { events = saved })
+	srv := httptest.NewUnstartedServer(newHandler(newMux()))
+	srv.Config.RegisterOnShutdown(events.Close)
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("Content-Type %q", got)
+	}
+	lines := bufio.NewScanner(resp.Body)
+	readEvent := func() string {
+		t.Helper()
+		var event []string
+		for lines.Scan() && lines.Text() != "" {
+			event = append(event, lines.Text())
+		}
+		return strings.Join(event, "\n")
+	}
+
+	// The stream is subscribed once its headers are sent, but publish until
+	// an event arrives in case the subscription hasn't been made yet.
+	received := make(chan string)
+	go func() { received <- readEvent() }()
+	var got string
+	for got == "" {
+		events.Publish(event{Type: "user.saved", Data: map[string]int{"id": 1}})
+		select {
+		case got = <-received:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if want := "event: user.saved\ndata: {\"id\":1}"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdown := make(chan error)
+	go func() { shutdown <- srv.Config.Shutdown(ctx) }()
+	// Drain any events published before the subscription was seen.
+	for got = readEvent(); strings.HasPrefix(got, "event: user.saved"); got = readEvent() {
+	}
+	if want := "event: close\ndata: {}"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if lines.Scan() {
+		t.Errorf("stream continued after close: %q", lines.Text())
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// exportBatchSize is how many rows are fetched from the export cursor at once.
+const exportBatchSize = 1000
+
+// Lines of an NDJSON export are users or addresses, tagged with their type.
+type (
+	userRecord struct {
+		Type string `json:"_type"`
+		*User
+	}
+	addressRecord struct {
+		Type string `json:"_type"`
+		*Address
+	}
+)
+
+// MarshalJSON adds the _type tag to the user's stored encoding, with both
+// its id and UUID. The user's own encoding would otherwise be promoted and
+// replace this type's.
+func (r userRecord) MarshalJSON() ([]byte, error) {
+	return tagRecord(r.Type, storedUser(*r.User))
+}
+
+func (r addressRecord) MarshalJSON() ([]byte, error) {
+	return tagRecord(r.Type, storedAddress(*r.Address))
+}
+
+// tagRecord encodes v, which must encode as a non-empty JSON object, with a
+// leading _type field.
+func tagRecord(typ string, v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return fmt.Appendf(nil, `{"_type":%q,%s`, typ, data[1:]), nil
+}
+
+// exportData streams every user and address as NDJSON. Rows are read through
+// server-side cursors in a single repeatable-read transaction, so the export
+// is a consistent snapshot and memory use doesn't grow with the table size.
+func exportData(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="export.ndjson"`)
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	err = streamCursor(ctx, tx, "export_users", "SELECT "+userColumns+" FROM users WHERE deleted_at IS NULL ORDER BY id", func(rows *sql.Rows) error {
+		var u User
+		if err := rows.Scan(u.fields()...); err != nil {
+			return err
+		}
+		return enc.Encode(userRecord{Type: "user", User: &u})
+	}, rc.Flush)
+	if err == nil {
+		err = streamCursor(ctx, tx, "export_addresses", "SELECT "+addressColumns+" FROM addresses ORDER BY id", func(rows *sql.Rows) error {
+			var a Address
+			if err := rows.Scan(a.fields()...); err != nil {
+				return err
+			}
+			return enc.Encode(addressRecord{Type: "address", Address: &a})
+		}, rc.Flush)
+	}
+	if err != nil {
+		// The status has already been sent, so all we can do is stop.
+		log.Printf("export: %v", err)
+	}
+}
+
+// exportUsersCSV streams every user as CSV with Postgres's COPY, which is
+// much faster than scanning rows for a full-table dump. Encrypted emails can
+// only be decrypted here, so then rows are scanned instead.
+func exportUsersCSV(w http.ResponseWriter, r *http.Request) {
+	if emailCipher != nil {
+		exportUsersCSVDecrypted(w, r)
+		return
+	}
+	ctx := r.Context()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer conn.Close()
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+	err = conn.Raw(func(driverConn any) error {
+		pgConn := driverConn.(*stdlib.Conn).Conn().PgConn()
+		_, err := pgConn.CopyTo(ctx, w, "COPY (SELECT "+userColumns+" FROM users WHERE deleted_at IS NULL ORDER BY id) TO STDOUT WITH CSV HEADER")
+		return err
+	})
+	if err != nil {
+		// Once COPY has started writing, the status has already been sent.
+		log.Printf("export: %v", err)
+	}
+}
+
+// exportUsersCSVDecrypted is exportUsersCSV for encrypted emails, in the
+// same format as COPY.
+func exportUsersCSVDecrypted(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write(strings.Split(userColumns, ", "))
+	rc := http.NewResponseController(w)
+	err = streamCursor(ctx, tx, "export_users_csv", "SELECT "+userColumns+" FROM users WHERE deleted_at IS NULL ORDER BY id", func(rows *sql.Rows) error {
+		u, err := scanUser(rows)
+		if err != nil {
+			return err
+		}
+		return cw.Write([]string{
+			strconv.Itoa(u.ID), u.Name, u.Email, csvBool(u.Active),
+			u.CreatedAt.Format(csvTimeFormat), u.UpdatedAt.Format(csvTimeFormat), u.UUID.String(),
+		})
+	}, func() error {
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+		return rc.Flush()
+	})
+	if err != nil {
+		// The status has already been sent.
+		log.Printf("export: %v", err)
+	}
+}
+
+// csvTimeFormat is how COPY formats timestamps.
+const csvTimeFormat = "2006-01-02 15:04:05.999999"
+
+// csvBool formats a boolean as COPY does.
+func csvBool(b bool) string {
+	if b {
+		return "t"
+	}
+	return "f"
+}
+
+// exportAddressesCSV streams every address, or those in the countries given
+// by ?country=, as CSV, with the name and email of the user it belongs to.
+func exportAddressesCSV(w http.ResponseWriter, r *http.Request) {
+	countries, err := countriesParam(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var where whereClause
+	if len(countries) > 0 {
+		where.and("a.country = ANY(" + where.arg(countries) + ")")
+	}
+	ctx := r.Context()
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="addresses.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{
+		"id", "user_id", "street", "city", "country", "postal_code", "latitude", "longitude",
+		"created_at", "updated_at", "uuid", "user_uuid", "user_name", "user_email",
+	})
+	coordinate := func(c *float64) string {
+		if c == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*c, 'f', -1, 64)
+	}
+	rc := http.NewResponseController(w)
+	query := `SELECT a.id, a.user_id, a.street, a.city, a.country, a.postal_code, a.latitude, a.longitude,
+		  a.created_at, a.updated_at, a.uuid, u.uuid, u.name, u.email
+		FROM addresses a JOIN users u ON u.id = a.user_id` + where.String() + " ORDER BY a.id"
+	err = streamCursor(ctx, tx, "export_addresses_csv", query, func(rows *sql.Rows) error {
+		var a Address
+		var u User
+		if err := rows.Scan(append(a.fields(), &u.Name, emailColumn{&u.Email})...); err != nil {
+			return err
+		}
+		return cw.Write([]string{
+			strconv.Itoa(a.ID), strconv.Itoa(a.UserID), a.Street, a.City, a.Country, a.PostalCode,
+			coordinate(a.Latitude), coordinate(a.Longitude),
+			a.CreatedAt.Format(csvTimeFormat), a.UpdatedAt.Format(csvTimeFormat), a.UUID.String(), a.UserUUID.String(),
+			u.Name, u.Email,
+		})
+	}, func() error {
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}, where.args...)
+	if err != nil {
+		// The status has already been sent.
+		log.Printf("export: %v", err)
+	}
+}
+
+// streamCursor declares a cursor for query, with args, within tx and calls fn
+// for each row, fetching exportBatchSize rows at a time and calling flush
+// after each batch.
+func streamCursor(ctx context.Context, tx *sql.Tx, name, query string, fn func(*sql.Rows) error, flush func() error, args ...any) error {
+	if _, err := tx.ExecContext(ctx, "DECLARE "+name+" NO SCROLL CURSOR FOR "+query, args...); err != nil {
+		return err
+	}
+	fetch := fmt.Sprintf("FETCH %d FROM %s", exportBatchSize, name)
+	for {
+		rows, err := tx.QueryContext(ctx, fetch)
+		if err != nil {
+			return err
+		}
+		n := 0
+		for rows.Next() {
+			n++
+			if err := fn(rows); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		if n < exportBatchSize {
+			return nil
+		}
+	}
+}
+
+// importAddress inserts or replaces a as part of an import. Unless
+// cfg.AllowDuplicateAddresses is set, it's an errDuplicateAddress if its user
+// already has the same address under another id.
+func importAddress(ctx context.Context, tx *sql.Tx, a Address) error {
+	// Lock the user, if it exists, for checkDuplicateAddress.
+	if _, err := tx.ExecContext(ctx, "SELECT 1 FROM users WHERE id = $1 FOR UPDATE", a.UserID); err != nil {
+		return err
+	}
+	if err := checkDuplicateAddress(ctx, tx, a); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO addresses (id, user_id, street, city, country, postal_code, latitude, longitude, created_at, updated_at, uuid)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, COALESCE($11::uuid, gen_random_uuid()))
+		 ON CONFLICT (id) DO UPDATE SET user_id = EXCLUDED.user_id, street = EXCLUDED.street, city = EXCLUDED.city,
+		   country = EXCLUDED.country, postal_code = EXCLUDED.postal_code, latitude = EXCLUDED.latitude,
+		   longitude = EXCLUDED.longitude, created_at = EXCLUDED.created_at, updated_at = EXCLUDED.updated_at,
+		   uuid = COALESCE($11::uuid, addresses.uuid)`,
+		a.ID, a.UserID, a.Street, a.City, a.Country, a.PostalCode, a.Latitude, a.Longitude, a.CreatedAt.Time, a.UpdatedAt.Time, a.UUID,
+	)
+	return err
+}
+
+// importData loads an NDJSON export in a single transaction. Rows keep their
+// ids and UUIDs, replacing any existing rows with the same id, so users must
+// precede their addresses as they do in an export. Rows without UUIDs are
+// given new ones. Once committed, the imported rows are dropped from every
+// cache, as the rows they replaced may be cached with no TTL.
+func importData(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	counts := map[string]int{"user": 0, "address": 0}
+	var userIDs, addressIDs []int
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var head struct {
+			Type string `json:"_type"`
+		}
+		var u User
+		var a Address
+		err := json.Unmarshal(scanner.Bytes(), &head)
+		switch {
+		case err != nil:
+		case head.Type == "user":
+			err = json.Unmarshal(scanner.Bytes(), (*storedUser)(&u))
+		case head.Type == "address":
+			err = json.Unmarshal(scanner.Bytes(), (*storedAddress)(&a))
+		default:
+			writeError(w, r, newError(http.StatusBadRequest, "invalid_record", fmt.Sprintf("line %d: unknown _type %q", line, head.Type)))
+			return
+		}
+		if err != nil {
+			writeError(w, r, newError(http.StatusBadRequest, "invalid_json", fmt.Sprintf("line %d: %v", line, err)))
+			return
+		}
+		if head.Type == "user" {
+			_, err = tx.ExecContext(ctx,
+				`INSERT INTO users (id, name, email, email_hash, active, created_at, updated_at, uuid)
+				 VALUES ($1, $2, $3, $4, $5, $6, $7, COALESCE($8::uuid, gen_random_uuid()))
+				 ON CONFLICT (id) DO UPDATE SET name = EXCLUDED.name, email = EXCLUDED.email, email_hash = EXCLUDED.email_hash,
+				   active = EXCLUDED.active, created_at = EXCLUDED.created_at, updated_at = EXCLUDED.updated_at,
+				   uuid = COALESCE($8::uuid, users.uuid)`,
+				u.ID, u.Name, storedEmail(u.Email), emailHash(u.Email), u.Active, u.CreatedAt.Time, u.UpdatedAt.Time, u.UUID,
+			)
+		} else {
+			err = importAddress(ctx, tx, a)
+		}
+		if err == errDuplicateAddress {
+			writeError(w, r, newError(http.StatusConflict, "duplicate_address", fmt.Sprintf("line %d: %v", line, err)))
+			return
+		}
+		if err != nil {
+			writeError(w, r, fmt.Errorf("line %d: %w", line, err))
+			return
+		}
+		counts[head.Type]++
+		if head.Type == "user" {
+			userIDs = append(userIDs, u.ID)
+		} else {
+			addressIDs = append(addressIDs, a.ID)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		writeError(w, r, newError(http.StatusBadRequest, "invalid_body", err.Error()))
+		return
+	}
+	// Move the id sequences past the imported ids.
+	for _, table := range []string{"users", "addresses"} {
+		if _, err := tx.ExecContext(ctx,
+			fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%[1]s', 'id'), COALESCE(max(id), 0) + 1, false) FROM %[1]s", table),
+		); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	invalidateImported(ctx, userIDs, addressIDs)
+	writeJSON(w, http.StatusOK, map[string]int{"users": counts["user"], "addresses": counts["address"]})
+}
+
+// invalidateImported drops imported users and addresses from every cache,
+// including the ids of their UUIDs, which an import may have changed.
+func invalidateImported(ctx context.Context, userIDs, addressIDs []int) {
+	ids := map[string]map[int]bool{"users": {}, "addresses": {}}
+	for _, id := range userIDs {
+		ids["users"][id] = true
+		invalidateUser(ctx, id)
+	}
+	for _, id := range addressIDs {
+		ids["addresses"][id] = true
+		sharedCache.Invalidate(ctx, addressKey(id))
+	}
+	idCache.DeleteFunc(func(key collectionUUID, id int) bool { return ids[key.collection][id] })
+	forgetCreatedAddresses(func(a Address) bool { return ids["addresses"][a.ID] || ids["users"][a.UserID] })
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordsAreTagged(t *testing.T) {
+	data, err := json.Marshal(userRecord{Type: "user", User: &User{ID: 1, Name: "Alice", Email: "alice@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), `{"_type":"user","id":1,"name":"Alice"`) {
+		t.Errorf("got %s", data)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	alice := createTestUser(t, h, "Alice", "alice@example.com")
+	bob := createTestUser(t, h, "Bob", "bob@example.com")
+	createTestAddress(t, h, alice.ID, "1 Main St", "Springfield", "US")
+	createTestAddress(t, h, bob.ID, "2 High St", "Oxford", "GB")
+
+	w := serve(h, adminRequest(t, "GET", "/admin/export", ""))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("export: %d %s", w.Code, w.Body)
+	}
+	export := w.Body.String()
+	if lines := strings.Count(export, "\n"); lines != 4 {
+		t.Errorf("exported %d lines:\n%s", lines, export)
+	}
+
+	if _, err := db.Exec("TRUNCATE users, addresses CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	w = serve(h, adminRequest(t, "POST", "/admin/import", export))
+	if w.Code != http.StatusOK {
+		t.Fatalf("import: %d %s", w.Code, w.Body)
+	}
+	if got := responseAs[map[string]int](t, w); got["users"] != 2 || got["addresses"] != 2 {
+		t.Errorf("imported %v", got)
+	}
+	if again := serve(h, adminRequest(t, "GET", "/admin/export", "")).Body.String(); again != export {
+		t.Errorf("re-export differs:\n%s\nwant\n%s", again, export)
+	}
+	// The id sequences were moved past the imported rows.
+	if carol := createTestUser(t, h, "Carol", "carol@example.com"); carol.ID <= bob.ID {
+		t.Errorf("new user got id %d", carol.ID)
+	}
+}
+
+func TestImportInvalidatesCaches(t *testing.T) {
+	testDB(t)
+	saved := userCache
+	userCache = newLRUCache[int, User](10, 0)
+	t.Cleanup(func() { userCache = saved })
+	h := newHandler(newMux())
+	alice := createTestUser(t, h, "Alice", "alice@example.com")
+	if w := serve(h, httptest.NewRequest("GET", userPath(alice.ID), nil)); w.Code != http.StatusOK {
+		t.Fatalf("get: %d %s", w.Code, w.Body)
+	}
+
+	record := `{"_type":"user","id":` + strconv.Itoa(alice.ID) + `,"name":"Alice Smith","email":"alice@example.com","active":true}` + "\n"
+	if w := serve(h, adminRequest(t, "POST", "/admin/import", record)); w.Code != http.StatusOK {
+		t.Fatalf("import: %d %s", w.Code, w.Body)
+	}
+	w := serve(h, httptest.NewRequest("GET", userPath(alice.ID), nil))
+	if got := responseAs[User](t, w); got.Name != "Alice Smith" {
+		t.Errorf("after the import: got %+v", got)
+	}
+}
+
+func TestInvalidateImported(t *testing.T) {
+	savedUsers, savedIDs, savedDedup := userCache, idCache, addressDedup
+	t.Cleanup(func() { userCache, idCache, addressDedup = savedUsers, savedIDs, savedDedup })
+	userCache = newLRUCache[int, User](10, 0)
+	idCache = newLRUCache[collectionUUID, int](10, 0)
+	addressDedup = newLRUCache[string, Address](10, time.Minute)
+	userCache.Set(1, User{ID: 1}, userCache.Generation())
+	userCache.Set(2, User{ID: 2}, userCache.Generation())
+	idCache.Set(collectionUUID{"users", uuid{1}}, 1, idCache.Generation())
+	idCache.Set(collectionUUID{"addresses", uuid{1}}, 1, idCache.Generation())
+	idCache.Set(collectionUUID{"addresses", uuid{2}}, 2, idCache.Generation())
+	addressDedup.Set("a", Address{ID: 3, UserID: 1}, addressDedup.Generation())
+	addressDedup.Set("b", Address{ID: 4, UserID: 2}, addressDedup.Generation())
+
+	invalidateImported(context.Background(), []int{1}, []int{2})
+
+	if _, ok := userCache.Get(1); ok {
+		t.Error("imported user is still cached")
+	}
+	if _, ok := userCache.Get(2); !ok {
+		t.Error("another user was dropped")
+	}
+	for key, want := range map[collectionUUID]bool{
+		{"users", uuid{1}}:     false,
+		{"addresses", uuid{1}}: true,
+		{"addresses", uuid{2}}: false,
+	} {
+		if _, ok := idCache.Get(key); ok != want {
+			t.Errorf("id of %s %v: cached %v, want %v", key.collection, key.uuid, ok, want)
+		}
+	}
+	if _, ok := addressDedup.Get("a"); ok {
+		t.Error("address of an imported user is still remembered")
+	}
+	if _, ok := addressDedup.Get("b"); !ok {
+		t.Error("another address was forgotten")
+	}
+}
+
+func TestImportRejectsUnknownRecords(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	w := serve(h, adminRequest(t, "POST", "/admin/import", `{"_type":"widget"}`+"\n"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("%d %s", w.Code, w.Body)
+	}
+}
+
+func TestExportUsersCSV(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	alice := createTestUser(t, h, `Alice "Al" Smith, Jr.`, "alice@example.com")
+	bob := createTestUser(t, h, "Bob", "bob@example.com")
+	deleted := createTestUser(t, h, "Carol", "carol@example.com")
+	if w := serve(h, httptest.NewRequest("DELETE", userPath(deleted.ID), nil)); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+
+	if w := serve(h, httptest.NewRequest("GET", "/admin/export/users.csv", nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: %d, want 401", w.Code)
+	}
+	w := serve(h, adminRequest(t, "GET", "/admin/export/users.csv", ""))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("%d %q %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="users.csv"` {
+		t.Errorf("Content-Disposition %q", got)
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || strings.Join(records[0], ", ") != userColumns {
+		t.Fatalf("got %q, want a header and 2 users", records)
+	}
+	for i, u := range []User{alice, bob} {
+		got := records[i+1]
+		if got[0] != strconv.Itoa(u.ID) || got[1] != u.Name || got[2] != u.Email || got[3] != "t" {
+			t.Errorf("row %d: %q, want %+v", i+1, got, u)
+		}
+	}
+}
+
+func TestExportAddressesCSV(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	alice := createTestUser(t, h, "Alice", "alice@example.com")
+	bob := createTestUser(t, h, `Bob "The Builder", Jr.`, "bob@example.com")
+	home := createTestAddress(t, h, alice.ID, `1 "Main" St, Apt 2`, "Springfield", "US")
+	w := serve(h, jsonRequest("POST", "/addresses", `{"user_id": `+strconv.Itoa(bob.ID)+`, "street": "2 High St", "city": "Oxford", "country": "GB", "latitude": 51.752, "longitude": -1.2577}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create address: %d %s", w.Code, w.Body)
+	}
+	oxford := responseAs[Address](t, w)
+
+	if w := serve(h, httptest.NewRequest("GET", "/admin/export/addresses.csv", nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: %d, want 401", w.Code)
+	}
+	export := func(target string) [][]string {
+		t.Helper()
+		w := serve(h, adminRequest(t, "GET", target, ""))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv" {
+			t.Fatalf("%s: %d %q %s", target, w.Code, w.Header().Get("Content-Type"), w.Body)
+		}
+		records, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return records
+	}
+	records := export("/admin/export/addresses.csv")
+	header := "id,user_id,street,city,country,postal_code,latitude,longitude,created_at,updated_at,user_name,user_email"
+	if len(records) != 3 || strings.Join(records[0], ",") != header {
+		t.Fatalf("got %q, want a header and 2 addresses", records)
+	}
+	want := [][]string{
+		{strconv.Itoa(home.ID), strconv.Itoa(alice.ID), `1 "Main" St, Apt 2`, "Springfield", "US", "", "", ""},
+		{strconv.Itoa(oxford.ID), strconv.Itoa(bob.ID), "2 High St", "Oxford", "GB", "", "51.752", "-1.2577"},
+	}
+	users := [][]string{{"Alice", "alice@example.com"}, {`Bob "The Builder", Jr.`, "bob@example.com"}}
+	for i, got := range records[1:] {
+		if !slices.Equal(got[:8], want[i]) || !slices.Equal(got[10:], users[i]) {
+			t.Errorf("row %d: got %q", i+1, got)
+		}
+	}
+
+	if records := export("/admin/export/addresses.csv?country=gb"); len(records) != 2 || records[1][0] != strconv.Itoa(oxford.ID) {
+		t.Errorf("by country: got %q", records)
+	}
+	if w := serve(h, adminRequest(t, "GET", "/admin/export/addresses.csv?country=XX", "")); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid country: %d %s", w.Code, w.Body)
+	}
+}
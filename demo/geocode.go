@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// geocodeCacheSize bounds the number of geocoded addresses held in memory.
+const geocodeCacheSize = 1000
+
+// maxGeocodeResponse bounds how much of the geocoder's response is read.
+const maxGeocodeResponse = 64 << 10
+
+var (
+	geocodeClient = &http.Client{}
+	// geocodeCache holds geocoder results by geocodeKey.
+	geocodeCache *lruCache[string, geocodeResult]
+
+	errGeocoderFailed = newError(http.StatusBadGateway, "geocoder_failed", "the geocoder did not respond successfully")
+	errNotGeocodable  = newError(http.StatusUnprocessableEntity, "not_geocodable", "the address could not be geocoded")
+)
+
+type geocodeInput struct {
+	Street  string `json:"street"`
+	City    string `json:"city"`
+	Country string `json:"country"`
+}
+
+// geocodeResult is both the geocoder's response and ours.
+type geocodeResult struct {
+	Latitude   float64 `json:"latitude"`
+	Longitude  float64 `json:"longitude"`
+	Confidence float64 `json:"confidence"`
+}
+
+// geocodeAddress looks up the coordinates of an address with
+// cfg.GeocoderURL, so that clients needn't hold the geocoder's API key.
+// Results are cached for cfg.GeocodeCacheTTL.
+func geocodeAddress(w http.ResponseWriter, r *http.Request) {
+	var in geocodeInput
+	if err := decodeJSON(r, &in); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	a := Address{Street: in.Street, City: in.City, Country: in.Country}
+	if strings.TrimSpace(a.Country) == "" && cfg.DefaultCountry != "" {
+		a.Country = cfg.DefaultCountry
+		addWarning(r, "default_country_applied", "country was set to the default, "+cfg.DefaultCountry)
+	}
+	// Normalized and validated as addresses are when they're saved, except
+	// that this one isn't any user's.
+	err := prepareAddress(&a)
+	if apiErr, ok := err.(*apiError); ok {
+		delete(apiErr.Fields, "user_id")
+		if len(apiErr.Fields) == 0 {
+			err = nil
+		}
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	key := geocodeKey(a)
+	if result, ok := geocodeCache.Get(key); ok {
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+	gen := geocodeCache.Generation()
+	result, err := geocode(r.Context(), a)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	geocodeCache.Set(key, result, gen)
+	writeJSON(w, http.StatusOK, result)
+}
+
+// geocodeKey identifies an address for caching, ignoring differences in case
+// and spacing.
+func geocodeKey(a Address) string {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.Join(strings.Fields(s), " "))
+	}
+	return normalize(a.Street) + "\x00" + normalize(a.City) + "\x00" + a.Country
+}
+
+// geocode asks cfg.GeocoderURL for the coordinates of a, passing street, city
+// and country as query parameters and cfg.GeocoderAPIKey as a bearer token.
+// The geocoder responds 404 if it can't find the address. Any other failure
+// is a 502.
+func geocode(ctx context.Context, a Address) (geocodeResult, error) {
+	var result geocodeResult
+	u, err := url.Parse(cfg.GeocoderURL)
+	if err != nil {
+		return result, err
+	}
+	q := u.Query()
+	q.Set("street", a.Street)
+	q.Set("city", a.City)
+	q.Set("country", a.Country)
+	u.RawQuery = q.Encode()
+	ctx, cancel := context.WithTimeout(ctx, cfg.GeocoderTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if cfg.GeocoderAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.GeocoderAPIKey)
+	}
+	resp, err := geocodeClient.Do(req)
+	if err != nil {
+		// The error includes the URL, which may contain credentials, so
+		// is only logged.
+		log.Printf("geocoder: %v", err)
+		return result, errGeocoderFailed
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return result, errNotGeocodable
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return result, newError(http.StatusBadGateway, "geocoder_failed", fmt.Sprintf("the geocoder responded %s", resp.Status))
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxGeocodeResponse)).Decode(&result); err != nil {
+		log.Printf("geocoder: decode response: %v", err)
+		return result, errGeocoderFailed
+	}
+	if result.Latitude < -90 || result.Latitude > 90 || result.Longitude < -180 || result.Longitude > 180 {
+		log.Printf("geocoder: coordinates out of range: %v, %v", result.Latitude, result.Longitude)
+		return result, errGeocoderFailed
+	}
+	return result, nil
+}
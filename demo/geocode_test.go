@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubGeocoder configures a geocoder that responds with respond, returning
+// the number of requests it has had.
+func stubGeocoder(t *testing.T, respond func(w http.ResponseWriter, q url.Values)) *atomic.Int32 {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if got := r.Header.Get("Authorization"); got != "Bearer geo-key" {
+			t.Errorf("Authorization %q", got)
+		}
+		respond(w, r.URL.Query())
+	}))
+	t.Cleanup(srv.Close)
+	setConfig(t, func(c *config) {
+		c.GeocoderURL = srv.URL + "/geocode?format=json"
+		c.GeocoderAPIKey = "geo-key"
+		c.GeocoderTimeout = 100 * time.Millisecond
+	})
+	saved := geocodeCache
+	t.Cleanup(func() { geocodeCache = saved })
+	geocodeCache = newLRUCache[string, geocodeResult](geocodeCacheSize, time.Hour)
+	return &calls
+}
+
+func TestGeocodeAddress(t *testing.T) {
+	calls := stubGeocoder(t, func(w http.ResponseWriter, q url.Values) {
+		if q.Get("format") != "json" || q.Get("street") != "1 Main St" || q.Get("city") != "Springfield" || q.Get("country") != "US" {
+			t.Errorf("query %v", q)
+		}
+		io.WriteString(w, `{"latitude": 39.78, "longitude": -89.65, "confidence": 0.9, "other": true}`)
+	})
+	h := newHandler(newMux())
+	want := geocodeResult{Latitude: 39.78, Longitude: -89.65, Confidence: 0.9}
+	for _, body := range []string{
+		`{"street": "1 Main St", "city": "Springfield", "country": "US"}`,
+		// The same address, normalized as it would be when saved, is
+		// cached.
+		`{"street": " 1  main st", "city": "SPRINGFIELD ", "country": "us"}`,
+	} {
+		w := serve(h, jsonRequest("POST", "/addresses/geocode", body))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d %s", body, w.Code, w.Body)
+		}
+		if got := responseAs[geocodeResult](t, w); got != want {
+			t.Errorf("%s: got %+v, want %+v", body, got, want)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("geocoder called %d times, want once", n)
+	}
+
+	// Invalid addresses are rejected before the geocoder is called.
+	w := serve(h, jsonRequest("POST", "/addresses/geocode", `{"city": "Springfield", "country": "XX"}`))
+	fields := responseAs[errorBody](t, w).Error.Fields
+	if w.Code != http.StatusUnprocessableEntity || fields["street"] == "" || fields["country"] == "" || fields["user_id"] != "" {
+		t.Errorf("invalid: got %d %s", w.Code, w.Body)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("geocoder called %d times, want once", n)
+	}
+}
+
+func TestGeocodeAddressFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(w http.ResponseWriter)
+		status  int
+		code    string
+	}{
+		{"not found", func(w http.ResponseWriter) { w.WriteHeader(http.StatusNotFound) }, http.StatusUnprocessableEntity, "not_geocodable"},
+		{"error", func(w http.ResponseWriter) { w.WriteHeader(http.StatusInternalServerError) }, http.StatusBadGateway, "geocoder_failed"},
+		{"unauthorized", func(w http.ResponseWriter) { w.WriteHeader(http.StatusUnauthorized) }, http.StatusBadGateway, "geocoder_failed"},
+		{"malformed", func(w http.ResponseWriter) { io.WriteString(w, "<html>") }, http.StatusBadGateway, "geocoder_failed"},
+		{"out of range", func(w http.ResponseWriter) { io.WriteString(w, `{"latitude": 91, "longitude": 0}`) }, http.StatusBadGateway, "geocoder_failed"},
+		{"timed out", func(w http.ResponseWriter) { time.Sleep(300 * time.Millisecond) }, http.StatusBadGateway, "geocoder_failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := stubGeocoder(t, func(w http.ResponseWriter, _ url.Values) { tt.respond(w) })
+			h := newHandler(newMux())
+			for range 2 {
+				w := serve(h, jsonRequest("POST", "/addresses/geocode", `{"street": "1 Main St", "city": "Springfield", "country": "US"}`))
+				if w.Code != tt.status || responseAs[errorBody](t, w).Error.Code != tt.code {
+					t.Errorf("got %d %s, want %d %s", w.Code, w.Body, tt.status, tt.code)
+				}
+			}
+			// Failures aren't cached.
+			if n := calls.Load(); n != 2 {
+				t.Errorf("geocoder called %d times, want twice", n)
+			}
+		})
+	}
+}
+
+func TestGeocodeAddressDisabled(t *testing.T) {
+	setConfig(t, func(c *config) { c.GeocoderURL = "" })
+	w := serve(newHandler(newMux()), jsonRequest("POST", "/addresses/geocode", `{"street": "1 Main St", "city": "Springfield", "country": "US"}`))
+	// It's taken as the address with id "geocode", which can't be POSTed.
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthCheckTimeout bounds each dependency check run by /readyz.
+const healthCheckTimeout = 2 * time.Second
+
+// healthCheck verifies that a dependency is reachable.
+type healthCheck struct {
+	name string
+	// critical checks make the service unready when they fail. Failing
+	// non-critical checks only mark it as degraded.
+	critical bool
+	check    func(ctx context.Context) error
+}
+
+var healthChecks []healthCheck
+
+// registerHealthCheck adds a dependency check to /readyz. It must be called
+// before the server starts.
+func registerHealthCheck(name string, critical bool, check func(ctx context.Context) error) {
+	healthChecks = append(healthChecks, healthCheck{name: name, critical: critical, check: check})
+}
+
+type checkResult struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+}
+
+type readiness struct {
+	// Status is "ok", "degraded" if only non-critical checks failed, or
+	// "unavailable".
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// healthHandler reports liveness: the process is up and serving.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// readyHandler runs every registered health check concurrently, responding 503
+// if any critical check fails.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+	results := make([]checkResult, len(healthChecks))
+	var wg sync.WaitGroup
+	for i, hc := range healthChecks {
+		wg.Go(func() {
+			results[i] = checkResult{Status: "ok", Critical: hc.critical}
+			if err := hc.check(ctx); err != nil {
+				results[i].Status = "fail"
+				results[i].Error = err.Error()
+			}
+		})
+	}
+	wg.Wait()
+
+	body := readiness{Status: "ok", Checks: map[string]checkResult{}}
+	status := http.StatusOK
+	for i, hc := range healthChecks {
+		body.Checks[hc.name] = results[i]
+		if results[i].Status == "ok" {
+			continue
+		}
+		if hc.critical {
+			body.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		} else if body.Status == "ok" {
+			body.Status = "degraded"
+		}
+	}
+	writeJSON(w, status, body)
+}
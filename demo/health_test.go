@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyHandler(t *testing.T) {
+	ok := func(context.Context) error { return nil }
+	fail := func(context.Context) error { return errors.New("unreachable") }
+	tests := []struct {
+		name       string
+		checks     []healthCheck
+		wantCode   int
+		wantStatus string
+	}{
+		{"no checks", nil, http.StatusOK, "ok"},
+		{"all ok", []healthCheck{{"database", true, ok}, {"redis", false, ok}}, http.StatusOK, "ok"},
+		{"non-critical failing", []healthCheck{{"database", true, ok}, {"redis", false, fail}}, http.StatusOK, "degraded"},
+		{"critical failing", []healthCheck{{"database", true, fail}, {"redis", false, ok}}, http.StatusServiceUnavailable, "unavailable"},
+	}
+	saved := healthChecks
+	t.Cleanup(func() { healthChecks = saved })
+	for _, tt := range tests {
+		healthChecks = tt.checks
+		w := httptest.NewRecorder()
+		readyHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+		got := responseAs[readiness](t, w)
+		if w.Code != tt.wantCode || got.Status != tt.wantStatus {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, w.Code, got.Status, tt.wantCode, tt.wantStatus)
+		}
+		for _, hc := range tt.checks {
+			if _, ok := got.Checks[hc.name]; !ok {
+				t.Errorf("%s: no result for %s", tt.name, hc.name)
+			}
+		}
+	}
+}
+
+func TestReadyHandlerReportsErrors(t *testing.T) {
+	saved := healthChecks
+	t.Cleanup(func() { healthChecks = saved })
+	healthChecks = []healthCheck{{"redis", false, func(context.Context) error { return errors.New("connection refused") }}}
+	w := httptest.NewRecorder()
+	readyHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	got := responseAs[readiness](t, w).Checks["redis"]
+	if got.Status != "fail" || got.Critical || got.Error != "connection refused" {
+		t.Errorf("got %+v", got)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+)
+
+// addressChange is a change to one field of an address.
+type addressChange struct {
+	Field     string    `json:"field"`
+	OldValue  string    `json:"old_value"`
+	NewValue  string    `json:"new_value"`
+	Actor     string    `json:"actor"`
+	ChangedAt timestamp `json:"changed_at"`
+}
+
+// recordAddressChanges records each field that differs between before and
+// after as part of tx.
+func recordAddressChanges(ctx context.Context, tx *sql.Tx, actor string, before, after Address) error {
+	fields := []struct{ name, old, new string }{
+		{"street", before.Street, after.Street},
+		{"city", before.City, after.City},
+		{"country", before.Country, after.Country},
+		{"postal_code", before.PostalCode, after.PostalCode},
+		{"latitude", formatCoordinate(before.Latitude), formatCoordinate(after.Latitude)},
+		{"longitude", formatCoordinate(before.Longitude), formatCoordinate(after.Longitude)},
+	}
+	for _, f := range fields {
+		if f.old == f.new {
+			continue
+		}
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO address_history (address_id, address_uuid, field, old_value, new_value, actor) VALUES ($1, $2, $3, $4, $5, $6)`,
+			after.ID, after.UUID, f.name, f.old, f.new, actor,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatCoordinate formats a nullable coordinate for the history, as "" if
+// it's NULL.
+func formatCoordinate(c *float64) string {
+	if c == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*c, 'f', -1, 64)
+}
+
+// listAddressHistory lists the changes to an address, oldest first. History
+// is kept after an address is deleted, so this is only 404 for addresses that
+// neither exist nor were ever changed.
+func listAddressHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "addresses")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	p, err := parsePage(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var total int
+	var exists bool
+	err = queryRowContext(r.Context(),
+		`SELECT (SELECT count(*) FROM address_history WHERE address_id = $1),
+		        EXISTS (SELECT 1 FROM addresses WHERE id = $1)`, id,
+	).Scan(&total, &exists)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if total == 0 && !exists {
+		writeError(w, r, errNotFound)
+		return
+	}
+	rows, err := queryContext(r.Context(),
+		`SELECT field, old_value, new_value, actor, changed_at FROM address_history
+		 WHERE address_id = $1 ORDER BY changed_at, id LIMIT $2 OFFSET $3`,
+		id, p.Limit, p.Offset,
+	)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	changes, err := scanAll(rows, func(rows *sql.Rows) (addressChange, error) {
+		var c addressChange
+		err := rows.Scan(&c.Field, &c.OldValue, &c.NewValue, &c.Actor, &c.ChangedAt)
+		return c, err
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	setPageHeaders(w, r, p, total)
+	writeJSON(w, http.StatusOK, changes)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// maxHookReason is how much of a rejecting hook's response body is returned
+// to the client as the reason.
+const maxHookReason = 512
+
+var hookClient = &http.Client{}
+
+// checkPreCreateHook asks cfg.PreCreateHookURL whether u may be created. A 4xx
+// response rejects the user with 422 and the hook's response body as the
+// reason. The hook failing to respond, or responding with anything else
+// unsuccessful, is a 502.
+func checkPreCreateHook(ctx context.Context, u User) error {
+	if cfg.PreCreateHookURL == "" {
+		return nil
+	}
+	body, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.PreCreateHookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.PreCreateHookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		// The error includes the URL, which may contain credentials.
+		log.Printf("pre-create hook: %v", err)
+		return newError(http.StatusBadGateway, "hook_failed", "the pre-create hook did not respond")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	if resp.StatusCode < 400 || resp.StatusCode >= 500 {
+		return newError(http.StatusBadGateway, "hook_failed", fmt.Sprintf("the pre-create hook responded %s", resp.Status))
+	}
+	reason, _ := io.ReadAll(io.LimitReader(resp.Body, maxHookReason))
+	msg := strings.TrimSpace(string(reason))
+	if msg == "" {
+		msg = resp.Status
+	}
+	return newError(http.StatusUnprocessableEntity, "rejected_by_hook", msg)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckPreCreateHook(t *testing.T) {
+	tests := []struct {
+		name     string
+		respond  func(w http.ResponseWriter)
+		wantCode string
+		wantMsg  string
+	}{
+		{"accepted", func(w http.ResponseWriter) { w.WriteHeader(http.StatusNoContent) }, "", ""},
+		{"rejected", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("email domain is blocked\n"))
+		}, "rejected_by_hook", "email domain is blocked"},
+		{"rejected without a reason", func(w http.ResponseWriter) { w.WriteHeader(http.StatusConflict) }, "rejected_by_hook", "409 Conflict"},
+		{"failed", func(w http.ResponseWriter) { w.WriteHeader(http.StatusInternalServerError) }, "hook_failed", "the pre-create hook responded 500 Internal Server Error"},
+		{"timed out", func(w http.ResponseWriter) { time.Sleep(200 * time.Millisecond) }, "hook_failed", "the pre-create hook did not respond"},
+	}
+	for _, tt := range tests {
+		var got User
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&got)
+			tt.respond(w)
+		}))
+		setConfig(t, func(c *config) {
+			c.PreCreateHookURL = srv.URL
+			c.PreCreateHookTimeout = 100 * time.Millisecond
+		})
+		err := checkPreCreateHook(context.Background(), User{Name: "Alice", Email: "alice@example.com"})
+		srv.Close()
+		if got.Email != "alice@example.com" {
+			t.Errorf("%s: hook was sent %+v", tt.name, got)
+		}
+		if tt.wantCode == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		wantStatus := http.StatusBadGateway
+		if tt.wantCode == "rejected_by_hook" {
+			wantStatus = http.StatusUnprocessableEntity
+		}
+		if e, ok := err.(*apiError); !ok || e.Status != wantStatus || e.Code != tt.wantCode || e.Message != tt.wantMsg {
+			t.Errorf("%s: got %v, want %d %s %q", tt.name, err, wantStatus, tt.wantCode, tt.wantMsg)
+		}
+	}
+}
+
+func TestCheckPreCreateHookDisabled(t *testing.T) {
+	setConfig(t, func(c *config) { c.PreCreateHookURL = "" })
+	if err := checkPreCreateHook(context.Background(), User{}); err != nil {
+		t.Error(err)
+	}
+}
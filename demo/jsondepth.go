@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+var errJSONTooDeep = errors.New("JSON nesting is too deep")
+
+// depthLimitReader fails with errJSONTooDeep as soon as the JSON read through
+// it nests arrays and objects more than max deep, so that pathologically
+// nested bodies are rejected before they are decoded. It only tracks
+// brackets and strings, leaving the rest of the syntax to the decoder.
+type depthLimitReader struct {
+	r        io.Reader
+	max      int
+	depth    int
+	inString bool
+	escaped  bool
+}
+
+func newDepthLimitReader(r io.Reader, max int) io.Reader {
+	if max <= 0 {
+		return r
+	}
+	return &depthLimitReader{r: r, max: max}
+}
+
+func (d *depthLimitReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	for _, c := range p[:n] {
+		switch {
+		case d.escaped:
+			d.escaped = false
+		case d.inString:
+			switch c {
+			case '\\':
+				d.escaped = true
+			case '"':
+				d.inString = false
+			}
+		case c == '"':
+			d.inString = true
+		case c == '[' || c == '{':
+			if d.depth++; d.depth > d.max {
+				return 0, errJSONTooDeep
+			}
+		case c == ']' || c == '}':
+			d.depth--
+		}
+	}
+	return n, err
+}
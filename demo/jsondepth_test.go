@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDepthLimitReader(t *testing.T) {
+	tests := []struct {
+		body string
+		ok   bool
+	}{
+		{`{"a":[1,{"b":2}]}`, true},
+		{`{"a":[1,{"b":[]}]}`, false},
+		{`[[[]],[[]],[[]]]`, true},
+		// Brackets in strings don't count, even after escaped quotes.
+		{`{"a":"[[[[{{{{"}`, true},
+		{`{"a":"\"[[[[","b":"\\"}`, true},
+		{`{"a":"\\","b":[[[]]]}`, false},
+	}
+	for _, tt := range tests {
+		var v any
+		err := json.NewDecoder(newDepthLimitReader(strings.NewReader(tt.body), 3)).Decode(&v)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.body, err)
+		}
+		if !tt.ok && err != errJSONTooDeep {
+			t.Errorf("%s: got %v, want errJSONTooDeep", tt.body, err)
+		}
+	}
+}
+
+// endlessNesting is a JSON body of endlessly nested arrays, counting how much
+// of it has been read.
+type endlessNesting struct {
+	read int
+}
+
+func (e *endlessNesting) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = '['
+	}
+	e.read += len(p)
+	return len(p), nil
+}
+
+func TestDecodeJSONRejectsDeepNesting(t *testing.T) {
+	setConfig(t, func(c *config) { c.MaxJSONDepth = 5 })
+	body := &endlessNesting{}
+	r := jsonRequest("POST", "/users", "")
+	r.Body = io.NopCloser(body)
+	err := decodeJSON(r, &userInput{})
+	if e, ok := err.(*apiError); !ok || e.Status != http.StatusBadRequest || e.Code != "json_too_deep" {
+		t.Fatalf("got %v, want json_too_deep", err)
+	}
+	if body.read > 64<<10 {
+		t.Errorf("read %d bytes before rejecting the body", body.read)
+	}
+
+	h := newHandler(newMux())
+	w := serve(h, jsonRequest("POST", "/users", strings.Repeat(`{"a":`, 100)+"1"+strings.Repeat("}", 100)))
+	if w.Code != http.StatusBadRequest || responseAs[errorBody](t, w).Error.Code != "json_too_deep" {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// marshalNullEmpty encodes the struct v like json.Marshal, except that zero
+// fields are encoded as null rather than with their zero value or, for
+// omitempty and omitzero fields, being left out. false is a value rather than
+// the absence of one, so bools are encoded as usual. Used when cfg.NullEmpty
+// is set.
+//
+// The fields of embedded structs are encoded in their place, unless v has a
+// field of the same name, as json.Marshal does.
+func marshalNullEmpty(v any) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	rt := rv.Type()
+	shadowed := map[string]bool{}
+	for i := range rt.NumField() {
+		if f := rt.Field(i); !f.Anonymous {
+			shadowed[jsonName(f)] = true
+		}
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	first := true
+	var encode func(rv reflect.Value, embedded bool) error
+	encode = func(rv reflect.Value, embedded bool) error {
+		rt := rv.Type()
+		for i := range rt.NumField() {
+			f := rt.Field(i)
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				if err := encode(rv.Field(i), true); err != nil {
+					return err
+				}
+				continue
+			}
+			name := jsonName(f)
+			if !f.IsExported() || name == "-" || embedded && shadowed[name] {
+				continue
+			}
+			if !first {
+				buf.WriteByte(',')
+			}
+			first = false
+			key, err := json.Marshal(name)
+			if err != nil {
+				return err
+			}
+			buf.Write(key)
+			buf.WriteByte(':')
+			fv := rv.Field(i)
+			if fv.IsZero() && fv.Kind() != reflect.Bool {
+				buf.WriteString("null")
+				continue
+			}
+			value, err := json.Marshal(fv.Interface())
+			if err != nil {
+				return err
+			}
+			buf.Write(value)
+		}
+		return nil
+	}
+	if err := encode(rv, false); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// jsonName returns the name of f in JSON, or "-" if it's never encoded.
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" {
+		name = f.Name
+	}
+	return name
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNullEmpty(t *testing.T) {
+	lat, lng := 51.5, -0.1
+	tests := []struct {
+		name      string
+		v         any
+		omit, nul string
+	}{
+		{
+			"user", User{ID: 1, Name: "Alice"},
+			`{"id":1,"name":"Alice","email":"","active":false}`,
+			`{"id":1,"name":"Alice","email":null,"active":false,"created_at":null,"updated_at":null,"addresses":null}`,
+		},
+		{
+			"address", Address{ID: 2, UserID: 1, Street: "1 Main St", Country: "GB"},
+			`{"id":2,"user_id":1,"street":"1 Main St","city":"","country":"GB","postal_code":""}`,
+			`{"id":2,"user_id":1,"street":"1 Main St","city":null,"country":"GB","postal_code":null,"latitude":null,"longitude":null,"created_at":null,"updated_at":null}`,
+		},
+		{
+			"address with coordinates", Address{ID: 2, UserID: 1, Latitude: &lat, Longitude: &lng},
+			`{"id":2,"user_id":1,"street":"","city":"","country":"","postal_code":"","latitude":51.5,"longitude":-0.1}`,
+			`{"id":2,"user_id":1,"street":null,"city":null,"country":null,"postal_code":null,"latitude":51.5,"longitude":-0.1,"created_at":null,"updated_at":null}`,
+		},
+	}
+	for _, nullEmpty := range []bool{false, true} {
+		setConfig(t, func(c *config) { c.NullEmpty = nullEmpty })
+		for _, tt := range tests {
+			want := tt.omit
+			if nullEmpty {
+				want = tt.nul
+			}
+			got, err := json.Marshal(tt.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != want {
+				t.Errorf("%s, NullEmpty=%v:\n got %s\nwant %s", tt.name, nullEmpty, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,1887 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	if cfg, err = loadConfig(); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+// setConfig applies change to cfg for the duration of the test.
+func setConfig(t *testing.T, change func(*config)) {
+	t.Helper()
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	change(&cfg)
+}
+
+// testDB points db at the database named by TEST_DATABASE_URL, with
+// schema.sql applied and every table emptied, for the duration of the test.
+// The test is skipped if TEST_DATABASE_URL is unset. The pool is configured
+// from cfg, so set that first.
+func testDB(t *testing.T) {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	pgcfg, err := cfg.pgxConfig(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pgcfg.Tracer = countingTracer{}
+	saved := db
+	db = stdlib.OpenDB(*pgcfg)
+	t.Cleanup(func() {
+		db.Close()
+		db = saved
+	})
+	schema, err := os.ReadFile("schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("TRUNCATE users, addresses, audit_log, address_history RESTART IDENTITY CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	// Cached query results are of earlier tests' data.
+	queryCache = newLRUCache[string, cachedResult](queryCacheSize, 0)
+}
+
+// testQueries counts the queries run on the pool opened by testDB.
+var testQueries atomic.Int64
+
+type countingTracer struct{}
+
+func (countingTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	testQueries.Add(1)
+	return ctx
+}
+
+func (countingTracer) TraceQueryEnd(context.Context, *pgx.Conn, pgx.TraceQueryEndData) {}
+
+// serve sends r through h and returns the response.
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// jsonRequest returns a request with a JSON body.
+func jsonRequest(method, target, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+// createTestUser creates a user through h.
+func createTestUser(t *testing.T, h http.Handler, name, email string) User {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"name": name, "email": email})
+	w := serve(h, jsonRequest("POST", "/users", string(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create user %s: %d %s", email, w.Code, w.Body)
+	}
+	return responseAs[User](t, w)
+}
+
+// createTestAddress creates an address for user through h.
+func createTestAddress(t *testing.T, h http.Handler, user int, street, city, country string) Address {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{"user_id": user, "street": street, "city": city, "country": country})
+	w := serve(h, jsonRequest("POST", "/addresses", string(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create address %s: %d %s", street, w.Code, w.Body)
+	}
+	return responseAs[Address](t, w)
+}
+
+// userPath returns the path of the user with the given id.
+func userPath(id int) string {
+	return "/users/" + strconv.Itoa(id)
+}
+
+// testRoutes are the patterns of every route registered by newMux, with the
+// optional routes enabled by testMux.
+var testRoutes = []string{
+	"GET /health",
+	"GET /readyz",
+	"GET /events",
+	"GET /debug/vars",
+	"GET /stats",
+	"GET /stats/users-by-country",
+	"GET /users",
+	"POST /users",
+	"POST /users/batch",
+	"POST /users/exists",
+	"POST /users/batch-get",
+	"POST /users/validate-emails",
+	"GET /users/{id}",
+	"GET /users/{id}/{sub}",
+	"GET /users/{id}/addresses",
+	"PUT /users/{id}/addresses/order",
+	"PATCH /users/{id}",
+	"DELETE /users/{id}",
+	"POST /users/{id}/merge",
+	"POST /users/{id}/activate",
+	"POST /users/{id}/deactivate",
+	"GET /addresses",
+	"POST /addresses",
+	"POST /addresses/validate",
+	"POST /addresses/geocode",
+	"GET /addresses/by-country",
+	"GET /addresses/{id}",
+	"PATCH /addresses/{id}",
+	"DELETE /addresses/{id}",
+	"GET /addresses/{id}/history",
+	"GET /admin/slow-queries",
+	"GET /audit",
+	"GET /admin/export",
+	"GET /admin/export/users.csv",
+	"GET /admin/export/addresses.csv",
+	"POST /admin/import",
+	"POST /admin/reindex",
+}
+
+// testMux returns newMux with every optional route registered.
+func testMux(t *testing.T) *http.ServeMux {
+	t.Helper()
+	setConfig(t, func(c *config) { c.GeocoderURL = "http://geocoder.invalid" })
+	return newMux() // Panics if any two patterns conflict.
+}
+
+// samplePath returns a path matching pattern, with each wildcard replaced
+// by 1.
+func samplePath(pattern string) string {
+	_, path, _ := strings.Cut(pattern, " ")
+	return regexp.MustCompile(`\{[^}]*\}`).ReplaceAllString(path, "1")
+}
+
+func TestNewMux(t *testing.T) {
+	mux := testMux(t)
+	for _, pattern := range testRoutes {
+		method, _, _ := strings.Cut(pattern, " ")
+		_, got := mux.Handler(httptest.NewRequest(method, samplePath(pattern), nil))
+		if got != pattern {
+			t.Errorf("%s matched %q", pattern, got)
+		}
+	}
+	// GET routes answer HEAD, unless it has a route of its own.
+	_, got := mux.Handler(httptest.NewRequest("HEAD", "/users/1", nil))
+	if got != "GET /users/{id}" {
+		t.Errorf("HEAD /users/1 matched %q", got)
+	}
+	// userSubresource serves these.
+	for _, r := range []*http.Request{
+		httptest.NewRequest("GET", "/users/by-email/a@example.com", nil),
+		httptest.NewRequest("HEAD", "/users/by-email/a@example.com", nil),
+		httptest.NewRequest("GET", "/users/1/summary", nil),
+	} {
+		if _, got := mux.Handler(r); got != "GET /users/{id}/{sub}" {
+			t.Errorf("%s %s matched %q", r.Method, r.URL, got)
+		}
+	}
+}
+
+func TestRoutePattern(t *testing.T) {
+	mux := testMux(t)
+	var got string
+	handler := withRoute(mux, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = routePattern(r)
+	}))
+	for _, pattern := range testRoutes {
+		method, _, _ := strings.Cut(pattern, " ")
+		serve(handler, httptest.NewRequest(method, samplePath(pattern), nil))
+		if got != pattern {
+			t.Errorf("%s: routePattern %q", pattern, got)
+		}
+	}
+	for _, r := range []*http.Request{
+		httptest.NewRequest("GET", "/nothing", nil),
+		httptest.NewRequest("PUT", "/users", nil),
+	} {
+		serve(handler, r)
+		if got != "" {
+			t.Errorf("%s %s: routePattern %q for an unmatched request", r.Method, r.URL, got)
+		}
+	}
+}
+
+func TestNewMuxBasePath(t *testing.T) {
+	setConfig(t, func(c *config) { c.BasePath = "/api" })
+	mux := newMux()
+	_, pattern := mux.Handler(httptest.NewRequest("GET", "/api/users/1", nil))
+	if pattern != "GET /api/users/{id}" {
+		t.Errorf("matched %q", pattern)
+	}
+}
+
+func TestUserSubresourceNotFound(t *testing.T) {
+	w := serve(newHandler(newMux()), httptest.NewRequest("GET", "/users/1/nope", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestBasePathLinks(t *testing.T) {
+	setConfig(t, func(c *config) { c.BasePath = "/api" })
+	testDB(t)
+	h := newHandler(newMux())
+	w := serve(h, jsonRequest("POST", "/api/users", `{"name":"Alice","email":"alice@example.com"}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	u := responseAs[User](t, w)
+	if got, want := w.Header().Get("Location"), "/api/users/"+strconv.Itoa(u.ID); got != want {
+		t.Errorf("Location %q, want %q", got, want)
+	}
+	if w := serve(h, httptest.NewRequest("GET", "/api/users/"+strconv.Itoa(u.ID), nil)); w.Code != http.StatusOK {
+		t.Errorf("GET under the base path: %d", w.Code)
+	}
+	if w := serve(h, httptest.NewRequest("GET", userPath(u.ID), nil)); w.Code != http.StatusNotFound {
+		t.Errorf("GET outside the base path: %d, want 404", w.Code)
+	}
+	w = serve(h, httptest.NewRequest("GET", "/api/users?limit=1", nil))
+	if link := w.Header().Get("Link"); !strings.Contains(link, "</api/users?limit=1&offset=0>") {
+		t.Errorf("Link %q doesn't include the base path", link)
+	}
+}
+
+func TestQueryExecModes(t *testing.T) {
+	for mode := range queryExecModes {
+		t.Run(mode, func(t *testing.T) {
+			setConfig(t, func(c *config) { c.QueryExecMode = mode })
+			testDB(t)
+			h := newHandler(newMux())
+			u := createTestUser(t, h, "Alice", "alice@example.com")
+			createTestAddress(t, h, u.ID, "1 Main St", "Springfield", "US")
+			for _, target := range []string{userPath(u.ID), "/users?q=ali", "/addresses?country=US"} {
+				if w := serve(h, httptest.NewRequest("GET", target, nil)); w.Code != http.StatusOK {
+					t.Errorf("GET %s: %d %s", target, w.Code, w.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestGetUserCache(t *testing.T) {
+	testDB(t)
+	saved := userCache
+	userCache = newLRUCache[int, User](10, time.Minute)
+	t.Cleanup(func() { userCache = saved })
+	h := newHandler(newMux())
+	u := createTestUser(t, h, "Alice", "alice@example.com")
+
+	for _, want := range []string{"MISS", "HIT"} {
+		w := serve(h, httptest.NewRequest("GET", userPath(u.ID), nil))
+		if got := w.Header().Get("X-Cache"); got != want {
+			t.Errorf("X-Cache: got %q, want %q", got, want)
+		}
+	}
+
+	if w := serve(h, jsonRequest("PATCH", userPath(u.ID), `{"name":"Alicia"}`)); w.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+	w := serve(h, httptest.NewRequest("GET", userPath(u.ID), nil))
+	if got := responseAs[User](t, w); got.Name != "Alicia" {
+		t.Errorf("served stale name %q after update", got.Name)
+	}
+
+	if w := serve(h, httptest.NewRequest("DELETE", userPath(u.ID), nil)); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, httptest.NewRequest("GET", userPath(u.ID), nil)); w.Code != http.StatusNotFound {
+		t.Errorf("served deleted user: %d", w.Code)
+	}
+}
+
+func TestHeadMatchesGet(t *testing.T) {
+	useMemoryRepositories(t)
+	h := newHandler(newMux())
+	u := createTestUser(t, h, "Alice", "alice@example.com")
+	a := createTestAddress(t, h, u.ID, "1 Main St", "Springfield", "US")
+	// The server, rather than the handler, discards the bodies of HEAD
+	// responses, so go through one.
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	for _, path := range []string{userPath(u.ID), "/addresses/" + strconv.Itoa(a.ID), "/users/999", "/addresses/999"} {
+		get, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		get.Body.Close()
+		head, err := http.Head(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(head.Body)
+		head.Body.Close()
+		if head.StatusCode != get.StatusCode {
+			t.Errorf("%s: HEAD got %d, GET %d", path, head.StatusCode, get.StatusCode)
+		}
+		for _, name := range []string{"ETag", "Cache-Control", "Content-Type"} {
+			if got, want := head.Header.Get(name), get.Header.Get(name); got != want {
+				t.Errorf("%s: HEAD %s %q, GET %q", path, name, got, want)
+			}
+		}
+		if len(body) != 0 {
+			t.Errorf("%s: HEAD got body %q", path, body)
+		}
+	}
+	head, err := http.Head(srv.URL + userPath(u.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head.Body.Close()
+	if head.StatusCode != http.StatusOK || head.Header.Get("ETag") == "" || head.Header.Get("Cache-Control") != "private, no-cache" {
+		t.Errorf("got %d %v", head.StatusCode, head.Header)
+	}
+}
+
+func TestListUsersIncludeAddressesQueryCount(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	for _, n := range []int{1, 5} {
+		for i := range n {
+			u := createTestUser(t, h, "User", fmt.Sprintf("user%d.%d@example.com", n, i))
+			createTestAddress(t, h, u.ID, "1 Main St", "Springfield", "US")
+			createTestAddress(t, h, u.ID, "2 Main St", "Springfield", "US")
+		}
+		// Keyset pagination skips the count query, leaving one query for
+		// the users and one for all of their addresses.
+		testQueries.Store(0)
+		w := serve(h, httptest.NewRequest("GET", "/users?include=addresses&after_id=0", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%d %s", w.Code, w.Body)
+		}
+		if got := testQueries.Load(); got != 2 {
+			t.Errorf("%d users: %d queries, want 2", n, got)
+		}
+		for _, u := range responseAs[[]User](t, w) {
+			if len(u.Addresses) != 2 {
+				t.Errorf("user %d has %d addresses", u.ID, len(u.Addresses))
+			}
+		}
+		if _, err := db.Exec("TRUNCATE users CASCADE"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListUsersIncludeAddressesEmpty(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	createTestUser(t, h, "Alice", "alice@example.com")
+	w := serve(h, httptest.NewRequest("GET", "/users?include=addresses", nil))
+	if !strings.Contains(w.Body.String(), `"addresses":[]`) {
+		t.Errorf("a user without addresses should have addresses []: %s", w.Body)
+	}
+}
+
+// adminRequest returns a JSON request bearing the token of the admin "ops".
+func adminRequest(t *testing.T, method, target, body string) *http.Request {
+	t.Helper()
+	setConfig(t, func(c *config) { c.AdminTokens = map[string]string{"ops": "secret"} })
+	r := jsonRequest(method, target, body)
+	r.Header.Set("Authorization", "Bearer secret")
+	return r
+}
+
+func TestMergeUsersValidation(t *testing.T) {
+	h := newHandler(newMux())
+	if w := serve(h, jsonRequest("POST", "/users/1/merge", `{"duplicate_id":2}`)); w.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: %d", w.Code)
+	}
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"duplicate_id":1}`, http.StatusBadRequest},
+		{`{}`, http.StatusUnprocessableEntity},
+		{`{"duplicate_id":1.5}`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		if w := serve(h, adminRequest(t, "POST", "/users/1/merge", tt.body)); w.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.body, w.Code, w.Body, tt.want)
+		}
+	}
+}
+
+func TestMergeUsers(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	survivor := createTestUser(t, h, "Alice", "alice@example.com")
+	duplicate := createTestUser(t, h, "Alice", "alice@work.example.com")
+	createTestAddress(t, h, survivor.ID, "1 Main St", "Springfield", "US")
+	createTestAddress(t, h, duplicate.ID, "1 Main St", "Springfield", "US")
+	moved := createTestAddress(t, h, duplicate.ID, "2 Office Park", "Springfield", "US")
+
+	w := serve(h, adminRequest(t, "POST", userPath(survivor.ID)+"/merge", fmt.Sprintf(`{"duplicate_id":%d}`, duplicate.ID)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	if got := responseAs[User](t, w); got.ID != survivor.ID {
+		t.Errorf("returned %+v", got)
+	}
+	if w := serve(h, httptest.NewRequest("GET", userPath(duplicate.ID), nil)); w.Code != http.StatusNotFound {
+		t.Errorf("duplicate still exists: %d", w.Code)
+	}
+	w = serve(h, httptest.NewRequest("GET", userPath(survivor.ID)+"?include=addresses", nil))
+	addresses := responseAs[User](t, w).Addresses
+	if len(addresses) != 2 || addresses[1].ID != moved.ID {
+		t.Errorf("survivor has addresses %+v", addresses)
+	}
+	var actor string
+	if err := db.QueryRow("SELECT actor FROM audit_log WHERE action = 'merge' AND resource_id = $1", survivor.ID).Scan(&actor); err != nil {
+		t.Fatalf("merge not audited: %v", err)
+	}
+	if actor != "ops" {
+		t.Errorf("audited actor %q", actor)
+	}
+
+	w = serve(h, adminRequest(t, "POST", userPath(survivor.ID)+"/merge", fmt.Sprintf(`{"duplicate_id":%d}`, duplicate.ID)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("merging a deleted user: %d", w.Code)
+	}
+}
+
+func TestCreateUserUpsert(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	w := serve(h, jsonRequest("POST", "/users?upsert=true", `{"name":"Alice","email":"alice@example.com"}`))
+	if w.Code != http.StatusCreated || w.Header().Get("X-Resource-Created") != "true" {
+		t.Fatalf("insert: %d %q %s", w.Code, w.Header().Get("X-Resource-Created"), w.Body)
+	}
+	created := responseAs[User](t, w)
+
+	w = serve(h, jsonRequest("POST", "/users?upsert=true", `{"name":"Alicia","email":"ALICE@example.com"}`))
+	if w.Code != http.StatusOK || w.Header().Get("X-Resource-Created") != "false" {
+		t.Fatalf("update: %d %q %s", w.Code, w.Header().Get("X-Resource-Created"), w.Body)
+	}
+	if w.Header().Get("Location") != "" {
+		t.Error("Location set for an update")
+	}
+	if got := responseAs[User](t, w); got.ID != created.ID || got.Name != "Alicia" {
+		t.Errorf("updated %+v, created %+v", got, created)
+	}
+
+	w = serve(h, jsonRequest("POST", "/users", `{"name":"Alice","email":"alice@example.com"}`))
+	if w.Code != http.StatusConflict {
+		t.Errorf("without upsert: %d", w.Code)
+	}
+	if w.Header().Get("X-Resource-Created") != "" {
+		t.Error("X-Resource-Created set without upsert")
+	}
+}
+
+func TestUpsertResourceCreated(t *testing.T) {
+	s := useMemoryRepositories(t)
+	h := newHandler(newMux())
+	var bodies []map[string]any
+	for i, tt := range []struct {
+		email   string
+		created bool
+	}{
+		{"alice@example.com", true},
+		{"Alice@example.com", false},
+		{"bob@example.com", true},
+	} {
+		before := len(s.users)
+		w := serve(h, jsonRequest("POST", "/users?upsert=true", fmt.Sprintf(`{"name":"User %d","email":%q}`, i, tt.email)))
+		inserted := len(s.users) > before
+		if inserted != tt.created {
+			t.Fatalf("%s: inserted %v", tt.email, inserted)
+		}
+		if got := w.Header().Get("X-Resource-Created"); got != strconv.FormatBool(inserted) {
+			t.Errorf("%s: X-Resource-Created %q, inserted %v", tt.email, got, inserted)
+		}
+		bodies = append(bodies, responseAs[map[string]any](t, w))
+	}
+	// Clients needn't tell the responses apart by their bodies.
+	for _, body := range bodies[1:] {
+		if !slices.Equal(slices.Sorted(maps.Keys(body)), slices.Sorted(maps.Keys(bodies[0]))) {
+			t.Errorf("got fields %v, want %v", slices.Sorted(maps.Keys(body)), slices.Sorted(maps.Keys(bodies[0])))
+		}
+	}
+}
+
+func TestCreateUserForm(t *testing.T) {
+	s := useMemoryRepositories(t)
+	h := newHandler(newMux())
+	post := func(contentType, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/users", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		return serve(h, r)
+	}
+
+	w := post("application/x-www-form-urlencoded", "name=Alice+Smith&email=Alice%40Example.com")
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	got := responseAs[User](t, w)
+	if got.Name != "Alice Smith" || got.Email != "alice@example.com" || s.users[got.ID].Email != "alice@example.com" {
+		t.Errorf("created %+v", got)
+	}
+	if loc := w.Header().Get("Location"); loc != userPath(got.ID) {
+		t.Errorf("Location %q", loc)
+	}
+
+	// Form bodies are validated as JSON ones are.
+	w = post("application/x-www-form-urlencoded; charset=utf-8", "name=Bob&email=nope")
+	if w.Code != http.StatusUnprocessableEntity || responseAs[errorBody](t, w).Error.Fields["email"] == "" {
+		t.Errorf("invalid email: got %d %s", w.Code, w.Body)
+	}
+	w = post("application/x-www-form-urlencoded", "name=Alice&email=alice%40example.com")
+	if w.Code != http.StatusConflict {
+		t.Errorf("taken email: got %d %s", w.Code, w.Body)
+	}
+	w = post("application/x-www-form-urlencoded", "name=%zz")
+	if w.Code != http.StatusBadRequest || responseAs[errorBody](t, w).Error.Code != "invalid_form" {
+		t.Errorf("malformed form: got %d %s", w.Code, w.Body)
+	}
+	w = post("text/plain", "name=Carol&email=carol%40example.com")
+	if w.Code != http.StatusUnsupportedMediaType || responseAs[errorBody](t, w).Error.Code != "unsupported_media_type" {
+		t.Errorf("text/plain: got %d %s", w.Code, w.Body)
+	}
+	if w := post("application/json", `{"name":"Carol","email":"carol@example.com"}`); w.Code != http.StatusCreated {
+		t.Errorf("JSON: got %d %s", w.Code, w.Body)
+	}
+	if len(s.users) != 2 {
+		t.Errorf("got %d users, want 2", len(s.users))
+	}
+}
+
+func TestAddressLimitUnderConcurrentCreates(t *testing.T) {
+	setConfig(t, func(c *config) { c.MaxAddressesPerUser = 5 })
+	testDB(t)
+	h := newHandler(newMux())
+	u := createTestUser(t, h, "Alice", "alice@example.com")
+
+	const attempts = 20
+	statuses := make([]int, attempts)
+	var wg sync.WaitGroup
+	for i := range attempts {
+		wg.Go(func() {
+			body := fmt.Sprintf(`{"user_id":%d,"street":"%d Main St","city":"Springfield","country":"US"}`, u.ID, i)
+			statuses[i] = serve(h, jsonRequest("POST", "/addresses", body)).Code
+		})
+	}
+	wg.Wait()
+	created := 0
+	for _, status := range statuses {
+		switch status {
+		case http.StatusCreated:
+			created++
+		case http.StatusUnprocessableEntity:
+		default:
+			t.Errorf("status %d", status)
+		}
+	}
+	var count int
+	if err := db.QueryRow("SELECT count(*) FROM addresses WHERE user_id = $1", u.ID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if created != 5 || count != 5 {
+		t.Errorf("created %d, stored %d, want 5", created, count)
+	}
+	body := fmt.Sprintf(`{"user_id":%d,"street":"Another St","city":"Springfield","country":"US"}`, u.ID)
+	w := serve(h, jsonRequest("POST", "/addresses", body))
+	if code := responseAs[errorBody](t, w).Error.Code; code != "address_limit_reached" {
+		t.Errorf("code %q", code)
+	}
+}
+
+func TestInactiveUserVisibility(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	alice := createTestUser(t, h, "Alice", "alice@example.com")
+	createTestUser(t, h, "Bob", "bob@example.com")
+	home := createTestAddress(t, h, alice.ID, "1 Main St", "Springfield", "US")
+
+	w := serve(h, adminRequest(t, "POST", userPath(alice.ID)+"/deactivate", ""))
+	if got := responseAs[User](t, w); w.Code != http.StatusOK || got.Active {
+		t.Fatalf("deactivate: %d %s", w.Code, w.Body)
+	}
+	listed := func(r *http.Request) int {
+		t.Helper()
+		w := serve(h, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", r.URL, w.Code, w.Body)
+		}
+		return len(responseAs[[]User](t, w))
+	}
+	if n := listed(httptest.NewRequest("GET", "/users", nil)); n != 1 {
+		t.Errorf("listed %d users, want only the active one", n)
+	}
+	if n := listed(adminRequest(t, "GET", "/users?include_inactive=true", "")); n != 2 {
+		t.Errorf("listed %d users with include_inactive, want 2", n)
+	}
+	if n := listed(httptest.NewRequest("GET", "/addresses", nil)); n != 0 {
+		t.Errorf("listed %d addresses of the inactive user", n)
+	}
+	if n := listed(adminRequest(t, "GET", "/addresses?include_inactive=true", "")); n != 1 {
+		t.Errorf("listed %d addresses with include_inactive, want 1", n)
+	}
+	tests := []struct {
+		r    *http.Request
+		want int
+	}{
+		{httptest.NewRequest("GET", userPath(alice.ID), nil), http.StatusNotFound},
+		{httptest.NewRequest("GET", userPath(alice.ID)+"?include_inactive=true", nil), http.StatusUnauthorized},
+		{adminRequest(t, "GET", userPath(alice.ID)+"?include_inactive=true", ""), http.StatusOK},
+		{httptest.NewRequest("GET", "/users?include_inactive=true", nil), http.StatusUnauthorized},
+		{httptest.NewRequest("POST", userPath(alice.ID)+"/activate", nil), http.StatusUnauthorized},
+		{httptest.NewRequest("GET", "/addresses/"+strconv.Itoa(home.ID), nil), http.StatusNotFound},
+		{adminRequest(t, "GET", "/addresses/"+strconv.Itoa(home.ID)+"?include_inactive=true", ""), http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := serve(h, tt.r); w.Code != tt.want {
+			t.Errorf("%s %s: %d, want %d", tt.r.Method, tt.r.URL, w.Code, tt.want)
+		}
+	}
+
+	w = serve(h, adminRequest(t, "POST", userPath(alice.ID)+"/activate", ""))
+	if got := responseAs[User](t, w); !got.Active {
+		t.Fatalf("activate: %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, httptest.NewRequest("GET", userPath(alice.ID), nil)); w.Code != http.StatusOK {
+		t.Errorf("reactivated user: %d", w.Code)
+	}
+	if w := serve(h, httptest.NewRequest("GET", "/addresses/"+strconv.Itoa(home.ID), nil)); w.Code != http.StatusOK {
+		t.Errorf("reactivated user's address: %d", w.Code)
+	}
+}
+
+func TestInactiveUserAddressVisibility(t *testing.T) {
+	s := useMemoryRepositories(t)
+	h := newHandler(newMux())
+	alice := createTestUser(t, h, "Alice", "alice@example.com")
+	bob := createTestUser(t, h, "Bob", "bob@example.com")
+	aliceHome := createTestAddress(t, h, alice.ID, "1 Main St", "Springfield", "US")
+	bobHome := createTestAddress(t, h, bob.ID, "2 Main St", "Springfield", "US")
+	setActive := func(id int, active bool) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		u := s.users[id]
+		u.Active = active
+		s.users[id] = u
+	}
+	check := func(aliceVisible bool) {
+		t.Helper()
+		both := []int{aliceHome.ID, bobHome.ID}
+		visible, aliceStatus := both, http.StatusOK
+		if !aliceVisible {
+			visible, aliceStatus = []int{bobHome.ID}, http.StatusNotFound
+		}
+		aliceTarget := "/addresses/" + strconv.Itoa(aliceHome.ID)
+		tests := []struct {
+			r    *http.Request
+			list []int
+			want int
+		}{
+			{httptest.NewRequest("GET", "/addresses", nil), visible, http.StatusOK},
+			{adminRequest(t, "GET", "/addresses?include_inactive=true", ""), both, http.StatusOK},
+			{httptest.NewRequest("GET", "/addresses?include_inactive=true", nil), nil, http.StatusUnauthorized},
+			{httptest.NewRequest("GET", aliceTarget, nil), nil, aliceStatus},
+			{adminRequest(t, "GET", aliceTarget+"?include_inactive=true", ""), nil, http.StatusOK},
+			{httptest.NewRequest("GET", aliceTarget+"?include_inactive=true", nil), nil, http.StatusUnauthorized},
+			{httptest.NewRequest("GET", "/addresses/"+strconv.Itoa(bobHome.ID), nil), nil, http.StatusOK},
+		}
+		for _, tt := range tests {
+			w := serve(h, tt.r)
+			if w.Code != tt.want {
+				t.Errorf("GET %s: got %d, want %d", tt.r.URL, w.Code, tt.want)
+				continue
+			}
+			if tt.list == nil {
+				continue
+			}
+			var ids []int
+			for _, a := range responseAs[[]Address](t, w) {
+				ids = append(ids, a.ID)
+			}
+			slices.Sort(ids)
+			if !slices.Equal(ids, tt.list) {
+				t.Errorf("GET %s: listed %v, want %v", tt.r.URL, ids, tt.list)
+			}
+		}
+	}
+	check(true)
+	setActive(alice.ID, false)
+	check(false)
+	setActive(alice.ID, true)
+	check(true)
+}
+
+func TestIfUnmodifiedSince(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	u := createTestUser(t, h, "Alice", "alice@example.com")
+	before := u.UpdatedAt.Add(-time.Hour).Format(http.TimeFormat)
+	after := u.UpdatedAt.Add(time.Hour).Format(http.TimeFormat)
+
+	for _, method := range []string{"PATCH", "DELETE"} {
+		r := jsonRequest(method, userPath(u.ID), `{"name":"Alicia"}`)
+		r.Header.Set("If-Unmodified-Since", before)
+		if w := serve(h, r); w.Code != http.StatusPreconditionFailed {
+			t.Errorf("%s modified since: %d %s", method, w.Code, w.Body)
+		}
+	}
+	r := jsonRequest("PATCH", userPath(u.ID), `{"name":"Alicia"}`)
+	r.Header.Set("If-Unmodified-Since", after)
+	if w := serve(h, r); w.Code != http.StatusOK {
+		t.Errorf("PATCH unmodified since: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestListUsersHasAddresses(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	alice := createTestUser(t, h, "Alice", "alice@example.com")
+	createTestUser(t, h, "Bob", "bob@example.com")
+	createTestAddress(t, h, alice.ID, "1 Main St", "Springfield", "US")
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"Alice", "Bob"}},
+		{"?has_addresses=true", []string{"Alice"}},
+		{"?has_addresses=false", []string{"Bob"}},
+		{"?has_addresses=false&limit=1&offset=1", []string{}},
+	}
+	for _, tt := range tests {
+		w := serve(h, httptest.NewRequest("GET", "/users"+tt.query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: %d %s", tt.query, w.Code, w.Body)
+		}
+		names := []string{}
+		for _, u := range responseAs[[]User](t, w) {
+			names = append(names, u.Name)
+		}
+		if !slices.Equal(names, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.query, names, tt.want)
+		}
+	}
+	if w := serve(h, httptest.NewRequest("GET", "/users?has_addresses=maybe", nil)); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid has_addresses: %d, want 400", w.Code)
+	}
+}
+
+func TestListUserAddressesCreatedRange(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	alice := createTestUser(t, h, "Alice", "alice@example.com")
+	for i, street := range []string{"1 Main St", "2 Main St", "3 Main St"} {
+		a := createTestAddress(t, h, alice.ID, street, "Springfield", "US")
+		created := time.Date(2024, 3, 1+i, 12, 0, 0, 0, time.UTC)
+		if _, err := db.Exec("UPDATE addresses SET created_at = $1 WHERE id = $2", created, a.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"1 Main St", "2 Main St", "3 Main St"}},
+		{"?created_after=2024-03-02", []string{"2 Main St", "3 Main St"}},
+		{"?created_before=2024-03-02T12:00:00Z", []string{"1 Main St"}},
+		{"?created_after=2024-03-01T12:00:00Z&created_before=2024-03-03", []string{"2 Main St"}},
+		// 13:00+02:00 is 11:00 UTC, before the second address was created.
+		{"?created_after=2024-03-02T13:00:00%2B02:00", []string{"2 Main St", "3 Main St"}},
+		{"?created_after=2024-03-02&limit=1&offset=1", []string{"3 Main St"}},
+	}
+	for _, tt := range tests {
+		w := serve(h, httptest.NewRequest("GET", userPath(alice.ID)+"/addresses"+tt.query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: %d %s", tt.query, w.Code, w.Body)
+		}
+		streets := []string{}
+		for _, a := range responseAs[[]Address](t, w) {
+			streets = append(streets, a.Street)
+		}
+		if !slices.Equal(streets, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.query, streets, tt.want)
+		}
+	}
+	w := serve(h, httptest.NewRequest("GET", userPath(alice.ID)+"/addresses?created_after=2024-03-02&limit=1", nil))
+	if got := w.Header().Get("X-Total-Count"); got != "2" {
+		t.Errorf("X-Total-Count: got %q, want 2", got)
+	}
+	if w := serve(h, httptest.NewRequest("GET", userPath(alice.ID)+"/addresses?created_after=soon", nil)); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid created_after: %d, want 400", w.Code)
+	}
+	if w := serve(h, httptest.NewRequest("GET", userPath(alice.ID+1)+"/addresses", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("missing user: %d, want 404", w.Code)
+	}
+}
+
+func TestListUsersFilteredKeysetPages(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	var want []int
+	for i, country := range []string{"US", "GB", "US", "", "US", "CA", "US"} {
+		u := createTestUser(t, h, "User", fmt.Sprintf("user%d@example.com", i))
+		if country == "" {
+			continue
+		}
+		// Users with several matching addresses must still appear once.
+		createTestAddress(t, h, u.ID, "1 Main St", "Springfield", country)
+		createTestAddress(t, h, u.ID, "2 Main St", "Springfield", country)
+		if country == "US" || country == "CA" {
+			want = append(want, u.ID)
+		}
+	}
+
+	var got []int
+	next := "/users?country=us,CA&after_id=0&limit=2"
+	for pages := 0; next != ""; pages++ {
+		if pages > len(want) {
+			t.Fatalf("too many pages: %v", got)
+		}
+		w := serve(h, httptest.NewRequest("GET", next, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", next, w.Code, w.Body)
+		}
+		for _, u := range responseAs[[]User](t, w) {
+			got = append(got, u.ID)
+		}
+		if w.Header().Get("X-Total-Count") != "" {
+			t.Errorf("%s: keyset pages have no total", next)
+		}
+		next = ""
+		if link := w.Header().Get("Link"); link != "" {
+			next = strings.TrimPrefix(link[:strings.Index(link, ">")], "<")
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestUpdateAddressValidatesResultingAddress(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	alice := createTestUser(t, h, "Alice", "alice@example.com")
+	body := fmt.Sprintf(`{"user_id":%d,"street":"1 Main St","city":"San Francisco","country":"US","postal_code":"94105"}`, alice.ID)
+	w := serve(h, jsonRequest("POST", "/addresses", body))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	path := "/addresses/" + strconv.Itoa(responseAs[Address](t, w).ID)
+
+	tests := []struct {
+		body      string
+		wantField string
+	}{
+		// The unchanged postal code isn't valid in the new country.
+		{`{"country":"GB"}`, "postal_code"},
+		// The new postal code isn't valid in the unchanged country.
+		{`{"postal_code":"SW1A 1AA"}`, "postal_code"},
+		{`{"city":"London","country":"GB","postal_code":"sw1a 1aa"}`, ""},
+	}
+	for _, tt := range tests {
+		w := serve(h, jsonRequest("PATCH", path, tt.body))
+		if tt.wantField != "" {
+			if w.Code != http.StatusUnprocessableEntity || responseAs[errorBody](t, w).Error.Fields[tt.wantField] == "" {
+				t.Errorf("%s: got %d %s, want a 422 for %s", tt.body, w.Code, w.Body, tt.wantField)
+			}
+			continue
+		}
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got %d %s", tt.body, w.Code, w.Body)
+		}
+	}
+
+	// Only the last change was applied.
+	a := responseAs[Address](t, serve(h, httptest.NewRequest("GET", path, nil)))
+	if a.City != "London" || a.Country != "GB" || a.PostalCode != "SW1A 1AA" {
+		t.Errorf("got %+v", a)
+	}
+}
+
+func TestSortedPagesDontRepeatOrSkip(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	want := map[int]bool{}
+	for i := range 7 {
+		// Only two distinct names, so most rows tie on the sort key.
+		u := createTestUser(t, h, []string{"Alice", "Bob"}[i%2], fmt.Sprintf("user%d@example.com", i))
+		want[u.ID] = true
+	}
+	for _, sort := range []string{"name", "-name"} {
+		seen := map[int]bool{}
+		for offset := 0; offset < len(want); offset += 2 {
+			w := serve(h, httptest.NewRequest("GET", fmt.Sprintf("/users?sort=%s&limit=2&offset=%d", sort, offset), nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: %d %s", sort, w.Code, w.Body)
+			}
+			for _, u := range responseAs[[]User](t, w) {
+				if seen[u.ID] {
+					t.Errorf("%s: user %d repeated at offset %d", sort, u.ID, offset)
+				}
+				seen[u.ID] = true
+			}
+		}
+		if len(seen) != len(want) {
+			t.Errorf("%s: saw %d users, want %d", sort, len(seen), len(want))
+		}
+	}
+}
+
+func TestCreateIgnoresServerAssignedFields(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	start := time.Now().Add(-time.Minute)
+
+	w := serve(h, jsonRequest("POST", "/users", `{"id":999,"created_at":"2000-01-01T00:00:00Z","name":"Alice","email":"alice@example.com"}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create user: %d %s", w.Code, w.Body)
+	}
+	u := responseAs[User](t, w)
+	if u.ID == 999 || u.CreatedAt.Before(start) {
+		t.Errorf("user has client-supplied id %d or created_at %v", u.ID, u.CreatedAt)
+	}
+
+	body := fmt.Sprintf(`{"id":999,"created_at":"2000-01-01T00:00:00Z","user_id":%d,"street":"1 Main St","city":"Springfield","country":"US"}`, u.ID)
+	w = serve(h, jsonRequest("POST", "/addresses", body))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create address: %d %s", w.Code, w.Body)
+	}
+	if a := responseAs[Address](t, w); a.ID == 999 || a.CreatedAt.Before(start) {
+		t.Errorf("address has client-supplied id %d or created_at %v", a.ID, a.CreatedAt)
+	}
+}
+
+func TestListAddressesByCountries(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	u := createTestUser(t, h, "Alice", "alice@example.com")
+	for _, country := range []string{"US", "CA", "GB", "FR"} {
+		createTestAddress(t, h, u.ID, "1 Main St "+country, "Springfield", country)
+	}
+	w := serve(h, httptest.NewRequest("GET", "/addresses?country=us,GB,CA&sort=-country&limit=2", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	var countries []string
+	for _, a := range responseAs[[]Address](t, w) {
+		countries = append(countries, a.Country)
+	}
+	if !slices.Equal(countries, []string{"US", "GB"}) || w.Header().Get("X-Total-Count") != "3" {
+		t.Errorf("got %v of %s, want [US GB] of 3", countries, w.Header().Get("X-Total-Count"))
+	}
+	if w := serve(h, httptest.NewRequest("GET", "/addresses?country=US,XX", nil)); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid country: %d, want 400", w.Code)
+	}
+}
+
+func TestUpdateValidationStatuses(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	u := createTestUser(t, h, "Alice", "alice@example.com")
+	a := createTestAddress(t, h, u.ID, "1 Main St", "Springfield", "US")
+	tests := []struct {
+		r    *http.Request
+		want int
+	}{
+		{jsonRequest("PATCH", userPath(u.ID), `{"email":"alice"}`), http.StatusUnprocessableEntity},
+		{jsonRequest("PATCH", userPath(u.ID), `{"email":1}`), http.StatusBadRequest},
+		{jsonRequest("PATCH", "/addresses/"+strconv.Itoa(a.ID), `{"country":"XX"}`), http.StatusUnprocessableEntity},
+		{jsonRequest("PATCH", "/addresses/"+strconv.Itoa(a.ID), `{"country":`), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := serve(h, tt.r); w.Code != tt.want {
+			t.Errorf("%s %s: %d %s, want %d", tt.r.Method, tt.r.URL, w.Code, w.Body, tt.want)
+		}
+	}
+}
+
+func TestGetUserByEmail(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	alice := createTestUser(t, h, "Alice", "Alice+Work@Example.com")
+	tests := []struct {
+		email string
+		want  int
+	}{
+		{"alice+work@example.com", http.StatusOK},
+		{"alice%2Bwork@example.com", http.StatusOK},
+		{"ALICE+WORK@EXAMPLE.COM", http.StatusOK},
+		{"%20alice+work@example.com%20", http.StatusOK},
+		// "+" tags are significant.
+		{"alice@example.com", http.StatusNotFound},
+		{"alice+home@example.com", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := serve(h, httptest.NewRequest("GET", "/users/by-email/"+tt.email, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: %d, want %d", tt.email, w.Code, tt.want)
+			continue
+		}
+		if tt.want == http.StatusOK && responseAs[User](t, w).ID != alice.ID {
+			t.Errorf("%s: found another user", tt.email)
+		}
+		if w := serve(h, httptest.NewRequest("HEAD", "/users/by-email/"+tt.email, nil)); w.Code != tt.want {
+			t.Errorf("HEAD %s: %d, want %d", tt.email, w.Code, tt.want)
+		}
+	}
+}
+
+func TestGetUserCoalescesConcurrentMisses(t *testing.T) {
+	const n = 10
+	var queries atomic.Int32
+	release := make(chan struct{})
+	now := time.Now()
+	fakeDB(t, scriptedDriver{func(string) *scriptedRows {
+		queries.Add(1)
+		<-release
+		return &scriptedRows{
+			columns: strings.Split(userColumns, ", "),
+			values:  [][]driver.Value{{int64(1), "Alice", "alice@example.com", true, now, now, "0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d90"}},
+		}
+	}})
+	h := newHandler(newMux())
+	codes := make(chan int, n)
+	for range n {
+		go func() { codes <- serve(h, httptest.NewRequest("GET", userPath(1), nil)).Code }()
+	}
+	// Hold the first query until the other requests have joined it.
+	for queries.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for range n {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("got %d", code)
+		}
+	}
+	if got := queries.Load(); got != 1 {
+		t.Errorf("%d queries for %d concurrent requests, want 1", got, n)
+	}
+}
+
+func TestAddressHistory(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	u := createTestUser(t, h, "Alice", "alice@example.com")
+	a := createTestAddress(t, h, u.ID, "1 Main St", "Springfield", "US")
+	path := "/addresses/" + strconv.Itoa(a.ID)
+	for _, body := range []string{`{"street":"2 Main St"}`, `{"city":"Shelbyville","postal_code":"12345"}`} {
+		if w := serve(h, jsonRequest("PATCH", path, body)); w.Code != http.StatusOK {
+			t.Fatalf("update %s: %d %s", body, w.Code, w.Body)
+		}
+	}
+
+	w := serve(h, httptest.NewRequest("GET", path+"/history", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	var got []string
+	for _, c := range responseAs[[]addressChange](t, w) {
+		got = append(got, fmt.Sprintf("%s %q->%q by %s", c.Field, c.OldValue, c.NewValue, c.Actor))
+	}
+	want := []string{
+		`street "1 Main St"->"2 Main St" by anonymous`,
+		`city "Springfield"->"Shelbyville" by anonymous`,
+		`postal_code ""->"12345" by anonymous`,
+	}
+	// Changes made by one update are in field order.
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	w = serve(h, httptest.NewRequest("GET", path+"/history?limit=1&offset=2", nil))
+	if page := responseAs[[]addressChange](t, w); len(page) != 1 || page[0].Field != "postal_code" || w.Header().Get("X-Total-Count") != "3" {
+		t.Errorf("last page: %+v of %s", page, w.Header().Get("X-Total-Count"))
+	}
+
+	// History outlives the address, but an address that never existed is 404.
+	if w := serve(h, httptest.NewRequest("DELETE", path, nil)); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, httptest.NewRequest("GET", path+"/history", nil)); w.Code != http.StatusOK {
+		t.Errorf("history of a deleted address: %d", w.Code)
+	}
+	if w := serve(h, httptest.NewRequest("GET", "/addresses/999999/history", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("history of a missing address: %d, want 404", w.Code)
+	}
+}
+
+func TestCountAddressesByCountry(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	u := createTestUser(t, h, "Alice", "alice@example.com")
+	for i, country := range []string{"US", "GB", "US", "FR", "US", "GB"} {
+		createTestAddress(t, h, u.ID, fmt.Sprintf("%d Main St", i), "Springfield", country)
+	}
+	// Rows from before countries were required.
+	if _, err := db.Exec(`INSERT INTO addresses (user_id, street, city, country) VALUES ($1, '9 Main St', 'Springfield', '')`, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	counts := func(target string) string {
+		t.Helper()
+		w := serve(h, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", target, w.Code, w.Body)
+		}
+		return strings.TrimSpace(w.Body.String())
+	}
+	if got, want := counts("/addresses/by-country"), `[{"country":"US","count":3},{"country":"GB","count":2},{"country":"FR","count":1}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got, want := counts("/addresses/by-country?limit=1"), `[{"country":"US","count":3}]`; got != want {
+		t.Errorf("top 1: got %s, want %s", got, want)
+	}
+
+	// Counts are cached, so a new address isn't counted straight away.
+	createTestAddress(t, h, u.ID, "10 Main St", "Springfield", "FR")
+	if got, want := counts("/addresses/by-country"), `[{"country":"US","count":3},{"country":"GB","count":2},{"country":"FR","count":1}]`; got != want {
+		t.Errorf("after a create: got %s, want the cached %s", got, want)
+	}
+}
+
+func TestCountAddressesByCountryPercentages(t *testing.T) {
+	testDB(t)
+	testQueryCache(t, false)
+	h := newHandler(newMux())
+	u := createTestUser(t, h, "Alice", "alice@example.com")
+	for i, country := range []string{"US", "GB", "US", "FR", "US", "GB", "DE"} {
+		createTestAddress(t, h, u.ID, fmt.Sprintf("%d Main St", i), "Springfield", country)
+	}
+	// Addresses without a country count towards neither a share nor the
+	// total.
+	if _, err := db.Exec(`INSERT INTO addresses (user_id, street, city, country) VALUES ($1, '9 Main St', 'Springfield', '')`, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	w := serve(h, httptest.NewRequest("GET", "/addresses/by-country?with_pct=true", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	counts := responseAs[[]countryCount](t, w)
+	want := map[string]float64{"US": 42.86, "GB": 28.57, "FR": 14.29, "DE": 14.29}
+	if len(counts) != len(want) {
+		t.Fatalf("got %s", w.Body)
+	}
+	var sum float64
+	for _, c := range counts {
+		if c.Percentage == nil || *c.Percentage != want[c.Country] {
+			t.Errorf("%s: got %v, want %v", c.Country, c.Percentage, want[c.Country])
+			continue
+		}
+		sum += *c.Percentage
+	}
+	if math.Abs(sum-100) > 0.05 {
+		t.Errorf("percentages sum to %v", sum)
+	}
+
+	// Without ?with_pct there are no percentages, and the two aren't cached
+	// as one.
+	w = serve(h, httptest.NewRequest("GET", "/addresses/by-country", nil))
+	if strings.Contains(w.Body.String(), "percentage") {
+		t.Errorf("got %s", w.Body)
+	}
+}
+
+func TestCountUsersByCountry(t *testing.T) {
+	testDB(t)
+	testQueryCache(t, false)
+	h := newHandler(newMux())
+	alice := createTestUser(t, h, "Alice", "alice@example.com")
+	bob := createTestUser(t, h, "Bob", "bob@example.com")
+	carol := createTestUser(t, h, "Carol", "carol@example.com")
+	createTestUser(t, h, "Dave", "dave@example.com")
+	// Alice has two addresses in the US, and one in Great Britain, so counts
+	// once in each.
+	createTestAddress(t, h, alice.ID, "1 Main St", "Springfield", "US")
+	createTestAddress(t, h, alice.ID, "2 Main St", "Springfield", "US")
+	createTestAddress(t, h, alice.ID, "1 High St", "Oxford", "GB")
+	createTestAddress(t, h, bob.ID, "3 Main St", "Springfield", "US")
+	createTestAddress(t, h, carol.ID, "1 Rue de Rivoli", "Paris", "FR")
+	if _, err := db.Exec(`INSERT INTO addresses (user_id, street, city, country) VALUES ($1, '9 Main St', 'Springfield', '')`, carol.ID); err != nil {
+		t.Fatal(err)
+	}
+	counts := func(target string) string {
+		t.Helper()
+		w := serve(h, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", target, w.Code, w.Body)
+		}
+		return strings.TrimSpace(w.Body.String())
+	}
+	if got, want := counts("/stats/users-by-country"), `[{"country":"US","users":2},{"country":"FR","users":1},{"country":"GB","users":1}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got, want := counts("/stats/users-by-country?limit=1"), `[{"country":"US","users":2}]`; got != want {
+		t.Errorf("top 1: got %s, want %s", got, want)
+	}
+}
+
+func TestCheckEmailExists(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	createTestUser(t, h, "Alice", "alice@example.com")
+	bob := createTestUser(t, h, "Bob", "bob@example.com")
+	if w := serve(h, httptest.NewRequest("DELETE", userPath(bob.ID), nil)); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	tests := []struct {
+		email string
+		want  int
+	}{
+		{"alice@example.com", http.StatusOK},
+		{"ALICE@example.com", http.StatusOK},
+		{"carol@example.com", http.StatusNotFound},
+		{"bob@example.com", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		before := testQueries.Load()
+		w := serve(h, httptest.NewRequest("HEAD", "/users/by-email/"+tt.email, nil))
+		if w.Code != tt.want || w.Body.Len() != 0 {
+			t.Errorf("%s: %d %q, want %d and no body", tt.email, w.Code, w.Body, tt.want)
+		}
+		if n := testQueries.Load() - before; n != 1 {
+			t.Errorf("%s: %d queries, want 1", tt.email, n)
+		}
+	}
+}
+
+func TestCheckEmailExistsRateLimit(t *testing.T) {
+	setConfig(t, func(c *config) { c.EmailCheckRateLimit = 2 })
+	useMemoryRepositories(t)
+	h := newHandler(newMux())
+	for i, want := range []int{http.StatusNotFound, http.StatusNotFound, http.StatusTooManyRequests} {
+		w := serve(h, httptest.NewRequest("HEAD", "/users/by-email/carol@example.com", nil))
+		if w.Code != want {
+			t.Errorf("request %d: %d, want %d", i+1, w.Code, want)
+		}
+	}
+	// GET /users/by-email/{email} isn't limited.
+	if w := serve(h, httptest.NewRequest("GET", "/users/by-email/carol@example.com", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("GET: %d, want 404", w.Code)
+	}
+}
+
+func TestCreateUsersBatch(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	w := serve(h, jsonRequest("POST", "/users/batch", `[{"name":"Alice","email":"alice@example.com"},{"name":"Bob","email":"bob@example.com"}]`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	if users := responseAs[[]User](t, w); len(users) != 2 || users[1].ID == 0 {
+		t.Errorf("got %+v", users)
+	}
+	// One taken email fails the whole batch.
+	w = serve(h, jsonRequest("POST", "/users/batch", `[{"name":"Carol","email":"carol@example.com"},{"name":"Alice","email":"alice@example.com"}]`))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("duplicate: %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, httptest.NewRequest("GET", "/users/by-email/carol@example.com", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("carol was created by a failed batch: %d", w.Code)
+	}
+}
+
+func TestCreateUsersBatchOnError(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	createTestUser(t, h, "Alice", "alice@example.com")
+	batch := `[
+		{"name":"Carol","email":"carol@example.com"},
+		{"name":"Alice","email":"ALICE@example.com"},
+		{"name":"Dan","email":"dan@example.com"},
+		{"name":"Dan","email":"dan@example.com"},
+		{"name":"Erin","email":"erin"},
+		{"name":"Frank","email":"frank@example.com"}
+	]`
+	exists := func(email string) bool {
+		return serve(h, httptest.NewRequest("GET", "/users/by-email/"+email, nil)).Code == http.StatusOK
+	}
+
+	// All or nothing, by default.
+	for _, query := range []string{"", "?on_error=abort"} {
+		w := serve(h, jsonRequest("POST", "/users/batch"+query, batch))
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%q: got %d %s, want 422", query, w.Code, w.Body)
+		}
+	}
+	w := serve(h, jsonRequest("POST", "/users/batch", strings.Replace(batch, `"erin"`, `"erin@example.com"`, 1)))
+	if w.Code != http.StatusConflict {
+		t.Errorf("valid but duplicated: got %d %s, want 409", w.Code, w.Body)
+	}
+	if exists("carol@example.com") {
+		t.Error("carol was created by a failed batch")
+	}
+
+	w = serve(h, jsonRequest("POST", "/users/batch?on_error=continue", batch))
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("continue: got %d %s, want 207", w.Code, w.Body)
+	}
+	got := responseAs[partialUsers](t, w)
+	var created []string
+	for _, u := range got.Created {
+		if u.ID == 0 {
+			t.Errorf("%s has no id", u.Email)
+		}
+		created = append(created, u.Email)
+	}
+	if want := []string{"carol@example.com", "dan@example.com", "frank@example.com"}; !slices.Equal(created, want) {
+		t.Errorf("created %v, want %v", created, want)
+	}
+	var failed []string
+	for _, e := range got.Errors {
+		failed = append(failed, fmt.Sprintf("%d:%s", e.Index, e.Code))
+	}
+	if want := []string{"1:email_taken", "3:email_taken", "4:validation_failed"}; !slices.Equal(failed, want) {
+		t.Errorf("errors %v, want %v", failed, want)
+	}
+	if got.Errors[2].Fields["email"] == "" {
+		t.Errorf("no field error: %+v", got.Errors[2])
+	}
+	for _, email := range []string{"carol@example.com", "dan@example.com", "frank@example.com"} {
+		if !exists(email) {
+			t.Errorf("%s wasn't created", email)
+		}
+	}
+}
+
+func TestDuplicateAddresses(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		t.Run(fmt.Sprintf("allow=%v", allow), func(t *testing.T) {
+			setConfig(t, func(c *config) { c.AllowDuplicateAddresses = allow })
+			testDB(t)
+			h := newHandler(newMux())
+			u := createTestUser(t, h, "Alice", "alice@example.com")
+			createTestAddress(t, h, u.ID, "1 Main St", "Springfield", "US")
+			other := createTestAddress(t, h, u.ID, "2 Main St", "Springfield", "US")
+			want, wantCode := http.StatusConflict, "duplicate_address"
+			if allow {
+				want, wantCode = http.StatusOK, ""
+			}
+			check := func(name string, w *httptest.ResponseRecorder) {
+				t.Helper()
+				code := w.Code
+				if code == http.StatusCreated {
+					code = http.StatusOK
+				}
+				if code != want {
+					t.Errorf("%s: %d %s, want %d", name, w.Code, w.Body, want)
+				}
+				if wantCode != "" && w.Code == want {
+					if got := responseAs[errorBody](t, w).Error.Code; got != wantCode {
+						t.Errorf("%s: code %q, want %q", name, got, wantCode)
+					}
+				}
+			}
+
+			body := fmt.Sprintf(`{"user_id":%d,"street":" 1 Main St ","city":"Springfield","country":"us"}`, u.ID)
+			check("create", serve(h, jsonRequest("POST", "/addresses", body)))
+			check("update", serve(h, jsonRequest("PATCH", "/addresses/"+strconv.Itoa(other.ID), `{"street":"1 Main St"}`)))
+			// Updating an address without changing it isn't a duplicate of
+			// itself.
+			if w := serve(h, jsonRequest("PATCH", "/addresses/"+strconv.Itoa(other.ID), `{"city":"Springfield"}`)); w.Code != http.StatusOK {
+				t.Errorf("no-op update: %d %s", w.Code, w.Body)
+			}
+			line := fmt.Sprintf(`{"_type":"address","id":100,"user_id":%d,"street":"1 Main St","city":"Springfield","country":"US"}`, u.ID)
+			check("import", serve(h, adminRequest(t, "POST", "/admin/import", line+"\n")))
+		})
+	}
+}
+
+func TestAddressDedupWindow(t *testing.T) {
+	setConfig(t, func(c *config) {
+		c.AddressDedupWindow = 5 * time.Second
+		c.AllowDuplicateAddresses = true
+	})
+	s := useMemoryRepositories(t)
+	saved := addressDedup
+	t.Cleanup(func() { addressDedup = saved })
+	addressDedup = newLRUCache[string, Address](addressDedupSize, cfg.AddressDedupWindow)
+	h := newHandler(newMux())
+	u := createTestUser(t, h, "Alice", "alice@example.com")
+
+	create := func(remoteAddr, street string) Address {
+		t.Helper()
+		r := jsonRequest("POST", "/addresses", fmt.Sprintf(`{"user_id":%d,"street":%q,"city":"Springfield","country":"US"}`, u.ID, street))
+		r.RemoteAddr = remoteAddr
+		w := serve(h, r)
+		if w.Code != http.StatusCreated {
+			// Called concurrently, so this can't be fatal.
+			t.Errorf("got %d %s", w.Code, w.Body)
+			return Address{}
+		}
+		var a Address
+		json.Unmarshal(w.Body.Bytes(), &a)
+		if loc := w.Header().Get("Location"); loc != "/addresses/"+strconv.Itoa(a.ID) {
+			t.Errorf("Location %q", loc)
+		}
+		return a
+	}
+	first := create("192.0.2.1:1234", "1 Main St")
+	if again := create("192.0.2.1:5678", "1 Main St"); again.ID != first.ID {
+		t.Errorf("repeat created address %d, want %d", again.ID, first.ID)
+	}
+	if other := create("192.0.2.2:1234", "1 Main St"); other.ID == first.ID {
+		t.Error("another client's address was deduplicated")
+	}
+	if other := create("192.0.2.1:1234", "2 Main St"); other.ID == first.ID {
+		t.Error("a different address was deduplicated")
+	}
+
+	// Identical requests at the same time share one insert.
+	ids := make([]int, 10)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Go(func() { ids[i] = create("192.0.2.1:1234", "3 Main St").ID })
+	}
+	wg.Wait()
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Errorf("concurrent creates got ids %v", ids)
+			break
+		}
+	}
+	if len(s.addresses) != 4 {
+		t.Errorf("got %d addresses, want 4", len(s.addresses))
+	}
+
+	// A repeat isn't answered with an address that has since been changed
+	// or deleted.
+	if w := serve(h, jsonRequest("PATCH", "/addresses/"+strconv.Itoa(first.ID), `{"street":"9 Main St"}`)); w.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+	updated := create("192.0.2.1:1234", "1 Main St")
+	if updated.ID == first.ID {
+		t.Error("repeat after an update returned the updated address")
+	}
+	if w := serve(h, httptest.NewRequest("DELETE", "/addresses/"+strconv.Itoa(updated.ID), nil)); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if again := create("192.0.2.1:1234", "1 Main St"); again.ID == updated.ID {
+		t.Error("repeat after a delete returned the deleted address")
+	}
+}
+
+func TestMergeUsersDuplicateAddresses(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		t.Run(fmt.Sprintf("allow=%v", allow), func(t *testing.T) {
+			setConfig(t, func(c *config) { c.AllowDuplicateAddresses = allow })
+			testDB(t)
+			h := newHandler(newMux())
+			alice := createTestUser(t, h, "Alice", "alice@example.com")
+			dup := createTestUser(t, h, "Alice", "alice@example.org")
+			createTestAddress(t, h, alice.ID, "1 Main St", "Springfield", "US")
+			createTestAddress(t, h, dup.ID, "1 Main St", "Springfield", "US")
+			createTestAddress(t, h, dup.ID, "2 Main St", "Springfield", "US")
+			w := serve(h, adminRequest(t, "POST", userPath(alice.ID)+"/merge", fmt.Sprintf(`{"duplicate_id":%d}`, dup.ID)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("merge: %d %s", w.Code, w.Body)
+			}
+			var n int
+			if err := db.QueryRow("SELECT count(*) FROM addresses WHERE user_id = $1", alice.ID).Scan(&n); err != nil {
+				t.Fatal(err)
+			}
+			want := 2
+			if allow {
+				want = 3
+			}
+			if n != want {
+				t.Errorf("alice has %d addresses, want %d", n, want)
+			}
+		})
+	}
+}
+
+func TestCreatePreferMinimal(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	r := jsonRequest("POST", "/users", `{"name":"Alice","email":"alice@example.com"}`)
+	r.Header.Set("Prefer", "return=minimal")
+	w := serve(h, r)
+	if w.Code != http.StatusCreated || w.Header().Get("Preference-Applied") != "return=minimal" {
+		t.Fatalf("create user: %d %q %s", w.Code, w.Header().Get("Preference-Applied"), w.Body)
+	}
+	u := responseAs[map[string]any](t, w)
+	if len(u) != 1 || w.Header().Get("Location") != fmt.Sprintf("/users/%v", u["id"]) {
+		t.Errorf("got %v, Location %q", u, w.Header().Get("Location"))
+	}
+
+	body := fmt.Sprintf(`{"user_id":%v,"street":"1 Main St","city":"Springfield","country":"US"}`, u["id"])
+	r = jsonRequest("POST", "/addresses", body)
+	r.Header.Set("Prefer", "return=minimal")
+	w = serve(h, r)
+	if a := responseAs[map[string]any](t, w); w.Code != http.StatusCreated || len(a) != 1 || a["id"] == nil {
+		t.Errorf("create address: %d %v", w.Code, a)
+	}
+}
+
+func TestEmailReusableAfterDelete(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	alice := createTestUser(t, h, "Alice", "alice@example.com")
+	if w := serve(h, httptest.NewRequest("DELETE", userPath(alice.ID), nil)); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, httptest.NewRequest("GET", userPath(alice.ID), nil)); w.Code != http.StatusNotFound {
+		t.Errorf("deleted user: %d, want 404", w.Code)
+	}
+	again := createTestUser(t, h, "Alice", "Alice@example.com")
+	if again.ID == alice.ID {
+		t.Errorf("the deleted user was reused")
+	}
+	w := serve(h, jsonRequest("POST", "/users", `{"name":"Alice","email":"ALICE@example.com"}`))
+	if w.Code != http.StatusConflict || responseAs[errorBody](t, w).Error.Code != "email_taken" {
+		t.Errorf("second live user: %d %s, want 409 email_taken", w.Code, w.Body)
+	}
+	w = serve(h, jsonRequest("PATCH", userPath(createTestUser(t, h, "Bob", "bob@example.com").ID), `{"email":"alice@example.com"}`))
+	if w.Code != http.StatusConflict {
+		t.Errorf("update to a live user's email: %d %s, want 409", w.Code, w.Body)
+	}
+}
+
+func TestListAuditValidation(t *testing.T) {
+	h := newHandler(newMux())
+	if w := serve(h, jsonRequest("GET", "/audit?actor=alice", "")); w.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: %d", w.Code)
+	}
+	for _, query := range []string{"", "?actor=", "?actor=alice&resource=invoice", "?actor=al%00ice"} {
+		if w := serve(h, adminRequest(t, "GET", "/audit"+query, "")); w.Code != http.StatusBadRequest {
+			t.Errorf("%q: %d %s, want 400", query, w.Code, w.Body)
+		}
+	}
+}
+
+func TestListAudit(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	entries := []struct {
+		actor, action, resource string
+		resourceID              int
+	}{
+		{"alice", "merge", "user", 1},
+		{"bob", "deactivate", "user", 2},
+		{"alice", "update", "address", 3},
+		{"alice", "activate", "user", 4},
+	}
+	for i, e := range entries {
+		created := time.Date(2024, 3, 1, i, 0, 0, 0, time.UTC)
+		if _, err := db.Exec(
+			"INSERT INTO audit_log (actor, action, resource, resource_id, created_at) VALUES ($1, $2, $3, $4, $5)",
+			e.actor, e.action, e.resource, e.resourceID, created,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+		total string
+	}{
+		{"?actor=alice", []string{"activate", "update", "merge"}, "3"},
+		{"?actor=alice&resource=user", []string{"activate", "merge"}, "2"},
+		{"?actor=alice&limit=1&offset=1", []string{"update"}, "3"},
+		{"?actor=bob&resource=address", []string{}, "0"},
+		// Not a pattern.
+		{"?actor=%25", []string{}, "0"},
+	}
+	for _, tt := range tests {
+		w := serve(h, adminRequest(t, "GET", "/audit"+tt.query, ""))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: %d %s", tt.query, w.Code, w.Body)
+		}
+		actions := []string{}
+		for _, e := range responseAs[[]auditEntry](t, w) {
+			actions = append(actions, e.Action)
+		}
+		if !slices.Equal(actions, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.query, actions, tt.want)
+		}
+		if got := w.Header().Get("X-Total-Count"); got != tt.total {
+			t.Errorf("%q: X-Total-Count %q, want %s", tt.query, got, tt.total)
+		}
+	}
+}
+
+func TestStatsLargeCounts(t *testing.T) {
+	const users, addresses = int64(1) << 53, int64(3_000_000_001) // Beyond int32, and exact float64.
+	fakeDB(t, scriptedDriver{func(query string) *scriptedRows {
+		if strings.Contains(query, "GROUP BY country") {
+			return &scriptedRows{columns: []string{"country", "count"}, values: [][]driver.Value{{"US", addresses}}}
+		}
+		return &scriptedRows{columns: []string{"count", "count", "count"}, values: [][]driver.Value{{users + 1, users, addresses}}}
+	}})
+	for _, asStrings := range []bool{false, true} {
+		setConfig(t, func(c *config) { c.CountsAsStrings = asStrings })
+		testQueryCache(t, false)
+		h := newHandler(newMux())
+
+		want := `"users":9007199254740993,"active_users":9007199254740992,"addresses":3000000001`
+		if asStrings {
+			want = `"users":"9007199254740993","active_users":"9007199254740992","addresses":"3000000001"`
+		}
+		w := serve(h, httptest.NewRequest("GET", "/stats", nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("strings=%v: got %d %s, want %s", asStrings, w.Code, w.Body, want)
+		}
+
+		want = `[{"country":"US","count":3000000001}]`
+		if asStrings {
+			want = `[{"country":"US","count":"3000000001"}]`
+		}
+		w = serve(h, httptest.NewRequest("GET", "/addresses/by-country", nil))
+		if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != want {
+			t.Errorf("strings=%v: by country: got %d %s, want %s", asStrings, w.Code, w.Body, want)
+		}
+	}
+}
+
+func TestScanAddressNullColumns(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	lat, lng := 51.5, -0.1
+	const userUUID, addressUUID = "0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d90", "0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d91"
+	fakeDB(t, scriptedDriver{func(string) *scriptedRows {
+		return &scriptedRows{
+			columns: strings.Split(addressColumns, ", "),
+			values: [][]driver.Value{
+				{int64(1), int64(1), "1 Main St", "Springfield", "US", "", nil, nil, now, now, addressUUID, userUUID},
+				{int64(2), int64(1), "10 Downing St", "London", "GB", "SW1A 2AA", lat, lng, now, now, addressUUID, userUUID},
+			},
+		}
+	}})
+	rows, err := db.Query("SELECT " + addressColumns + " FROM addresses")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses, err := scanAll(rows, scanAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := addresses[0]; a.Latitude != nil || a.Longitude != nil {
+		t.Errorf("NULLs: got %+v", a)
+	}
+	if a := addresses[1]; a.Latitude == nil || *a.Latitude != lat || a.Longitude == nil || *a.Longitude != lng {
+		t.Errorf("values: got %+v", a)
+	}
+	data, _ := json.Marshal(addresses[0])
+	if strings.Contains(string(data), "latitude") || strings.Contains(string(data), "longitude") {
+		t.Errorf("NULL columns not omitted: %s", data)
+	}
+}
+
+func TestAddressCoordinatesRoundTrip(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	alice := createTestUser(t, h, "Alice", "alice@example.com")
+	a := createTestAddress(t, h, alice.ID, "1 Main St", "Springfield", "US")
+	path := "/addresses/" + strconv.Itoa(a.ID)
+	w := serve(h, httptest.NewRequest("GET", path, nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "latitude") {
+		t.Errorf("without coordinates: got %d %s", w.Code, w.Body)
+	}
+
+	w = serve(h, jsonRequest("PATCH", path, `{"latitude":39.8,"longitude":-89.6}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("set coordinates: %d %s", w.Code, w.Body)
+	}
+	got := responseAs[Address](t, serve(h, httptest.NewRequest("GET", path, nil)))
+	if got.Latitude == nil || *got.Latitude != 39.8 || got.Longitude == nil || *got.Longitude != -89.6 {
+		t.Errorf("with coordinates: got %+v", got)
+	}
+
+	// Rows written outside the API, with every nullable column NULL.
+	if _, err := db.Exec("UPDATE addresses SET latitude = NULL, longitude = NULL WHERE id = $1", a.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{path, "/addresses", userPath(alice.ID) + "/addresses"} {
+		if w := serve(h, httptest.NewRequest("GET", target, nil)); w.Code != http.StatusOK {
+			t.Errorf("%s: got %d %s", target, w.Code, w.Body)
+		}
+	}
+}
+
+func TestGetUserInTimeZone(t *testing.T) {
+	// Either side of the start and end of daylight saving time in New York
+	// and London.
+	tests := []struct {
+		created time.Time
+		tz      string
+		want    string
+	}{
+		{time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), "", "2024-03-01T12:00:00Z"},
+		{time.Date(2024, 3, 10, 6, 59, 0, 0, time.UTC), "America/New_York", "2024-03-10T01:59:00-05:00"},
+		{time.Date(2024, 3, 10, 7, 0, 0, 0, time.UTC), "America/New_York", "2024-03-10T03:00:00-04:00"},
+		{time.Date(2024, 11, 3, 5, 59, 0, 0, time.UTC), "America/New_York", "2024-11-03T01:59:00-04:00"},
+		{time.Date(2024, 11, 3, 6, 0, 0, 0, time.UTC), "America/New_York", "2024-11-03T01:00:00-05:00"},
+		{time.Date(2024, 10, 27, 0, 59, 0, 0, time.UTC), "Europe/London", "2024-10-27T01:59:00+01:00"},
+		{time.Date(2024, 10, 27, 1, 0, 0, 0, time.UTC), "Europe/London", "2024-10-27T01:00:00Z"},
+	}
+	for _, tt := range tests {
+		fakeDB(t, scriptedDriver{func(string) *scriptedRows {
+			return &scriptedRows{
+				columns: strings.Split(userColumns, ", "),
+				values:  [][]driver.Value{{int64(1), "Alice", "alice@example.com", true, tt.created, tt.created, "0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d90"}},
+			}
+		}})
+		h := newHandler(newMux())
+		w := serve(h, httptest.NewRequest("GET", userPath(1)+"?tz="+tt.tz, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: %d %s", tt.created, tt.tz, w.Code, w.Body)
+		}
+		got := responseAs[struct {
+			CreatedAt string `json:"created_at"`
+			UpdatedAt string `json:"updated_at"`
+		}](t, w)
+		if got.CreatedAt != tt.want || got.UpdatedAt != tt.want {
+			t.Errorf("%s in %q: got %s and %s, want %s", tt.created, tt.tz, got.CreatedAt, got.UpdatedAt, tt.want)
+		}
+	}
+
+	h := newHandler(newMux())
+	if w := serve(h, httptest.NewRequest("GET", userPath(1)+"?tz=Nowhere/Special", nil)); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid tz: got %d %s, want 400", w.Code, w.Body)
+	}
+}
+
+func TestCheckAddressOrder(t *testing.T) {
+	tests := []struct {
+		order []int
+		ok    bool
+	}{
+		{[]int{3, 1, 2}, true},
+		{[]int{1, 2, 3}, true},
+		{[]int{3, 1}, false},
+		{[]int{3, 1, 2, 2}, false},
+		{[]int{3, 1, 1}, false},
+		{[]int{3, 1, 2, 4}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		err := checkAddressOrder(tt.order, []int{1, 2, 3})
+		if tt.ok && err != nil {
+			t.Errorf("%v: %v", tt.order, err)
+		}
+		if e, ok := err.(*apiError); !tt.ok && (!ok || e.Status != http.StatusBadRequest || e.Code != "invalid_order") {
+			t.Errorf("%v: got %v, want invalid_order", tt.order, err)
+		}
+	}
+}
+
+func TestReorderUserAddresses(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	alice := createTestUser(t, h, "Alice", "alice@example.com")
+	bob := createTestUser(t, h, "Bob", "bob@example.com")
+	home := createTestAddress(t, h, alice.ID, "1 Main St", "Springfield", "US")
+	work := createTestAddress(t, h, alice.ID, "2 Main St", "Springfield", "US")
+	other := createTestAddress(t, h, alice.ID, "3 Main St", "Springfield", "US")
+	bobs := createTestAddress(t, h, bob.ID, "4 Main St", "Springfield", "US")
+
+	streets := func(w *httptest.ResponseRecorder) []string {
+		t.Helper()
+		streets := []string{}
+		for _, a := range responseAs[[]Address](t, w) {
+			streets = append(streets, a.Street)
+		}
+		return streets
+	}
+	list := func() []string {
+		return streets(serve(h, httptest.NewRequest("GET", userPath(alice.ID)+"/addresses", nil)))
+	}
+	if got, want := list(), []string{"1 Main St", "2 Main St", "3 Main St"}; !slices.Equal(got, want) {
+		t.Errorf("initially: got %v, want %v", got, want)
+	}
+
+	orderPath := userPath(alice.ID) + "/addresses/order"
+	body := fmt.Sprintf("[%d,%d,%d]", other.ID, home.ID, work.ID)
+	w := serve(h, jsonRequest("PUT", orderPath, body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("reorder: %d %s", w.Code, w.Body)
+	}
+	want := []string{"3 Main St", "1 Main St", "2 Main St"}
+	if got := streets(w); !slices.Equal(got, want) {
+		t.Errorf("response: got %v, want %v", got, want)
+	}
+	if got := list(); !slices.Equal(got, want) {
+		t.Errorf("after reordering: got %v, want %v", got, want)
+	}
+
+	for _, body := range []string{
+		fmt.Sprintf("[%d,%d]", other.ID, home.ID),
+		fmt.Sprintf("[%d,%d,%d,%d]", other.ID, home.ID, work.ID, work.ID),
+		fmt.Sprintf("[%d,%d,%d,%d]", other.ID, home.ID, work.ID, bobs.ID),
+	} {
+		if w := serve(h, jsonRequest("PUT", orderPath, body)); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d %s, want 400", body, w.Code, w.Body)
+		}
+	}
+	if got := list(); !slices.Equal(got, want) {
+		t.Errorf("after rejected orders: got %v, want %v", got, want)
+	}
+
+	// New addresses go last.
+	createTestAddress(t, h, alice.ID, "5 Main St", "Springfield", "US")
+	if got, want := list(), append(want, "5 Main St"); !slices.Equal(got, want) {
+		t.Errorf("after adding one: got %v, want %v", got, want)
+	}
+}
+
+func TestEmptyListsAreArrays(t *testing.T) {
+	testQueryCache(t, false)
+	// Every table is empty.
+	fakeDB(t, scriptedDriver{func(query string) *scriptedRows {
+		if strings.HasPrefix(query, "SELECT count(") {
+			return &scriptedRows{columns: []string{"count"}, values: [][]driver.Value{{int64(0)}}}
+		}
+		return &scriptedRows{columns: []string{"id"}}
+	}})
+	targets := []string{
+		"/users", "/users?after_id=0", "/addresses", "/addresses/by-country", "/stats/users-by-country",
+		"/admin/slow-queries", "/audit?actor=alice",
+	}
+	check := func(h http.Handler) {
+		t.Helper()
+		for _, target := range targets {
+			w := serve(h, adminRequest(t, "GET", target, ""))
+			if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+				t.Errorf("%s: got %d %s, want []", target, w.Code, w.Body)
+			}
+		}
+	}
+	check(newHandler(newMux()))
+
+	useMemoryRepositories(t)
+	targets = []string{"/users", "/users?after_id=0", "/addresses"}
+	check(newHandler(newMux()))
+}
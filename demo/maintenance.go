@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maintenanceWindow is a period during which the service is read-only.
+type maintenanceWindow struct {
+	start, end time.Time
+}
+
+func (w maintenanceWindow) String() string {
+	return w.start.Format(time.RFC3339) + "/" + w.end.Format(time.RFC3339)
+}
+
+// envWindows reads a comma-separated list of maintenance windows, each a
+// pair of RFC 3339 timestamps separated by "/", such as
+// "2026-01-10T02:00:00Z/2026-01-10T04:00:00Z".
+func envWindows(name string) ([]maintenanceWindow, error) {
+	var windows []maintenanceWindow
+	for _, item := range envList(name, nil) {
+		start, end, ok := strings.Cut(item, "/")
+		if !ok {
+			return nil, fmt.Errorf("%s: expected start/end, got %q", name, item)
+		}
+		var w maintenanceWindow
+		var err error
+		if w.start, err = time.Parse(time.RFC3339, start); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if w.end, err = time.Parse(time.RFC3339, end); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if !w.end.After(w.start) {
+			return nil, fmt.Errorf("%s: window %q ends before it starts", name, item)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// maintenanceSchedule tracks whether the current time is within one of a set
+// of maintenance windows, logging each time that changes.
+type maintenanceSchedule struct {
+	windows []maintenanceWindow
+	// now is time.Now, replaceable for testing.
+	now    func() time.Time
+	active atomic.Bool
+}
+
+func newMaintenanceSchedule(windows []maintenanceWindow) *maintenanceSchedule {
+	return &maintenanceSchedule{windows: windows, now: time.Now}
+}
+
+// remaining returns how long is left of the maintenance window in progress,
+// rounded up to a whole second, if any. Overlapping windows are treated as
+// one, ending with the latest.
+func (s *maintenanceSchedule) remaining() (time.Duration, bool) {
+	now := s.now()
+	var end time.Time
+	for _, w := range s.windows {
+		if !now.Before(w.start) && now.Before(w.end) && w.end.After(end) {
+			end = w.end
+		}
+	}
+	// Extend through any windows that start before this one ends.
+	for extended := !end.IsZero(); extended; {
+		extended = false
+		for _, w := range s.windows {
+			if !w.start.After(end) && w.end.After(end) {
+				end, extended = w.end, true
+			}
+		}
+	}
+	active := !end.IsZero()
+	if s.active.Swap(active) != active {
+		if active {
+			log.Printf("Maintenance window started: read-only until %s", end.Format(time.RFC3339))
+		} else {
+			log.Println("Maintenance window ended: accepting writes")
+		}
+	}
+	if !active {
+		return 0, false
+	}
+	return (end.Sub(now) + time.Second - 1).Truncate(time.Second), true
+}
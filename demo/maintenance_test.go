@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestEnvWindows(t *testing.T) {
+	t.Setenv("MAINTENANCE_WINDOWS", "2026-01-10T02:00:00Z/2026-01-10T04:00:00Z, 2026-02-01T00:00:00+01:00/2026-02-01T01:00:00+01:00")
+	windows, err := envWindows("MAINTENANCE_WINDOWS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []maintenanceWindow{
+		{time.Date(2026, 1, 10, 2, 0, 0, 0, time.UTC), time.Date(2026, 1, 10, 4, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 1, 31, 23, 0, 0, 0, time.UTC), time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	if len(windows) != len(want) {
+		t.Fatalf("got %v", windows)
+	}
+	for i := range want {
+		if !windows[i].start.Equal(want[i].start) || !windows[i].end.Equal(want[i].end) {
+			t.Errorf("%d: got %v, want %v", i, windows[i], want[i])
+		}
+	}
+	for _, v := range []string{
+		"2026-01-10T02:00:00Z",
+		"2026-01-10T02:00:00Z/tomorrow",
+		"2026-01-10T04:00:00Z/2026-01-10T02:00:00Z",
+		"2026-01-10T02:00:00Z/2026-01-10T02:00:00Z",
+	} {
+		t.Setenv("MAINTENANCE_WINDOWS", v)
+		if _, err := envWindows("MAINTENANCE_WINDOWS"); err == nil {
+			t.Errorf("%q: expected an error", v)
+		}
+	}
+}
+
+func TestMaintenanceSchedule(t *testing.T) {
+	at := func(hour, minute int) time.Time { return time.Date(2026, 1, 10, hour, minute, 0, 0, time.UTC) }
+	s := newMaintenanceSchedule([]maintenanceWindow{
+		{at(2, 0), at(4, 0)},
+		// Overlaps the first, extending it.
+		{at(3, 30), at(5, 0)},
+		{at(8, 0), at(9, 0)},
+	})
+	var now time.Time
+	s.now = func() time.Time { return now }
+
+	tests := []struct {
+		now    time.Time
+		active bool
+		left   time.Duration
+	}{
+		{at(1, 59), false, 0},
+		{at(2, 0), true, 3 * time.Hour},
+		{at(3, 0), true, 2 * time.Hour},
+		{at(4, 30), true, 30 * time.Minute},
+		{at(4, 59).Add(59*time.Second + time.Millisecond), true, time.Second},
+		{at(5, 0), false, 0},
+		{at(8, 15), true, 45 * time.Minute},
+		{at(9, 0), false, 0},
+	}
+	for _, tt := range tests {
+		now = tt.now
+		left, active := s.remaining()
+		if active != tt.active || left != tt.left {
+			t.Errorf("at %s: got %v, %v; want %v, %v", now.Format(time.TimeOnly), left, active, tt.left, tt.active)
+		}
+		if s.active.Load() != tt.active {
+			t.Errorf("at %s: transition not recorded", now.Format(time.TimeOnly))
+		}
+	}
+}
+
+func TestReadOnlyDuringMaintenanceWindow(t *testing.T) {
+	now := time.Now()
+	setConfig(t, func(c *config) {
+		c.ReadOnly = false
+		c.MaintenanceWindows = []maintenanceWindow{{now.Add(-time.Hour), now.Add(time.Hour)}}
+	})
+	handler := withReadOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := serve(handler, httptest.NewRequest("POST", "/users", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d, want 503", w.Code)
+	}
+	// The window's end, give or take the time the test has taken.
+	if retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After")); retryAfter < 3590 || retryAfter > 3600 {
+		t.Errorf("Retry-After %q, want the time left in the window", w.Header().Get("Retry-After"))
+	}
+	if w := serve(handler, httptest.NewRequest("GET", "/users", nil)); w.Code != http.StatusOK {
+		t.Errorf("GET: got %d", w.Code)
+	}
+
+	setConfig(t, func(c *config) {
+		c.MaintenanceWindows = []maintenanceWindow{{now.Add(time.Hour), now.Add(2 * time.Hour)}}
+	})
+	handler = withReadOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if w := serve(handler, httptest.NewRequest("POST", "/users", nil)); w.Code != http.StatusOK {
+		t.Errorf("before the window: got %d", w.Code)
+	}
+}
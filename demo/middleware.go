@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"expvar"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type contextKey int
+
+const (
+	routeKey contextKey = iota
+	requestIDKey
+	actorKey
+	timingKey
+	warningsKey
+)
+
+var (
+	requestsTotal    = expvar.NewMap("http_requests_total")
+	requestDuration  = expvar.NewMap("http_request_duration_seconds")
+	requestsInflight = expvar.NewInt("http_requests_inflight")
+)
+
+// withRoute resolves the route pattern that mux will dispatch r to, such as
+// "GET /users/{id}", and makes it available to later middleware via
+// routePattern.
+func withRoute(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey, pattern)))
+	})
+}
+
+// routePattern returns the matched route pattern, or "" if no route matched.
+//
+// Use this rather than the request path for metric labels and log fields, to
+// keep their cardinality bounded.
+func routePattern(r *http.Request) string {
+	pattern, _ := r.Context().Value(routeKey).(string)
+	return pattern
+}
+
+var errMethodNotAllowed = newError(http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+
+// withMuxErrors replaces the plain text 404 and 405 responses that the mux
+// sends for requests that match no route with our JSON errors. The mux's
+// Allow header, listing the methods registered for the path, is kept.
+func withMuxErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if routePattern(r) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&muxErrorWriter{ResponseWriter: w, r: r}, r)
+	})
+}
+
+// muxErrorWriter writes an error in place of a 404 or 405 response.
+type muxErrorWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	replaced bool
+}
+
+func (m *muxErrorWriter) WriteHeader(status int) {
+	switch status {
+	case http.StatusNotFound:
+		m.replaced = true
+		writeError(m.ResponseWriter, m.r, errNotFound)
+	case http.StatusMethodNotAllowed:
+		m.replaced = true
+		writeError(m.ResponseWriter, m.r, errMethodNotAllowed)
+	default:
+		m.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (m *muxErrorWriter) Write(b []byte) (int, error) {
+	if m.replaced {
+		return len(b), nil
+	}
+	return m.ResponseWriter.Write(b)
+}
+
+func (m *muxErrorWriter) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}
+
+// Values of cfg.TrailingSlash.
+const (
+	trailingSlashStrip    = "strip"
+	trailingSlashRedirect = "redirect"
+)
+
+// withTrailingSlash makes paths with a trailing slash, such as "/users/", reach
+// the same route as those without, either by stripping the slash or by
+// redirecting to the path without it, according to cfg.TrailingSlash.
+//
+// This must run before withRoute, so that the route is resolved from the
+// canonical path.
+func withTrailingSlash(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if path == "/" || !strings.HasSuffix(path, "/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u := *r.URL
+		u.Path = strings.TrimRight(path, "/")
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		u.RawPath = ""
+		if cfg.TrailingSlash == trailingSlashRedirect {
+			http.Redirect(w, r, u.RequestURI(), http.StatusPermanentRedirect)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL = &u
+		next.ServeHTTP(w, r2)
+	})
+}
+
+var errTooManyParams = newError(http.StatusBadRequest, "too_many_params", "the query string has too many parameters")
+
+// withQueryLimit rejects requests with more than cfg.MaxQueryParams query
+// parameters before anything parses them. Repeated parameters each count.
+func withQueryLimit(next http.Handler) http.Handler {
+	if cfg.MaxQueryParams <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if q := r.URL.RawQuery; q != "" && strings.Count(q, "&")+1 > cfg.MaxQueryParams {
+			writeError(w, r, errTooManyParams)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withCanonicalHost redirects requests for any host other than
+// cfg.CanonicalHost to the same path and query there, with 308 Permanent
+// Redirect. Health probes are exempt, as they are usually made to an
+// instance's own address.
+func withCanonicalHost(next http.Handler) http.Handler {
+	if cfg.CanonicalHost == "" {
+		return next
+	}
+	exempt := map[string]bool{
+		route("GET /health"): true,
+		route("GET /readyz"): true,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Host, cfg.CanonicalHost) || exempt[routePattern(r)] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.Redirect(w, r, requestScheme(r)+"://"+cfg.CanonicalHost+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// requestScheme returns the scheme the client used to make r, "http" or
+// "https". As with clientIP, X-Forwarded-Proto is only believed from
+// cfg.TrustedProxies.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if peer, err := netip.ParseAddrPort(r.RemoteAddr); err == nil && trustedProxy(peer.Addr().Unmap()) {
+		if proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto == "https" || proto == "http" {
+			return proto
+		}
+	}
+	return "http"
+}
+
+// withRequestID propagates the caller's X-Request-ID, or generates one.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			var b [8]byte
+			rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// clientIP returns the IP address of the client that made r. Forwarding
+// headers are only believed when the direct peer is one of
+// cfg.TrustedProxies, as anyone else could set them to anything.
+//
+// X-Forwarded-For is read from the right, skipping trusted proxies, so that
+// entries prepended by the client are ignored.
+func clientIP(r *http.Request) string {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	addr := peer.Addr().Unmap()
+	if !trustedProxy(addr) {
+		return addr.String()
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			addr = hop.Unmap()
+			if !trustedProxy(addr) {
+				break
+			}
+		}
+		return addr.String()
+	}
+	if ip, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return ip.Unmap().String()
+	}
+	return addr.String()
+}
+
+func trustedProxy(addr netip.Addr) bool {
+	for _, prefix := range cfg.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// withAccessLog logs each request and records it in the request metrics.
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		elapsed := time.Since(start)
+
+		route := routePattern(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		requestsTotal.Add(route+" "+strconv.Itoa(rec.status), 1)
+		requestDuration.AddFloat(route, elapsed.Seconds())
+		log.Printf("%s %s %d %s route=%q request_id=%s client=%s", r.Method, r.URL.RequestURI(), rec.status, elapsed, route, requestID(r), clientIP(r))
+	})
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// serverTiming accumulates time spent in each phase of a request.
+type serverTiming struct {
+	start time.Time
+	// db is the total duration of the request's queries, recorded by
+	// queryTracer.
+	db atomic.Int64
+}
+
+func (t *serverTiming) header() string {
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+	}
+	return "db;dur=" + ms(time.Duration(t.db.Load())) + ", total;dur=" + ms(time.Since(t.start))
+}
+
+// withServerTiming adds a Server-Timing header breaking down where the time to
+// respond was spent, when cfg.ServerTiming is set.
+func withServerTiming(next http.Handler) http.Handler {
+	if !cfg.ServerTiming {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := &serverTiming{start: time.Now()}
+		tw := &timingWriter{ResponseWriter: w, timing: t}
+		next.ServeHTTP(tw, r.WithContext(context.WithValue(r.Context(), timingKey, t)))
+	})
+}
+
+// timingWriter sets the Server-Timing header just before the response header
+// is sent.
+type timingWriter struct {
+	http.ResponseWriter
+	timing      *serverTiming
+	wroteHeader bool
+}
+
+func (t *timingWriter) WriteHeader(status int) {
+	if !t.wroteHeader {
+		t.wroteHeader = true
+		t.Header().Set("Server-Timing", t.timing.header())
+	}
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *timingWriter) Write(b []byte) (int, error) {
+	if !t.wroteHeader {
+		t.WriteHeader(http.StatusOK)
+	}
+	return t.ResponseWriter.Write(b)
+}
+
+func (t *timingWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// overloadedRetryAfter is the Retry-After sent when shedding load.
+const overloadedRetryAfter = time.Second
+
+var errOverloaded = newError(http.StatusServiceUnavailable, "overloaded", "too many requests in flight")
+
+// withInflightLimit responds 503 to requests beyond the cfg.MaxInflight being
+// handled at once, rather than queueing them. Health probes are exempt so
+// that an overloaded instance isn't restarted, as are event streams, which
+// are long-lived but don't use the database.
+func withInflightLimit(next http.Handler) http.Handler {
+	if cfg.MaxInflight <= 0 {
+		return next
+	}
+	sem := make(chan struct{}, cfg.MaxInflight)
+	exempt := map[string]bool{
+		route("GET /health"): true,
+		route("GET /readyz"): true,
+		route("GET /events"): true,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if exempt[routePattern(r)] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case sem <- struct{}{}:
+		default:
+			w.Header().Set("Retry-After", strconv.Itoa(int(overloadedRetryAfter.Seconds())))
+			writeError(w, r, errOverloaded)
+			return
+		}
+		requestsInflight.Add(1)
+		defer func() {
+			requestsInflight.Add(-1)
+			<-sem
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readOnlyRetryAfter is the Retry-After sent while in read-only mode.
+const readOnlyRetryAfter = time.Minute
+
+var errReadOnly = newError(http.StatusServiceUnavailable, "read_only", "the service is in read-only mode")
+
+// withReadOnly rejects every write request with 503 when cfg.ReadOnly is set,
+// or during one of cfg.MaintenanceWindows, when Retry-After is the time left
+// in the window. Writes are identified by method, so new write routes are
+// covered automatically. Routes that only read, but take their input in a
+// POST body, must be listed in reads.
+func withReadOnly(next http.Handler) http.Handler {
+	if !cfg.ReadOnly && len(cfg.MaintenanceWindows) == 0 {
+		return next
+	}
+	schedule := newMaintenanceSchedule(cfg.MaintenanceWindows)
+	reads := map[string]bool{
+		route("POST /users/exists"):          true,
+		route("POST /users/batch-get"):       true,
+		route("POST /users/validate-emails"): true,
+		route("POST /addresses/validate"):    true,
+		route("POST /addresses/geocode"):     true,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reads[routePattern(r)] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		readOnly, retryAfter := cfg.ReadOnly, readOnlyRetryAfter
+		if !readOnly {
+			// Checked on every request so that transitions are logged
+			// promptly.
+			retryAfter, readOnly = schedule.remaining()
+		}
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+			if readOnly {
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+				writeError(w, r, errReadOnly)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
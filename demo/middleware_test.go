@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestReadOnlyServesReadRoutes(t *testing.T) {
+	setConfig(t, func(c *config) { c.ReadOnly = true })
+	mux := http.NewServeMux()
+	for _, pattern := range []string{
+		"GET /users", "POST /users", "PATCH /users/{id}",
+		"POST /users/exists", "POST /users/batch-get", "POST /addresses/validate",
+	} {
+		mux.HandleFunc(route(pattern), func(w http.ResponseWriter, r *http.Request) {})
+	}
+	handler := withRoute(mux, withReadOnly(mux))
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", "/users", http.StatusOK},
+		{"POST", "/users", http.StatusServiceUnavailable},
+		{"PATCH", "/users/1", http.StatusServiceUnavailable},
+		{"POST", "/users/exists", http.StatusOK},
+		{"POST", "/users/batch-get", http.StatusOK},
+		{"POST", "/addresses/validate", http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s %s: got %d, want %d", tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+}
+
+func TestReadOnlyRejectsWrites(t *testing.T) {
+	setConfig(t, func(c *config) { c.ReadOnly = true })
+	handler := withReadOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, method := range []string{"POST", "PUT", "PATCH", "DELETE"} {
+		w := serve(handler, httptest.NewRequest(method, "/users/1", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: status %d", method, w.Code)
+		}
+		if got := w.Header().Get("Retry-After"); got != "60" {
+			t.Errorf("%s: Retry-After %q", method, got)
+		}
+		if code := responseAs[errorBody](t, w).Error.Code; code != "read_only" {
+			t.Errorf("%s: code %q", method, code)
+		}
+	}
+	for _, method := range []string{"GET", "HEAD", "OPTIONS"} {
+		if w := serve(handler, httptest.NewRequest(method, "/users/1", nil)); w.Code != http.StatusOK {
+			t.Errorf("%s: status %d", method, w.Code)
+		}
+	}
+}
+
+func TestReadOnlyDisabled(t *testing.T) {
+	setConfig(t, func(c *config) { c.ReadOnly = false; c.MaintenanceWindows = nil })
+	handler := withReadOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if w := serve(handler, httptest.NewRequest("POST", "/users", nil)); w.Code != http.StatusOK {
+		t.Errorf("status %d", w.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name, remote, xff, realIP string
+		trusted                   []string
+		want                      string
+	}{
+		{"direct", "203.0.113.7:1234", "", "", nil, "203.0.113.7"},
+		{"untrusted peer can't spoof", "203.0.113.7:1234", "198.51.100.1", "198.51.100.2", nil, "203.0.113.7"},
+		{"untrusted peer not in list", "203.0.113.7:1234", "198.51.100.1", "", []string{"10.0.0.0/8"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.1:1234", "198.51.100.1", "", []string{"10.0.0.0/8"}, "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.1:1234", "198.51.100.1, 10.0.0.2", "", []string{"10.0.0.0/8"}, "198.51.100.1"},
+		{"client-prepended entries ignored", "10.0.0.1:1234", "192.0.2.99, 198.51.100.1", "", []string{"10.0.0.0/8"}, "198.51.100.1"},
+		{"X-Real-IP", "10.0.0.1:1234", "", "198.51.100.3", []string{"10.0.0.0/8"}, "198.51.100.3"},
+		{"IPv4-mapped IPv6", "[::ffff:10.0.0.1]:1234", "198.51.100.1", "", []string{"10.0.0.0/8"}, "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		var prefixes []netip.Prefix
+		for _, p := range tt.trusted {
+			prefixes = append(prefixes, netip.MustParsePrefix(p))
+		}
+		setConfig(t, func(c *config) { c.TrustedProxies = prefixes })
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitByForwardedClient(t *testing.T) {
+	setConfig(t, func(c *config) { c.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")} })
+	h := rateLimit(newRateLimiter(1, time.Minute), func(w http.ResponseWriter, r *http.Request) {})
+	request := func(xff string) int {
+		r := httptest.NewRequest("HEAD", "/users/by-email/a@example.com", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", xff)
+		return serve(h, r).Code
+	}
+	// Clients behind the same proxy have their own limits.
+	if a, b := request("198.51.100.1"), request("198.51.100.2"); a != http.StatusOK || b != http.StatusOK {
+		t.Errorf("first requests: %d, %d", a, b)
+	}
+	if code := request("198.51.100.1"); code != http.StatusTooManyRequests {
+		t.Errorf("second request: %d, want 429", code)
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	query := func(w http.ResponseWriter, r *http.Request) {
+		ctx := queryTracer{}.TraceQueryStart(r.Context(), nil, pgx.TraceQueryStartData{SQL: "SELECT 1"})
+		time.Sleep(20 * time.Millisecond)
+		queryTracer{}.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{})
+		w.Write([]byte("ok"))
+	}
+	setConfig(t, func(c *config) { c.ServerTiming = false })
+	if got := serve(withServerTiming(http.HandlerFunc(query)), httptest.NewRequest("GET", "/", nil)).Header().Get("Server-Timing"); got != "" {
+		t.Errorf("disabled: got %q", got)
+	}
+
+	setConfig(t, func(c *config) { c.ServerTiming = true })
+	got := serve(withServerTiming(http.HandlerFunc(query)), httptest.NewRequest("GET", "/", nil)).Header().Get("Server-Timing")
+	var db, total float64
+	if _, err := fmt.Sscanf(got, "db;dur=%g, total;dur=%g", &db, &total); err != nil {
+		t.Fatalf("%q: %v", got, err)
+	}
+	if db < 20 || total < db {
+		t.Errorf("got %q, want db at least 20ms and total at least db", got)
+	}
+}
+
+func TestInflightLimitSheds(t *testing.T) {
+	setConfig(t, func(c *config) { c.MaxInflight = 2 })
+	entered, release := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc(route("GET /users"), func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	})
+	mux.HandleFunc(route("GET /health"), func(w http.ResponseWriter, r *http.Request) {})
+	handler := withRoute(mux, withInflightLimit(mux))
+
+	before := requestsInflight.Value()
+	done := make(chan int, 2)
+	for range 2 {
+		go func() { done <- serve(handler, httptest.NewRequest("GET", "/users", nil)).Code }()
+		<-entered
+	}
+	if n := requestsInflight.Value() - before; n != 2 {
+		t.Errorf("http_requests_inflight rose by %d, want 2", n)
+	}
+	w := serve(handler, httptest.NewRequest("GET", "/users", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("over the limit: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := serve(handler, httptest.NewRequest("GET", "/health", nil)); w.Code != http.StatusOK {
+		t.Errorf("health probe: %d", w.Code)
+	}
+
+	close(release)
+	for range 2 {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("admitted request: %d", code)
+		}
+	}
+	go func() { <-entered }()
+	if w := serve(handler, httptest.NewRequest("GET", "/users", nil)); w.Code != http.StatusOK {
+		t.Errorf("after the load passed: %d", w.Code)
+	}
+}
+
+func TestTrailingSlash(t *testing.T) {
+	mux := testMux(t)
+	// The route each request resolves to, without running its handler.
+	h := withTrailingSlash(withRoute(mux, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, routePattern(r)+" "+r.URL.RequestURI())
+	})))
+	for _, pattern := range testRoutes {
+		method, _, _ := strings.Cut(pattern, " ")
+		path := samplePath(pattern)
+		want := pattern + " " + path + "?x=1"
+		for _, target := range []string{path + "?x=1", path + "/?x=1", path + "//?x=1"} {
+			setConfig(t, func(c *config) { c.TrailingSlash = trailingSlashStrip })
+			if w := serve(h, httptest.NewRequest(method, target, nil)); w.Body.String() != want {
+				t.Errorf("strip: %s %s: got %q, want %q", method, target, w.Body, want)
+			}
+			setConfig(t, func(c *config) { c.TrailingSlash = trailingSlashRedirect })
+			w := serve(h, httptest.NewRequest(method, target, nil))
+			if target == path+"?x=1" {
+				if w.Body.String() != want {
+					t.Errorf("redirect: %s %s: got %q, want %q", method, target, w.Body, want)
+				}
+				continue
+			}
+			if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != path+"?x=1" {
+				t.Errorf("redirect: %s %s: got %d to %q", method, target, w.Code, w.Header().Get("Location"))
+			}
+		}
+	}
+}
+
+func TestMuxErrors(t *testing.T) {
+	h := newHandler(newMux())
+	tests := []struct {
+		method, path string
+		status       int
+		allow        string
+	}{
+		{"POST", "/users/1", http.StatusMethodNotAllowed, "DELETE, GET, HEAD, PATCH"},
+		{"PUT", "/health", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{"DELETE", "/users", http.StatusMethodNotAllowed, "GET, HEAD, POST"},
+		{"POST", "/users/1/addresses/order", http.StatusMethodNotAllowed, "PUT"},
+		{"GET", "/widgets", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		w := serve(h, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.status || w.Header().Get("Allow") != tt.allow {
+			t.Errorf("%s %s: got %d with Allow %q, want %d with %q", tt.method, tt.path, w.Code, w.Header().Get("Allow"), tt.status, tt.allow)
+		}
+		want := "method_not_allowed"
+		if tt.status == http.StatusNotFound {
+			want = "not_found"
+		}
+		if code := responseAs[errorBody](t, w).Error.Code; code != want {
+			t.Errorf("%s %s: got code %q, want %q", tt.method, tt.path, code, want)
+		}
+	}
+}
+
+func TestCanonicalHost(t *testing.T) {
+	setConfig(t, func(c *config) {
+		c.CanonicalHost = "api.example.com"
+		c.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	})
+	mux := testMux(t)
+	h := withRoute(mux, withCanonicalHost(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "served")
+	})))
+	tests := []struct {
+		method, host, target string
+		// proxyProto is the X-Forwarded-Proto of a trusted proxy, if any.
+		proxyProto string
+		want       string
+	}{
+		{"GET", "old.example.com", "/users?limit=5&q=a%20b", "", "http://api.example.com/users?limit=5&q=a%20b"},
+		{"POST", "old.example.com:8080", "/users", "", "http://api.example.com/users"},
+		{"GET", "old.example.com", "/users/1", "https", "https://api.example.com/users/1"},
+		{"GET", "API.example.com", "/users", "", ""},
+		{"GET", "api.example.com", "/users", "", ""},
+		// Probes are made to instances' own addresses.
+		{"GET", "10.1.2.3:8080", "/health", "", ""},
+		{"GET", "10.1.2.3:8080", "/readyz", "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		r.Host = tt.host
+		if tt.proxyProto != "" {
+			r.RemoteAddr = "10.0.0.1:1234"
+			r.Header.Set("X-Forwarded-Proto", tt.proxyProto)
+		}
+		w := serve(h, r)
+		if tt.want == "" {
+			if w.Body.String() != "served" {
+				t.Errorf("%s %s%s: got %d %q", tt.method, tt.host, tt.target, w.Code, w.Header().Get("Location"))
+			}
+			continue
+		}
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != tt.want {
+			t.Errorf("%s %s%s: got %d to %q, want %s", tt.method, tt.host, tt.target, w.Code, w.Header().Get("Location"), tt.want)
+		}
+	}
+
+	setConfig(t, func(c *config) { c.CanonicalHost = "" })
+	r := httptest.NewRequest("GET", "/users", nil)
+	r.Host = "old.example.com"
+	if w := serve(withCanonicalHost(http.NotFoundHandler()), r); w.Code != http.StatusNotFound {
+		t.Errorf("disabled: got %d", w.Code)
+	}
+}
+
+func TestQueryLimit(t *testing.T) {
+	served := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "served") })
+	params := func(n int) string {
+		q := make([]string, n)
+		for i := range q {
+			q[i] = "junk" + strconv.Itoa(i) + "=1"
+		}
+		return strings.Join(q, "&")
+	}
+	// Every parameter of GET /users at once.
+	busiest := "q=a&name_prefix=a&email_contains=a&country=US,CA&has_addresses=true&created_after=2024-01-01" +
+		"&created_before=2025-01-01&include=addresses&include_inactive=true&sort=name&order=desc&limit=10" +
+		"&offset=10&after_id=5&tz=UTC"
+	tests := []struct {
+		max   int
+		query string
+		want  bool
+	}{
+		{32, "", true},
+		{32, busiest, true},
+		{32, params(32), true},
+		{32, params(33), false},
+		{32, params(500), false},
+		// Empty parameters count too.
+		{2, "a=1&&", false},
+		{0, params(500), true},
+	}
+	for _, tt := range tests {
+		setConfig(t, func(c *config) { c.MaxQueryParams = tt.max })
+		w := serve(withQueryLimit(served), httptest.NewRequest("GET", "/users?"+tt.query, nil))
+		if tt.want {
+			if w.Body.String() != "served" {
+				t.Errorf("max %d, %.40s: got %d %s", tt.max, tt.query, w.Code, w.Body)
+			}
+			continue
+		}
+		if w.Code != http.StatusBadRequest || responseAs[errorBody](t, w).Error.Code != "too_many_params" {
+			t.Errorf("max %d, %.40s: got %d %s, want too_many_params", tt.max, tt.query, w.Code, w.Body)
+		}
+	}
+	if n := len(strings.Split(busiest, "&")); n > 32/2 {
+		t.Errorf("GET /users takes %d parameters, too near the default limit of 32", n)
+	}
+}
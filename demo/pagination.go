@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
+// page is an offset/limit window over a list, from ?offset= and ?limit=.
+type page struct {
+	Offset int
+	Limit  int
+}
+
+func parsePage(r *http.Request) (page, error) {
+	p := page{Limit: defaultPageSize}
+	q := r.URL.Query()
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return p, newError(http.StatusBadRequest, "invalid_offset", "offset must be a non-negative integer")
+		}
+		p.Offset = n
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return p, newError(http.StatusBadRequest, "invalid_limit", "limit must be a positive integer")
+		}
+		if n > maxPageSize {
+			addWarning(r, "page_size_clamped", fmt.Sprintf("limit was reduced to the maximum of %d", maxPageSize))
+			n = maxPageSize
+		}
+		p.Limit = n
+	}
+	return p, nil
+}
+
+// setPageHeaders sets X-Total-Count and a Link header (RFC 8288) with first,
+// prev, next and last relations. Other query parameters are preserved.
+func setPageHeaders(w http.ResponseWriter, r *http.Request, p page, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	last := 0
+	if total > 0 {
+		last = (total - 1) / p.Limit * p.Limit
+	}
+	links := []string{pageLink(r, 0, p.Limit, "first")}
+	if p.Offset > 0 {
+		links = append(links, pageLink(r, max(p.Offset-p.Limit, 0), p.Limit, "prev"))
+	}
+	if p.Offset+p.Limit < total {
+		links = append(links, pageLink(r, p.Offset+p.Limit, p.Limit, "next"))
+	}
+	links = append(links, pageLink(r, last, p.Limit, "last"))
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+// setCursorHeaders sets a Link header to the keyset page after lastID. Other
+// query parameters are preserved.
+func setCursorHeaders(w http.ResponseWriter, r *http.Request, lastID any) {
+	q := r.URL.Query()
+	q.Set("after_id", fmt.Sprint(lastID))
+	w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=%q", r.URL.Path, q.Encode(), "next"))
+}
+
+func pageLink(r *http.Request, offset, limit int, rel string) string {
+	q := r.URL.Query()
+	q.Set("offset", strconv.Itoa(offset))
+	q.Set("limit", strconv.Itoa(limit))
+	return fmt.Sprintf("<%s?%s>; rel=%q", r.URL.Path, q.Encode(), rel)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestParsePage(t *testing.T) {
+	tests := []struct {
+		query string
+		want  page
+		err   bool
+	}{
+		{"", page{Offset: 0, Limit: 50}, false},
+		{"offset=10&limit=20", page{Offset: 10, Limit: 20}, false},
+		{"limit=1000", page{Limit: maxPageSize}, false},
+		{"offset=-1", page{}, true},
+		{"limit=0", page{}, true},
+		{"limit=ten", page{}, true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/users?"+tt.query, nil)
+		got, err := parsePage(r)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v", tt.query, err)
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestSetPageHeaders(t *testing.T) {
+	tests := []struct {
+		query string
+		total int
+		want  string
+	}{
+		{"offset=0&limit=50", 120, `</users?limit=50&offset=0&sort=name>; rel="first", ` +
+			`</users?limit=50&offset=50&sort=name>; rel="next", ` +
+			`</users?limit=50&offset=100&sort=name>; rel="last"`},
+		{"offset=50&limit=50", 120, `</users?limit=50&offset=0&sort=name>; rel="first", ` +
+			`</users?limit=50&offset=0&sort=name>; rel="prev", ` +
+			`</users?limit=50&offset=100&sort=name>; rel="next", ` +
+			`</users?limit=50&offset=100&sort=name>; rel="last"`},
+		{"offset=100&limit=50", 120, `</users?limit=50&offset=0&sort=name>; rel="first", ` +
+			`</users?limit=50&offset=50&sort=name>; rel="prev", ` +
+			`</users?limit=50&offset=100&sort=name>; rel="last"`},
+		{"offset=0&limit=50", 0, `</users?limit=50&offset=0&sort=name>; rel="first", ` +
+			`</users?limit=50&offset=0&sort=name>; rel="last"`},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/users?sort=name&"+tt.query, nil)
+		p, err := parsePage(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		setPageHeaders(w, r, p, tt.total)
+		if got := w.Header().Get("Link"); got != tt.want {
+			t.Errorf("%s of %d:\ngot  %s\nwant %s", tt.query, tt.total, got, tt.want)
+		}
+		if got := w.Header().Get("X-Total-Count"); got != strconv.Itoa(tt.total) {
+			t.Errorf("X-Total-Count %q", got)
+		}
+	}
+}
+
+func TestSetCursorHeaders(t *testing.T) {
+	r := httptest.NewRequest("GET", "/users?after_id=10&limit=2&country=US", nil)
+	w := httptest.NewRecorder()
+	setCursorHeaders(w, r, 42)
+	if got, want := w.Header().Get("Link"), `</users?after_id=42&country=US&limit=2>; rel="next"`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestListUsersLinkHeader(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		createTestUser(t, h, "User", email)
+	}
+	w := serve(h, httptest.NewRequest("GET", "/users?limit=2&sort=email", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	want := `</users?limit=2&offset=0&sort=email>; rel="first", </users?limit=2&offset=2&sort=email>; rel="next", </users?limit=2&offset=2&sort=email>; rel="last"`
+	if got := w.Header().Get("Link"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
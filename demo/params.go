@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// boolParam parses an optional boolean query parameter.
+func boolParam(r *http.Request, name string) (bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, newError(http.StatusBadRequest, "invalid_"+name, name+" must be true or false")
+	}
+	return b, nil
+}
+
+// optionalBoolParam parses a boolean query parameter, returning nil if it is
+// absent.
+func optionalBoolParam(r *http.Request, name string) (*bool, error) {
+	if r.URL.Query().Get(name) == "" {
+		return nil, nil
+	}
+	b, err := boolParam(r, name)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// textParam returns a free-text query parameter, such as a search term. Its
+// length is capped at cfg.MaxSearchLength so that it can't be used to make
+// pattern matching arbitrarily expensive.
+func textParam(r *http.Request, name string) (string, error) {
+	v := r.URL.Query().Get(name)
+	if utf8.RuneCountInString(v) > cfg.MaxSearchLength {
+		return "", newError(http.StatusBadRequest, "invalid_"+name, fmt.Sprintf("%s must be at most %d characters", name, cfg.MaxSearchLength))
+	}
+	if strings.ContainsFunc(v, unicode.IsControl) {
+		return "", newError(http.StatusBadRequest, "invalid_"+name, name+" must not contain control characters")
+	}
+	return v, nil
+}
+
+// likeEscape escapes the LIKE wildcards in s so that it matches literally.
+func likeEscape(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// timeParam parses an optional RFC 3339 timestamp or YYYY-MM-DD date (taken as
+// midnight UTC) query parameter, returning the zero time if it is absent.
+//
+// The time is returned in UTC: created_at columns are TIMESTAMP, without a
+// time zone, and pgx sends a time's wall clock as-is, so an offset would
+// otherwise be silently dropped.
+func timeParam(r *http.Request, name string) (time.Time, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.UTC(), nil
+	}
+	if t, err := time.Parse(time.DateOnly, v); err == nil {
+		return t, nil
+	}
+	return time.Time{}, newError(http.StatusBadRequest, "invalid_"+name, name+" must be an RFC 3339 timestamp or YYYY-MM-DD date")
+}
+
+// timeZoneParam parses the optional ?tz= parameter, an IANA time zone name
+// such as "America/New_York" in which to present timestamps. It defaults to
+// UTC. Timestamps are always stored in UTC.
+func timeZoneParam(r *http.Request) (*time.Location, error) {
+	v := r.URL.Query().Get("tz")
+	if v == "" {
+		return time.UTC, nil
+	}
+	// "Local" is the server's own zone, which clients can't know.
+	loc, err := time.LoadLocation(v)
+	if err != nil || v == "Local" {
+		return nil, newError(http.StatusBadRequest, "invalid_tz", "tz must be an IANA time zone name")
+	}
+	return loc, nil
+}
+
+// timeRange is an exclusive range of times, either end of which may be zero
+// for no bound.
+type timeRange struct {
+	After, Before time.Time
+}
+
+// contains reports whether t is within the range.
+func (tr timeRange) contains(t time.Time) bool {
+	return (tr.After.IsZero() || t.After(tr.After)) && (tr.Before.IsZero() || t.Before(tr.Before))
+}
+
+// and adds conditions to where restricting column to the range.
+func (tr timeRange) and(where *whereClause, column string) {
+	if !tr.After.IsZero() {
+		where.and(column + " > " + where.arg(tr.After))
+	}
+	if !tr.Before.IsZero() {
+		where.and(column + " < " + where.arg(tr.Before))
+	}
+}
+
+// createdParams parses the ?created_after= and ?created_before= parameters.
+func createdParams(r *http.Request) (timeRange, error) {
+	after, err := timeParam(r, "created_after")
+	if err != nil {
+		return timeRange{}, err
+	}
+	before, err := timeParam(r, "created_before")
+	if err != nil {
+		return timeRange{}, err
+	}
+	return timeRange{after, before}, nil
+}
+
+// listParam parses a comma-separated query parameter, ignoring empty
+// elements.
+func listParam(r *http.Request, name string) []string {
+	var list []string
+	for item := range strings.SplitSeq(r.URL.Query().Get(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// limitParam parses the optional ?limit= of a top-N list, returning 0 if it
+// is absent.
+func limitParam(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 {
+		return 0, newError(http.StatusBadRequest, "invalid_limit", "limit must be a positive integer")
+	}
+	return limit, nil
+}
+
+// countriesParam parses ?country= as a comma-separated list of ISO 3166-1
+// alpha-2 country codes, in any case.
+func countriesParam(r *http.Request) ([]string, error) {
+	countries := listParam(r, "country")
+	for i, c := range countries {
+		countries[i] = strings.ToUpper(c)
+		if !isCountry(countries[i]) {
+			return nil, newError(http.StatusBadRequest, "invalid_country", strconv.Quote(c)+" is not an ISO 3166-1 alpha-2 country code")
+		}
+	}
+	return countries, nil
+}
+
+// cursorParam parses a keyset pagination cursor, which is the id of the last
+// item on the previous page, in collection, returning -1 if it's absent. With
+// ID_TYPE=uuid, it's the item's UUID. Keyset pages are always in id order, so
+// the cursor can't be combined with ?sort= or ?offset=.
+func cursorParam(r *http.Request, name, collection string) (int, error) {
+	q := r.URL.Query()
+	v := q.Get(name)
+	if v == "" {
+		return -1, nil
+	}
+	if q.Has("sort") || q.Has("offset") {
+		return 0, newError(http.StatusBadRequest, "invalid_"+name, name+" cannot be combined with sort or offset")
+	}
+	id, err := lookupID(r.Context(), collection, v)
+	if err == errInvalidID || err == errNotFound || err == nil && id < 0 {
+		return 0, newError(http.StatusBadRequest, "invalid_"+name, name+" must be the id of an item")
+	}
+	return id, err
+}
+
+// sortOrder is a validated ?sort= parameter.
+type sortOrder struct {
+	// Column is empty to sort by id alone.
+	Column string
+	Desc   bool
+}
+
+// sortParam parses ?sort=column or ?sort=-column (for descending order),
+// where column must be id or one of columns.
+func sortParam(r *http.Request, columns ...string) (sortOrder, error) {
+	column, desc := strings.CutPrefix(r.URL.Query().Get("sort"), "-")
+	if column == "id" {
+		column = ""
+	}
+	if column != "" && !slices.Contains(columns, column) {
+		return sortOrder{}, newError(http.StatusBadRequest, "invalid_sort", "sort must be one of id, "+strings.Join(columns, ", "))
+	}
+	return sortOrder{Column: column, Desc: desc}, nil
+}
+
+// String returns the ORDER BY clause for s. id is always the final sort key,
+// so that rows with equal values for the requested column are in a stable
+// order and are never repeated or skipped between pages.
+func (s sortOrder) String() string {
+	switch {
+	case s.Column == "" && s.Desc:
+		return " ORDER BY id DESC"
+	case s.Column == "":
+		return " ORDER BY id"
+	case s.Desc:
+		return " ORDER BY " + s.Column + " DESC, id DESC"
+	default:
+		return " ORDER BY " + s.Column + ", id"
+	}
+}
+
+// checkUnmodifiedSince enforces an If-Unmodified-Since precondition against
+// the time a resource was last modified. HTTP-dates have one second
+// granularity, so updatedAt is truncated to match. Invalid dates are ignored,
+// as RFC 9110 requires.
+func checkUnmodifiedSince(r *http.Request, updatedAt time.Time) error {
+	since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since"))
+	if err != nil {
+		return nil
+	}
+	if updatedAt.Truncate(time.Second).After(since) {
+		return errPreconditionFailed
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckUnmodifiedSince(t *testing.T) {
+	updated := time.Date(2024, 3, 1, 12, 0, 0, 500e6, time.UTC)
+	tests := []struct {
+		header string
+		want   error
+	}{
+		{"", nil},
+		{"not a date", nil},
+		// HTTP-dates have second granularity, so the fraction is ignored.
+		{updated.Format(http.TimeFormat), nil},
+		{updated.Add(time.Hour).Format(http.TimeFormat), nil},
+		{updated.Add(-time.Second).Format(http.TimeFormat), errPreconditionFailed},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("PATCH", "/users/1", nil)
+		if tt.header != "" {
+			r.Header.Set("If-Unmodified-Since", tt.header)
+		}
+		if got := checkUnmodifiedSince(r, updated); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestOptionalBoolParam(t *testing.T) {
+	for query, want := range map[string]string{"": "absent", "?f=true": "true", "?f=0": "false"} {
+		got, err := optionalBoolParam(httptest.NewRequest("GET", "/"+query, nil), "f")
+		if err != nil {
+			t.Fatalf("%q: %v", query, err)
+		}
+		s := "absent"
+		if got != nil {
+			s = strconv.FormatBool(*got)
+		}
+		if s != want {
+			t.Errorf("%q: got %s, want %s", query, s, want)
+		}
+	}
+	_, err := optionalBoolParam(httptest.NewRequest("GET", "/?f=maybe", nil), "f")
+	if e, ok := err.(*apiError); !ok || e.Status != http.StatusBadRequest {
+		t.Errorf("invalid value: got %v, want a 400", err)
+	}
+}
+
+func TestSortParam(t *testing.T) {
+	tests := []struct {
+		query, want string
+	}{
+		{"", " ORDER BY id"},
+		{"?sort=-id", " ORDER BY id DESC"},
+		{"?sort=name", " ORDER BY name, id"},
+		{"?sort=-name", " ORDER BY name DESC, id DESC"},
+	}
+	for _, tt := range tests {
+		got, err := sortParam(httptest.NewRequest("GET", "/users"+tt.query, nil), "name", "email")
+		if err != nil || got.String() != tt.want {
+			t.Errorf("%q: got %q, %v; want %q", tt.query, got, err, tt.want)
+		}
+	}
+	_, err := sortParam(httptest.NewRequest("GET", "/users?sort=password", nil), "name", "email")
+	if e, ok := err.(*apiError); !ok || e.Code != "invalid_sort" {
+		t.Errorf("unknown column: got %v, want invalid_sort", err)
+	}
+}
+
+func TestCountriesParam(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", nil},
+		{"?country=us", []string{"US"}},
+		{"?country=US,ca,%20GB", []string{"US", "CA", "GB"}},
+	}
+	for _, tt := range tests {
+		got, err := countriesParam(httptest.NewRequest("GET", "/addresses"+tt.query, nil))
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("%q: got %v, %v; want %v", tt.query, got, err, tt.want)
+		}
+	}
+	_, err := countriesParam(httptest.NewRequest("GET", "/addresses?country=US,XX", nil))
+	if e, ok := err.(*apiError); !ok || e.Status != http.StatusBadRequest || !strings.Contains(e.Message, `"XX"`) {
+		t.Errorf("invalid country: got %v, want a 400 naming XX", err)
+	}
+}
+
+func TestTextParam(t *testing.T) {
+	setConfig(t, func(c *config) { c.MaxSearchLength = 4 })
+	tests := []struct {
+		query, want string
+		ok          bool
+	}{
+		{"", "", true},
+		{"?q=abcd", "abcd", true},
+		{"?q=%C3%A9t%C3%A9s", "étés", true}, // Counted in characters, not bytes.
+		{"?q=abcde", "", false},
+		{"?q=a%00b", "", false},
+		{"?q=a%0Ab", "", false},
+		{"?q=a%1Bb", "", false},
+	}
+	for _, tt := range tests {
+		got, err := textParam(httptest.NewRequest("GET", "/users"+tt.query, nil), "q")
+		if tt.ok && (err != nil || got != tt.want) {
+			t.Errorf("%q: got %q, %v; want %q", tt.query, got, err, tt.want)
+		}
+		if e, ok := err.(*apiError); !tt.ok && (!ok || e.Status != http.StatusBadRequest || e.Code != "invalid_q") {
+			t.Errorf("%q: got %q, %v; want a 400", tt.query, got, err)
+		}
+	}
+}
+
+func TestTimeParam(t *testing.T) {
+	tests := []struct {
+		query string
+		want  time.Time
+	}{
+		{"", time.Time{}},
+		{"?t=2024-03-01", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"?t=2024-03-01T12:00:00Z", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+		// Offsets are converted, as TIMESTAMP columns would otherwise drop them.
+		{"?t=2024-03-01T12:00:00%2B02:00", time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := timeParam(httptest.NewRequest("GET", "/users"+tt.query, nil), "t")
+		if err != nil || !got.Equal(tt.want) || got.Location() != tt.want.Location() {
+			t.Errorf("%q: got %v, %v; want %v", tt.query, got, err, tt.want)
+		}
+	}
+	for _, query := range []string{"?t=yesterday", "?t=2024-13-01", "?t=1709294400"} {
+		if _, err := timeParam(httptest.NewRequest("GET", "/users"+query, nil), "t"); err == nil {
+			t.Errorf("%q: expected an error", query)
+		}
+	}
+}
+
+func TestCursorParam(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+		ok    bool
+	}{
+		{"", -1, true},
+		{"?after_id=0", 0, true},
+		{"?after_id=42&limit=10", 42, true},
+		{"?after_id=-1", 0, false},
+		{"?after_id=abc", 0, false},
+		{"?after_id=42&sort=name", 0, false},
+		{"?after_id=42&offset=10", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := cursorParam(httptest.NewRequest("GET", "/users"+tt.query, nil), "after_id", "users")
+		if tt.ok && (err != nil || got != tt.want) {
+			t.Errorf("%q: got %d, %v; want %d", tt.query, got, err, tt.want)
+		}
+		if e, ok := err.(*apiError); !tt.ok && (!ok || e.Code != "invalid_after_id") {
+			t.Errorf("%q: got %d, %v; want invalid_after_id", tt.query, got, err)
+		}
+	}
+}
+
+func TestTimeZoneParam(t *testing.T) {
+	for query, want := range map[string]string{
+		"":                     "UTC",
+		"?tz=UTC":              "UTC",
+		"?tz=America/New_York": "America/New_York",
+		"?tz=Asia/Kolkata":     "Asia/Kolkata",
+	} {
+		loc, err := timeZoneParam(httptest.NewRequest("GET", "/users"+query, nil))
+		if err != nil || loc.String() != want {
+			t.Errorf("%q: got %v, %v; want %s", query, loc, err, want)
+		}
+	}
+	for _, query := range []string{"?tz=Local", "?tz=Mars/Olympus_Mons", "?tz=../../etc/passwd"} {
+		if _, err := timeZoneParam(httptest.NewRequest("GET", "/users"+query, nil)); err == nil {
+			t.Errorf("%q: expected an error", query)
+		}
+	}
+}
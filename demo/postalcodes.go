@@ -0,0 +1,32 @@
+package main
+
+import "regexp"
+
+// maxPostalCodeLength bounds postal codes of countries without a known format.
+const maxPostalCodeLength = 16
+
+// postalCodeFormats are the postal code formats of countries where the format
+// is well known. Codes are matched after upper-casing.
+var postalCodeFormats = map[string]*regexp.Regexp{
+	"AU": regexp.MustCompile(`^\d{4}$`),
+	"BR": regexp.MustCompile(`^\d{5}-?\d{3}$`),
+	"CA": regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`),
+	"CH": regexp.MustCompile(`^\d{4}$`),
+	"DE": regexp.MustCompile(`^\d{5}$`),
+	"ES": regexp.MustCompile(`^\d{5}$`),
+	"FR": regexp.MustCompile(`^\d{5}$`),
+	"GB": regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`),
+	"IN": regexp.MustCompile(`^\d{6}$`),
+	"IT": regexp.MustCompile(`^\d{5}$`),
+	"JP": regexp.MustCompile(`^\d{3}-?\d{4}$`),
+	"NL": regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`),
+	"US": regexp.MustCompile(`^\d{5}(-\d{4})?$`),
+}
+
+// validPostalCode reports whether code is a plausible postal code in country.
+func validPostalCode(country, code string) bool {
+	if format, ok := postalCodeFormats[country]; ok {
+		return format.MatchString(code)
+	}
+	return len(code) <= maxPostalCodeLength
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// pruneBatchSize bounds how many users each pruning transaction deletes, so
+// that no transaction holds its locks for long.
+const pruneBatchSize = 500
+
+// pruner hard-deletes users that were soft-deleted more than retention ago,
+// along with their addresses. Audit entries and address history are kept.
+type pruner struct {
+	retention time.Duration
+	// now is time.Now, replaceable for testing.
+	now func() time.Time
+}
+
+func newPruner(retention time.Duration) *pruner {
+	return &pruner{retention: retention, now: time.Now}
+}
+
+// run prunes every interval until ctx is cancelled.
+func (p *pruner) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		n, err := p.prune(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("prune deleted users: %v (%d pruned)", err, n)
+			}
+			continue
+		}
+		log.Printf("Pruned %d deleted users", n)
+	}
+}
+
+// prune deletes every user due to be pruned, a batch per transaction, and
+// returns how many it deleted.
+func (p *pruner) prune(ctx context.Context) (int, error) {
+	cutoff := p.now().Add(-p.retention)
+	total := 0
+	for {
+		n, err := p.pruneBatch(ctx, cutoff)
+		total += n
+		if err != nil || n < pruneBatchSize {
+			return total, err
+		}
+	}
+}
+
+func (p *pruner) pruneBatch(ctx context.Context, cutoff time.Time) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	// Addresses go with their users by ON DELETE CASCADE. Users locked by
+	// another transaction are left for the next run.
+	res, err := tx.ExecContext(ctx,
+		`DELETE FROM users WHERE id IN (
+			SELECT id FROM users WHERE deleted_at < $1 ORDER BY id LIMIT $2 FOR UPDATE SKIP LOCKED
+		)`,
+		cutoff, pruneBatchSize,
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
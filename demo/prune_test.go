@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPrune(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	month := createTestUser(t, h, "Month", "month@example.com")
+	createTestAddress(t, h, month.ID, "1 Main St", "Springfield", "US")
+	today := createTestUser(t, h, "Today", "today@example.com")
+	live := createTestUser(t, h, "Live", "live@example.com")
+	for _, u := range []User{month, today} {
+		if w := serve(h, httptest.NewRequest("DELETE", userPath(u.ID), nil)); w.Code != http.StatusNoContent {
+			t.Fatalf("delete: got %d %s", w.Code, w.Body)
+		}
+	}
+	// One of them was deleted a month ago.
+	if _, err := db.Exec("UPDATE users SET deleted_at = deleted_at - interval '30 days' WHERE id = $1", month.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	const day = 24 * time.Hour
+	start := time.Now().UTC()
+	p := newPruner(90 * day)
+	exists := func(id int) bool {
+		t.Helper()
+		var n int
+		if err := db.QueryRow("SELECT count(*) FROM users WHERE id = $1", id).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n == 1
+	}
+	tests := []struct {
+		after  time.Duration
+		pruned int
+		// kept are the users left afterwards.
+		kept []User
+	}{
+		{0, 0, []User{month, today, live}},
+		{59 * day, 0, []User{month, today, live}},
+		{61 * day, 1, []User{today, live}},
+		{89 * day, 0, []User{today, live}},
+		{91 * day, 1, []User{live}},
+		{365 * day, 0, []User{live}},
+	}
+	for _, tt := range tests {
+		p.now = func() time.Time { return start.Add(tt.after) }
+		n, err := p.prune(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tt.pruned {
+			t.Errorf("after %v: pruned %d, want %d", tt.after, n, tt.pruned)
+		}
+		for _, u := range tt.kept {
+			if !exists(u.ID) {
+				t.Errorf("after %v: %s was pruned", tt.after, u.Name)
+			}
+		}
+	}
+	var addresses int
+	if err := db.QueryRow("SELECT count(*) FROM addresses WHERE user_id = $1", month.ID).Scan(&addresses); err != nil || addresses != 0 {
+		t.Errorf("pruned user's addresses: %d, %v", addresses, err)
+	}
+	if exists(month.ID) || exists(today.ID) {
+		t.Error("deleted users weren't pruned")
+	}
+}
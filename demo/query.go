@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// whereClause accumulates SQL conditions and their arguments.
+type whereClause struct {
+	conds []string
+	args  []any
+}
+
+// arg adds an argument, returning its placeholder.
+func (w *whereClause) arg(v any) string {
+	w.args = append(w.args, v)
+	return "$" + strconv.Itoa(len(w.args))
+}
+
+// and adds a condition, which must reference its arguments via arg.
+func (w *whereClause) and(cond string) {
+	w.conds = append(w.conds, cond)
+}
+
+func (w *whereClause) String() string {
+	if len(w.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(w.conds, " AND ")
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"time"
+)
+
+// queryCacheSize bounds the number of results held in memory by cachedQuery
+// when Redis isn't configured.
+const queryCacheSize = 1000
+
+var (
+	queryCacheResults = expvar.NewMap("query_cache_total")
+	// queryCache is used by cachedQuery when there's no sharedCache.
+	queryCache = newLRUCache[string, cachedResult](queryCacheSize, 0)
+)
+
+type cachedResult struct {
+	data    json.RawMessage
+	expires time.Time
+}
+
+// cachedQuery returns the JSON encoding of fn's result, reusing a result
+// cached under key for up to ttl. Results are shared between instances
+// through Redis if it's configured, and held in memory otherwise.
+//
+// Results aren't invalidated by writes, so this is only for reads that can
+// tolerate being up to ttl out of date, such as aggregates.
+func cachedQuery(ctx context.Context, key string, ttl time.Duration, fn func(context.Context) (any, error)) (json.RawMessage, error) {
+	key = "query:" + key
+	var data json.RawMessage
+	if sharedCache != nil {
+		if sharedCache.Get(ctx, key, &data) {
+			queryCacheResults.Add("hit", 1)
+			return data, nil
+		}
+	} else if result, ok := queryCache.Get(key); ok && time.Now().Before(result.expires) {
+		queryCacheResults.Add("hit", 1)
+		return result.data, nil
+	}
+	queryCacheResults.Add("miss", 1)
+	gen := queryCache.Generation()
+	v, err := fn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = json.Marshal(v); err != nil {
+		return nil, err
+	}
+	if sharedCache != nil {
+		sharedCache.SetWithTTL(ctx, key, data, ttl)
+	} else {
+		queryCache.Set(key, cachedResult{data: data, expires: time.Now().Add(ttl)}, gen)
+	}
+	return data, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"testing"
+	"time"
+)
+
+// testQueryCache gives cachedQuery an empty in-memory cache, or a Redis cache
+// if redis is set, for the duration of the test.
+func testQueryCache(t *testing.T, redis bool) {
+	t.Helper()
+	savedQuery, savedShared := queryCache, sharedCache
+	t.Cleanup(func() { queryCache, sharedCache = savedQuery, savedShared })
+	queryCache = newLRUCache[string, cachedResult](queryCacheSize, 0)
+	sharedCache = nil
+	if redis {
+		sharedCache, _ = testRedisCache(t)
+	}
+}
+
+// queryCacheCount returns the number of cachedQuery hits or misses so far.
+func queryCacheCount(result string) int64 {
+	if v, ok := queryCacheResults.Get(result).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestCachedQueryRunsOnceWithinTTL(t *testing.T) {
+	for _, redis := range []bool{false, true} {
+		testQueryCache(t, redis)
+		ctx := context.Background()
+		calls := 0
+		fn := func(context.Context) (any, error) {
+			calls++
+			return map[string]int{"calls": calls}, nil
+		}
+		hits, misses := queryCacheCount("hit"), queryCacheCount("miss")
+		for range 3 {
+			data, err := cachedQuery(ctx, "test", time.Minute, fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != `{"calls":1}` {
+				t.Errorf("redis=%v: got %s", redis, data)
+			}
+		}
+		if calls != 1 {
+			t.Errorf("redis=%v: fn ran %d times", redis, calls)
+		}
+		if got := queryCacheCount("hit") - hits; got != 2 {
+			t.Errorf("redis=%v: %d hits, want 2", redis, got)
+		}
+		if got := queryCacheCount("miss") - misses; got != 1 {
+			t.Errorf("redis=%v: %d misses, want 1", redis, got)
+		}
+
+		// Keys are cached separately.
+		if data, _ := cachedQuery(ctx, "other", time.Minute, fn); string(data) != `{"calls":2}` {
+			t.Errorf("redis=%v: other key: got %s", redis, data)
+		}
+	}
+}
+
+func TestCachedQueryExpires(t *testing.T) {
+	testQueryCache(t, false)
+	calls := 0
+	fn := func(context.Context) (any, error) {
+		calls++
+		return calls, nil
+	}
+	cachedQuery(context.Background(), "test", time.Millisecond, fn)
+	time.Sleep(5 * time.Millisecond)
+	if data, _ := cachedQuery(context.Background(), "test", time.Millisecond, fn); string(data) != "2" {
+		t.Errorf("got %s after the TTL, want 2", data)
+	}
+}
+
+func TestCachedQueryDoesntCacheErrors(t *testing.T) {
+	testQueryCache(t, false)
+	calls := 0
+	fn := func(context.Context) (any, error) {
+		calls++
+		if calls == 1 {
+			return nil, context.DeadlineExceeded
+		}
+		return calls, nil
+	}
+	if _, err := cachedQuery(context.Background(), "test", time.Minute, fn); err != context.DeadlineExceeded {
+		t.Errorf("got %v", err)
+	}
+	if data, err := cachedQuery(context.Background(), "test", time.Minute, fn); err != nil || string(data) != "2" {
+		t.Errorf("got %s, %v after an error", data, err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// queryTracer times every query, logging those slower than
+// cfg.SlowQueryThreshold and recording them in slowQueries.
+type queryTracer struct{}
+
+type queryStartKey struct{}
+
+type queryStart struct {
+	sql   string
+	args  []any
+	start time.Time
+}
+
+func (queryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	qs := queryStart{sql: data.SQL, start: time.Now()}
+	if cfg.LogSQLParams {
+		qs.args = data.Args
+	}
+	return context.WithValue(ctx, queryStartKey{}, qs)
+}
+
+func (queryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	qs, ok := ctx.Value(queryStartKey{}).(queryStart)
+	if !ok {
+		return
+	}
+	elapsed := time.Since(qs.start)
+	if t, ok := ctx.Value(timingKey).(*serverTiming); ok {
+		t.db.Add(int64(elapsed))
+	}
+	if elapsed < cfg.SlowQueryThreshold {
+		return
+	}
+	q := slowQuery{SQL: qs.sql, Duration: elapsed, At: qs.start}
+	if qs.args != nil {
+		q.Params = make([]string, len(qs.args))
+		for i, arg := range qs.args {
+			q.Params[i] = redactParam(arg)
+		}
+		log.Printf("slow query (%s): %s params=%q", elapsed, qs.sql, q.Params)
+	} else {
+		log.Printf("slow query (%s): %s", elapsed, qs.sql)
+	}
+	slowQueries.Record(q)
+}
+
+type slowQuery struct {
+	SQL      string        `json:"sql"`
+	Params   []string      `json:"params,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+	At       time.Time     `json:"at"`
+}
+
+// maxLoggedParamLength is the longest query parameter logged before it is
+// truncated.
+const maxLoggedParamLength = 64
+
+// redactParam formats a query parameter for logging, masking the local part
+// of emails, as "***@example.com", and truncating long values.
+func redactParam(arg any) string {
+	var s string
+	switch v := arg.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return fmt.Sprintf("<%d bytes>", len(v))
+	case string:
+		s = v
+	default:
+		s = fmt.Sprint(v)
+	}
+	if local, domain, ok := strings.Cut(s, "@"); ok && local != "" && domain != "" && !strings.ContainsAny(s, " \t\n") {
+		s = "***@" + domain
+	}
+	if utf8.RuneCountInString(s) > maxLoggedParamLength {
+		s = string([]rune(s)[:maxLoggedParamLength]) + "…"
+	}
+	return s
+}
+
+// slowQueryLog holds the slowest queries seen within a retention window.
+type slowQueryLog struct {
+	mu        sync.Mutex
+	size      int
+	retention time.Duration
+	// queries is ordered slowest first.
+	queries []slowQuery
+}
+
+var slowQueries = &slowQueryLog{}
+
+func (l *slowQueryLog) Record(q slowQuery) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire()
+	i, _ := slices.BinarySearchFunc(l.queries, q, func(a, b slowQuery) int {
+		return int(b.Duration - a.Duration)
+	})
+	if i >= l.size {
+		return
+	}
+	l.queries = slices.Insert(l.queries, i, q)
+	if len(l.queries) > l.size {
+		l.queries = l.queries[:l.size]
+	}
+}
+
+// Snapshot returns the retained queries, slowest first.
+func (l *slowQueryLog) Snapshot() []slowQuery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire()
+	return slices.Clone(l.queries)
+}
+
+func (l *slowQueryLog) expire() {
+	cutoff := time.Now().Add(-l.retention)
+	l.queries = slices.DeleteFunc(l.queries, func(q slowQuery) bool { return q.At.Before(cutoff) })
+}
+
+func listSlowQueries(w http.ResponseWriter, r *http.Request) {
+	queries := slowQueries.Snapshot()
+	if queries == nil {
+		queries = []slowQuery{}
+	}
+	writeJSON(w, http.StatusOK, queries)
+}
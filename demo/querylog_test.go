@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestSlowQueryLogKeepsSlowest(t *testing.T) {
+	l := &slowQueryLog{size: 3, retention: time.Hour}
+	now := time.Now()
+	for _, ms := range []int{5, 50, 1, 20, 10, 30} {
+		l.Record(slowQuery{SQL: "SELECT 1", Duration: time.Duration(ms) * time.Millisecond, At: now})
+	}
+	var got []time.Duration
+	for _, q := range l.Snapshot() {
+		got = append(got, q.Duration)
+	}
+	want := []time.Duration{50 * time.Millisecond, 30 * time.Millisecond, 20 * time.Millisecond}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSlowQueryLogExpires(t *testing.T) {
+	l := &slowQueryLog{size: 3, retention: time.Minute}
+	l.Record(slowQuery{SQL: "old", Duration: time.Second, At: time.Now().Add(-2 * time.Minute)})
+	l.Record(slowQuery{SQL: "new", Duration: time.Millisecond, At: time.Now()})
+	got := l.Snapshot()
+	if len(got) != 1 || got[0].SQL != "new" {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestListSlowQueries(t *testing.T) {
+	saved := slowQueries
+	slowQueries = &slowQueryLog{size: 3, retention: time.Hour}
+	t.Cleanup(func() { slowQueries = saved })
+	h := newHandler(newMux())
+	if w := serve(h, httptest.NewRequest("GET", "/admin/slow-queries", nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: %d", w.Code)
+	}
+	w := serve(h, adminRequest(t, "GET", "/admin/slow-queries", ""))
+	if w.Body.String() != "[]\n" {
+		t.Errorf("empty log: %s", w.Body)
+	}
+	slowQueries.Record(slowQuery{SQL: "SELECT 1", Duration: time.Second, At: time.Now()})
+	w = serve(h, adminRequest(t, "GET", "/admin/slow-queries", ""))
+	if got := responseAs[[]slowQuery](t, w); len(got) != 1 || got[0].SQL != "SELECT 1" {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestRedactParam(t *testing.T) {
+	long := strings.Repeat("é", maxLoggedParamLength+1)
+	tests := []struct {
+		arg  any
+		want string
+	}{
+		{nil, "NULL"},
+		{42, "42"},
+		{true, "true"},
+		{"Alice", "Alice"},
+		{"alice@example.com", "***@example.com"},
+		{"Alice+tag@Example.com", "***@Example.com"},
+		// Not emails.
+		{"@example.com", "@example.com"},
+		{"alice@", "alice@"},
+		{"meet alice@example.com", "meet alice@example.com"},
+		{[]byte("secret"), "<6 bytes>"},
+		{long, strings.Repeat("é", maxLoggedParamLength) + "…"},
+		{[]int{1, 2}, "[1 2]"},
+	}
+	for _, tt := range tests {
+		if got := redactParam(tt.arg); got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestQueryTracerParams(t *testing.T) {
+	saved := slowQueries
+	t.Cleanup(func() { slowQueries = saved })
+	var logs bytes.Buffer
+	savedOutput := log.Writer()
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(savedOutput) })
+
+	for _, logParams := range []bool{false, true} {
+		setConfig(t, func(c *config) { c.LogSQLParams = logParams; c.SlowQueryThreshold = 0 })
+		slowQueries = &slowQueryLog{size: 3, retention: time.Hour}
+		logs.Reset()
+		var tracer queryTracer
+		ctx := tracer.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{
+			SQL:  "SELECT id FROM users WHERE email = $1",
+			Args: []any{"alice@example.com"},
+		})
+		tracer.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{})
+
+		got := slowQueries.Snapshot()
+		if len(got) != 1 {
+			t.Fatalf("LogSQLParams=%v: recorded %+v", logParams, got)
+		}
+		if strings.Contains(logs.String(), "alice") || strings.Contains(fmt.Sprint(got[0].Params), "alice") {
+			t.Errorf("LogSQLParams=%v: email logged: %s %q", logParams, logs.String(), got[0].Params)
+		}
+		if logParams {
+			if len(got[0].Params) != 1 || got[0].Params[0] != "***@example.com" || !strings.Contains(logs.String(), "***@example.com") {
+				t.Errorf("redacted params missing: %s %q", logs.String(), got[0].Params)
+			}
+		} else if got[0].Params != nil || strings.Contains(logs.String(), "params=") {
+			t.Errorf("params logged by default: %s %q", logs.String(), got[0].Params)
+		}
+	}
+}
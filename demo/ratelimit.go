@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errRateLimited = newError(http.StatusTooManyRequests, "rate_limited", "too many requests")
+
+// rateLimiter allows each key at most limit requests per fixed window.
+//
+// A nil *rateLimiter allows everything.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	start  time.Time
+	counts map[string]int
+}
+
+// newRateLimiter returns a limiter, or nil if limit is not positive.
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &rateLimiter{limit: limit, window: window, counts: map[string]int{}}
+}
+
+// Allow counts a request for key, reporting whether it is within the limit
+// and, if not, how long until the next window.
+func (l *rateLimiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.start) >= l.window {
+		l.start = now
+		clear(l.counts)
+	}
+	if l.counts[key] >= l.limit {
+		return false, l.window - now.Sub(l.start)
+	}
+	l.counts[key]++
+	return true, 0
+}
+
+// rateLimit limits requests to next per client IP.
+func rateLimit(l *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, retryAfter := l.Allow(clientIP(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(w, r, errRateLimited)
+			return
+		}
+		next(w, r)
+	}
+}
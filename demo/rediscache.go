@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// cacheInvalidationChannel carries the keys of cached values that were
+// modified, so that every instance can drop its in-memory copy.
+const cacheInvalidationChannel = "demo:cache:invalidate"
+
+// redisCache is a cache shared between instances.
+//
+// A nil *redisCache is a valid, permanently empty cache. Redis errors are
+// logged and treated as cache misses so that Redis is never required to serve
+// a request.
+type redisCache struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// cachedValue is the JSON representation of a value stored in Redis.
+type cachedValue struct {
+	// Version is the ETag of Value.
+	Version string          `json:"version"`
+	Value   json.RawMessage `json:"value"`
+}
+
+func newRedisCache(url string, ttl time.Duration) (*redisCache, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &redisCache{client: redis.NewClient(opts), ttl: ttl}, nil
+}
+
+// Get decodes the value cached under key into v.
+//
+// Entries whose version does not match their value are treated as stale.
+func (c *redisCache) Get(ctx context.Context, key string, v any) bool {
+	if c == nil {
+		return false
+	}
+	data, err := c.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return false
+	}
+	if err != nil {
+		log.Printf("redis: get %s: %v", key, err)
+		return false
+	}
+	var cv cachedValue
+	if err := json.Unmarshal(data, &cv); err != nil {
+		log.Printf("redis: decode %s: %v", key, err)
+		return false
+	}
+	if cv.Version != etag(cv.Value) {
+		return false
+	}
+	if err := json.Unmarshal(cv.Value, v); err != nil {
+		log.Printf("redis: decode %s: %v", key, err)
+		return false
+	}
+	return true
+}
+
+// Set caches v under key.
+func (c *redisCache) Set(ctx context.Context, key string, v any) {
+	if c == nil {
+		return
+	}
+	c.SetWithTTL(ctx, key, v, c.ttl)
+}
+
+// SetWithTTL caches v under key for ttl rather than the cache's default TTL.
+func (c *redisCache) SetWithTTL(ctx context.Context, key string, v any, ttl time.Duration) {
+	if c == nil {
+		return
+	}
+	value, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("redis: encode %s: %v", key, err)
+		return
+	}
+	data, err := json.Marshal(cachedValue{Version: etag(value), Value: value})
+	if err != nil {
+		log.Printf("redis: encode %s: %v", key, err)
+		return
+	}
+	if err := c.client.Set(ctx, key, data, ttl).Err(); err != nil {
+		log.Printf("redis: set %s: %v", key, err)
+	}
+}
+
+// Invalidate removes key from Redis and notifies every instance.
+func (c *redisCache) Invalidate(ctx context.Context, key string) {
+	if c == nil {
+		return
+	}
+	if err := c.client.Del(ctx, key).Err(); err != nil {
+		log.Printf("redis: del %s: %v", key, err)
+	}
+	if err := c.client.Publish(ctx, cacheInvalidationChannel, key).Err(); err != nil {
+		log.Printf("redis: publish %s: %v", key, err)
+	}
+}
+
+// Ping checks that Redis is reachable.
+func (c *redisCache) Ping(ctx context.Context) error {
+	return c.client.Ping(ctx).Err()
+}
+
+// Subscribe calls fn with each invalidated key until ctx is cancelled.
+func (c *redisCache) Subscribe(ctx context.Context, fn func(key string)) {
+	if c == nil {
+		return
+	}
+	sub := c.client.Subscribe(ctx, cacheInvalidationChannel)
+	defer sub.Close()
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			fn(msg.Payload)
+		}
+	}
+}
+
+// etag returns a strong ETag for a JSON-encoded value.
+func etag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
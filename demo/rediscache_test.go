@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func testRedisCache(t *testing.T) (*redisCache, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	c, err := newRedisCache("redis://"+mr.Addr(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.client.Close() })
+	return c, mr
+}
+
+func TestRedisCacheRoundTrip(t *testing.T) {
+	c, mr := testRedisCache(t)
+	ctx := context.Background()
+	c.Set(ctx, userKey(1), User{ID: 1, Name: "Alice"})
+	var u User
+	if !c.Get(ctx, userKey(1), &u) || u.Name != "Alice" {
+		t.Errorf("got %+v", u)
+	}
+	if ttl := mr.TTL(userKey(1)); ttl != time.Minute {
+		t.Errorf("TTL %v", ttl)
+	}
+}
+
+func TestRedisCacheIgnoresStaleVersions(t *testing.T) {
+	c, mr := testRedisCache(t)
+	mr.Set(userKey(1), `{"version":"\"0000000000000000\"","value":{"id":1,"name":"Alice"}}`)
+	var u User
+	if c.Get(context.Background(), userKey(1), &u) {
+		t.Error("served a value that doesn't match its version")
+	}
+}
+
+func TestRedisCacheInvalidate(t *testing.T) {
+	c, mr := testRedisCache(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.Set(ctx, userKey(1), User{ID: 1})
+	keys := make(chan string, 10)
+	go c.Subscribe(ctx, func(key string) { keys <- key })
+	deadline := time.After(5 * time.Second)
+	for received := false; !received; {
+		// Until the subscription is established, invalidations are missed.
+		c.Invalidate(ctx, userKey(1))
+		select {
+		case key := <-keys:
+			if key != userKey(1) {
+				t.Errorf("invalidated %q", key)
+			}
+			received = true
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("invalidation not received")
+		}
+	}
+	if mr.Exists(userKey(1)) {
+		t.Error("key not deleted")
+	}
+}
+
+func TestRedisCacheUnavailable(t *testing.T) {
+	c, mr := testRedisCache(t)
+	mr.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c.Set(ctx, userKey(1), User{ID: 1})
+	var u User
+	if c.Get(ctx, userKey(1), &u) {
+		t.Error("got a value from an unreachable Redis")
+	}
+}
+
+func TestNilRedisCache(t *testing.T) {
+	var c *redisCache
+	ctx := context.Background()
+	c.Set(ctx, userKey(1), User{ID: 1})
+	c.Invalidate(ctx, userKey(1))
+	var u User
+	if c.Get(ctx, userKey(1), &u) {
+		t.Error("nil cache returned a value")
+	}
+}
+
+func TestGetUserSharedCache(t *testing.T) {
+	testDB(t)
+	saved := sharedCache
+	sharedCache, _ = testRedisCache(t)
+	t.Cleanup(func() { sharedCache = saved })
+	h := newHandler(newMux())
+	u := createTestUser(t, h, "Alice", "alice@example.com")
+	a := createTestAddress(t, h, u.ID, "1 Main St", "Springfield", "US")
+
+	for _, target := range []string{userPath(u.ID), "/addresses/" + strconv.Itoa(a.ID)} {
+		for _, want := range []string{"MISS", "HIT"} {
+			w := serve(h, httptest.NewRequest("GET", target, nil))
+			if got := w.Header().Get("X-Cache"); got != want {
+				t.Errorf("GET %s: X-Cache %q, want %q", target, got, want)
+			}
+		}
+	}
+
+	serve(h, jsonRequest("PATCH", userPath(u.ID), `{"name":"Alicia"}`))
+	serve(h, jsonRequest("PATCH", "/addresses/"+strconv.Itoa(a.ID), `{"city":"Shelbyville"}`))
+	if got := responseAs[User](t, serve(h, httptest.NewRequest("GET", userPath(u.ID), nil))); got.Name != "Alicia" {
+		t.Errorf("served stale user %+v", got)
+	}
+	if got := responseAs[Address](t, serve(h, httptest.NewRequest("GET", "/addresses/"+strconv.Itoa(a.ID), nil))); got.City != "Shelbyville" {
+		t.Errorf("served stale address %+v", got)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// reindexLockKey is the advisory lock held while /admin/reindex runs, so that
+// only one instance reindexes at a time.
+const reindexLockKey = 0x7265696e646578 // "reindex"
+
+// reindexIndexes are the indexes rebuilt by /admin/reindex.
+var reindexIndexes = []string{
+	"users_email_live_idx",
+	"users_email_hash_live_idx",
+	"address_history_address_id_idx",
+}
+
+var errReindexRunning = newError(http.StatusConflict, "reindex_running", "a reindex is already running")
+
+type reindexProgress struct {
+	Index    string `json:"index"`
+	Duration int64  `json:"duration_ms"`
+	Error    string `json:"error,omitempty"`
+}
+
+// reindex rebuilds each of reindexIndexes in turn, without blocking writes
+// where the server supports it, streaming an NDJSON line for each as it
+// finishes. It responds 409 if a reindex is already running on any instance.
+func reindex(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	// The advisory lock is held by the session, and REINDEX CONCURRENTLY
+	// can't run in a transaction, so everything runs on one connection.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer conn.Close()
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", reindexLockKey).Scan(&locked); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !locked {
+		writeError(w, r, errReindexRunning)
+		return
+	}
+	defer func() {
+		// The request's context may be done, but the lock must be released
+		// before the connection is reused.
+		if _, err := conn.ExecContext(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock($1)", reindexLockKey); err != nil {
+			log.Printf("reindex: unlock: %v", err)
+		}
+	}()
+	concurrently, err := supportsReindexConcurrently(ctx, conn)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	rc := http.NewResponseController(w)
+	for _, index := range reindexIndexes {
+		stmt := "REINDEX INDEX "
+		if concurrently {
+			stmt += "CONCURRENTLY "
+		}
+		start := time.Now()
+		_, err := conn.ExecContext(ctx, stmt+index)
+		progress := reindexProgress{Index: index, Duration: time.Since(start).Milliseconds()}
+		if err != nil {
+			log.Printf("reindex %s: %v", index, err)
+			progress.Error = err.Error()
+		}
+		enc.Encode(progress)
+		rc.Flush()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// supportsReindexConcurrently reports whether the server has REINDEX
+// CONCURRENTLY, added in Postgres 12.
+func supportsReindexConcurrently(ctx context.Context, conn *sql.Conn) (bool, error) {
+	var version int
+	err := conn.QueryRowContext(ctx, "SELECT current_setting('server_version_num')::int").Scan(&version)
+	return version >= 120000, err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReindexRunning(t *testing.T) {
+	// Another instance holds the lock.
+	fakeDB(t, scriptedDriver{func(query string) *scriptedRows {
+		return &scriptedRows{columns: []string{"pg_try_advisory_lock"}, values: [][]driver.Value{{false}}}
+	}})
+	w := serve(newHandler(newMux()), adminRequest(t, "POST", "/admin/reindex", ""))
+	if w.Code != http.StatusConflict || responseAs[errorBody](t, w).Error.Code != "reindex_running" {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestReindex(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	if w := serve(h, jsonRequest("POST", "/admin/reindex", "")); w.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: got %d", w.Code)
+	}
+
+	// A reindex holding the lock on another connection blocks this one.
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", reindexLockKey); err != nil {
+		t.Fatal(err)
+	}
+	w := serve(h, adminRequest(t, "POST", "/admin/reindex", ""))
+	if w.Code != http.StatusConflict || responseAs[errorBody](t, w).Error.Code != "reindex_running" {
+		t.Errorf("while locked: got %d %s", w.Code, w.Body)
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", reindexLockKey); err != nil {
+		t.Fatal(err)
+	}
+
+	w = serve(h, adminRequest(t, "POST", "/admin/reindex", ""))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	var indexes []string
+	scanner := bufio.NewScanner(strings.NewReader(w.Body.String()))
+	for scanner.Scan() {
+		var progress reindexProgress
+		if err := json.Unmarshal(scanner.Bytes(), &progress); err != nil {
+			t.Fatal(err)
+		}
+		if progress.Error != "" {
+			t.Errorf("%s: %s", progress.Index, progress.Error)
+		}
+		indexes = append(indexes, progress.Index)
+	}
+	if strings.Join(indexes, ",") != strings.Join(reindexIndexes, ",") {
+		t.Errorf("got %v, want %v", indexes, reindexIndexes)
+	}
+
+	// The lock is released afterwards.
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", reindexLockKey).Scan(&locked); err != nil || !locked {
+		t.Errorf("lock not released: %v, %v", locked, err)
+	}
+	conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", reindexLockKey)
+}
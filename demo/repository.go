@@ -0,0 +1,666 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// UserRepository stores users. The user handlers reach the database through
+// userRepo, so that tests can replace it with a fake. Caching, events and
+// request-specific checks are left to the handlers.
+//
+// Batch creation, export and import, statistics and the audit log work on
+// many rows at once and query the database directly.
+type UserRepository interface {
+	// Create inserts u, setting its generated fields, and returns
+	// errEmailTaken if a user already has its email. With upsert, such a
+	// user is renamed and returned in u instead, and inserted is false.
+	Create(ctx context.Context, u *User, upsert bool) (inserted bool, err error)
+	// Get returns a user that hasn't been deleted, or sql.ErrNoRows.
+	Get(ctx context.Context, id int) (User, error)
+	// IDs returns the ids of the users, deleted or not, with the given
+	// UUIDs, omitting UUIDs no user has.
+	IDs(ctx context.Context, uuids []uuid) (map[uuid]int, error)
+	// GetByEmail returns the user that hasn't been deleted with an email,
+	// compared as normalized, or sql.ErrNoRows.
+	GetByEmail(ctx context.Context, email string) (User, error)
+	// EmailExists reports whether a user that hasn't been deleted has an
+	// email, compared as normalized.
+	EmailExists(ctx context.Context, email string) (bool, error)
+	// List returns a page of the users matching f, and how many match in
+	// total, which is -1 if f.AfterID is set.
+	List(ctx context.Context, f userFilter) ([]User, int, error)
+	// Update locks a user, or returns errNotFound, then stores the changes
+	// made to it by update, unless that returns an error. It returns
+	// errEmailTaken if the new email is taken.
+	Update(ctx context.Context, id int, update func(*User) error) (User, error)
+	// SetActive activates or deactivates a user, or returns errNotFound,
+	// auditing the change as made by actor.
+	SetActive(ctx context.Context, id int, active bool, actor string) (User, error)
+	// Delete locks a user, or returns errNotFound, then soft-deletes them
+	// and deletes their addresses, unless check returns an error. It returns
+	// the ids of the deleted addresses.
+	Delete(ctx context.Context, id int, check func(User) error) ([]int, error)
+	// Merge moves the addresses of the user duplicateID to the user id,
+	// except those id already has, then deletes duplicateID, auditing the
+	// merge as made by actor. It returns errNotFound unless both users
+	// exist, and the ids of the moved addresses.
+	Merge(ctx context.Context, id, duplicateID int, actor string) (User, []int, error)
+}
+
+// AddressRepository stores addresses, as UserRepository does users.
+type AddressRepository interface {
+	// Create inserts a at the end of its user's addresses, setting its
+	// generated fields. It fails with a field error if the user doesn't
+	// exist, errDuplicateAddress or errAddressLimit.
+	Create(ctx context.Context, a *Address) error
+	// Get returns an address, or sql.ErrNoRows.
+	Get(ctx context.Context, id int) (Address, error)
+	// IDs returns the ids of the addresses with the given UUIDs, including
+	// deleted addresses that have history, omitting UUIDs no address has.
+	IDs(ctx context.Context, uuids []uuid) (map[uuid]int, error)
+	// List returns a page of the addresses matching f, and how many match in
+	// total.
+	List(ctx context.Context, f addressFilter) ([]Address, int, error)
+	// ListByUsers returns every address of the users, each user's in their
+	// order.
+	ListByUsers(ctx context.Context, userIDs []int) ([]Address, error)
+	// Latest returns a user's most recently created address, or nil if they
+	// have none, and how many addresses they have.
+	Latest(ctx context.Context, userID int) (*Address, int, error)
+	// Update locks an address, or returns errNotFound, then stores the
+	// changes made to it by update, unless that returns an error, recording
+	// them in the address's history as made by actor. It returns
+	// errDuplicateAddress if the user already has the new address.
+	Update(ctx context.Context, id int, actor string, update func(*Address) error) (Address, error)
+	// Reorder locks a user, or returns errNotFound, then orders their
+	// addresses as listed by order, unless check returns an error or order
+	// doesn't list each of them exactly once. It returns the addresses in
+	// their new order.
+	Reorder(ctx context.Context, userID int, order []int, check func(User) error) ([]Address, error)
+	// Delete locks an address, or returns errNotFound, then deletes it,
+	// unless check returns an error.
+	Delete(ctx context.Context, id int, check func(Address) error) error
+}
+
+var (
+	userRepo    UserRepository    = sqlUserRepository{}
+	addressRepo AddressRepository = sqlAddressRepository{}
+)
+
+// userFilter selects the users listed by UserRepository.List.
+type userFilter struct {
+	// Inactive includes inactive users.
+	Inactive bool
+	// Search matches users whose name, or email if emails aren't
+	// encrypted, contains it, ignoring case.
+	Search        string
+	NamePrefix    string
+	EmailContains string
+	Created       timeRange
+	// HasAddresses, if set, selects users with or without addresses.
+	HasAddresses *bool
+	// Countries, if set, selects users with an address in one of them.
+	Countries []string
+	// AfterID, unless it's negative, selects the users by id after it
+	// instead of by Sort and Page.Offset.
+	AfterID int
+	Sort    sortOrder
+	Page    page
+}
+
+// addressFilter selects the addresses listed by AddressRepository.List.
+type addressFilter struct {
+	// UserID, unless it's zero, selects a single user's addresses.
+	UserID int
+	// ActiveUsers selects only the addresses of active users.
+	ActiveUsers bool
+	Countries   []string
+	Created     timeRange
+	Sort        sortOrder
+	Page        page
+}
+
+// sqlUserRepository is the UserRepository of the database.
+type sqlUserRepository struct{}
+
+func (sqlUserRepository) Create(ctx context.Context, u *User, upsert bool) (bool, error) {
+	inserted := true
+	var err error
+	if upsert {
+		err = db.QueryRowContext(ctx,
+			`INSERT INTO users (name, email, email_hash) VALUES ($1, $2, $3)
+			 ON CONFLICT `+emailConflictTarget()+` DO UPDATE SET name = EXCLUDED.name
+			 RETURNING `+userColumns+`, (xmax = 0) AS inserted`,
+			u.Name, storedEmail(u.Email), emailHash(u.Email),
+		).Scan(append(u.fields(), &inserted)...)
+	} else {
+		err = db.QueryRowContext(ctx,
+			"INSERT INTO users (name, email, email_hash) VALUES ($1, $2, $3) RETURNING "+userColumns,
+			u.Name, storedEmail(u.Email), emailHash(u.Email),
+		).Scan(u.fields()...)
+	}
+	if isUniqueViolation(err) {
+		return false, errEmailTaken
+	}
+	return inserted, err
+}
+
+// Get reads from the primary, as fetchUser caches the user.
+func (sqlUserRepository) Get(ctx context.Context, id int) (User, error) {
+	var u User
+	err := primaryQueryRowContext(ctx,
+		"SELECT "+userColumns+" FROM users WHERE id = $1 AND deleted_at IS NULL", id,
+	).Scan(u.fields()...)
+	return u, err
+}
+
+func (sqlUserRepository) IDs(ctx context.Context, uuids []uuid) (map[uuid]int, error) {
+	return lookupUUIDs(ctx, "SELECT uuid, id FROM users WHERE uuid = ANY($1::uuid[])", uuids)
+}
+
+func (sqlUserRepository) GetByEmail(ctx context.Context, email string) (User, error) {
+	var u User
+	match, arg := emailMatch(email, "$1")
+	err := queryRowContext(ctx,
+		"SELECT "+userColumns+" FROM users WHERE "+match+" AND deleted_at IS NULL", arg,
+	).Scan(u.fields()...)
+	return u, err
+}
+
+func (sqlUserRepository) EmailExists(ctx context.Context, email string) (bool, error) {
+	// The user isn't read, so the lookup is answered from an index alone.
+	var exists bool
+	match, arg := emailMatch(email, "$1")
+	err := queryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM users WHERE "+match+" AND deleted_at IS NULL)", arg,
+	).Scan(&exists)
+	return exists, err
+}
+
+func (sqlUserRepository) List(ctx context.Context, f userFilter) ([]User, int, error) {
+	var where whereClause
+	where.and("deleted_at IS NULL")
+	if !f.Inactive {
+		where.and("active")
+	}
+	if f.Search != "" {
+		pattern := where.arg("%" + likeEscape(f.Search) + "%")
+		if emailCipher != nil {
+			// Encrypted emails can only be matched exactly.
+			where.and("name ILIKE " + pattern)
+		} else {
+			where.and("(name ILIKE " + pattern + " OR email ILIKE " + pattern + ")")
+		}
+	}
+	if f.NamePrefix != "" {
+		where.and("name ILIKE " + where.arg(likeEscape(f.NamePrefix)+"%"))
+	}
+	if f.EmailContains != "" {
+		where.and("email ILIKE " + where.arg("%"+likeEscape(f.EmailContains)+"%"))
+	}
+	f.Created.and(&where, "created_at")
+	if f.HasAddresses != nil {
+		exists := "EXISTS (SELECT 1 FROM addresses a WHERE a.user_id = users.id)"
+		if !*f.HasAddresses {
+			exists = "NOT " + exists
+		}
+		where.and(exists)
+	}
+	if len(f.Countries) > 0 {
+		where.and("EXISTS (SELECT 1 FROM addresses a WHERE a.user_id = users.id AND a.country = ANY(" + where.arg(f.Countries) + "))")
+	}
+	var query string
+	total := -1
+	if f.AfterID >= 0 {
+		where.and("id > " + where.arg(f.AfterID))
+		query = "SELECT " + userColumns + " FROM users" + where.String() + " ORDER BY id LIMIT " + where.arg(f.Page.Limit)
+	} else {
+		if err := queryRowContext(ctx, "SELECT count(*) FROM users"+where.String(), where.args...).Scan(&total); err != nil {
+			return nil, 0, err
+		}
+		query = "SELECT " + userColumns + " FROM users" + where.String() + f.Sort.String() +
+			" LIMIT " + where.arg(f.Page.Limit) + " OFFSET " + where.arg(f.Page.Offset)
+	}
+	rows, err := queryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	users, err := scanAll(rows, scanUser)
+	return users, total, err
+}
+
+func (sqlUserRepository) Update(ctx context.Context, id int, update func(*User) error) (User, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+	u, err := lockUser(ctx, tx, id)
+	if err != nil {
+		return u, err
+	}
+	if err := update(&u); err != nil {
+		return u, err
+	}
+	err = tx.QueryRowContext(ctx,
+		"UPDATE users SET name = $2, email = $3, email_hash = $4, updated_at = NOW() WHERE id = $1 RETURNING "+userColumns,
+		id, u.Name, storedEmail(u.Email), emailHash(u.Email),
+	).Scan(u.fields()...)
+	if isUniqueViolation(err) {
+		return u, errEmailTaken
+	}
+	if err != nil {
+		return u, err
+	}
+	return u, tx.Commit()
+}
+
+func (sqlUserRepository) SetActive(ctx context.Context, id int, active bool, actor string) (User, error) {
+	action := "deactivate"
+	if active {
+		action = "activate"
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+	var u User
+	err = tx.QueryRowContext(ctx,
+		"UPDATE users SET active = $2 WHERE id = $1 AND deleted_at IS NULL RETURNING "+userColumns, id, active,
+	).Scan(u.fields()...)
+	if err == sql.ErrNoRows {
+		return u, errNotFound
+	}
+	if err != nil {
+		return u, err
+	}
+	if err := audit(ctx, tx, actor, action, "user", id, nil); err != nil {
+		return u, err
+	}
+	return u, tx.Commit()
+}
+
+func (sqlUserRepository) Delete(ctx context.Context, id int, check func(User) error) ([]int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	u, err := lockUser(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := check(u); err != nil {
+		return nil, err
+	}
+	// Delete the addresses explicitly, rather than by cascade, to learn which
+	// cache entries to invalidate.
+	rows, err := tx.QueryContext(ctx, "DELETE FROM addresses WHERE user_id = $1 RETURNING id", id)
+	if err != nil {
+		return nil, err
+	}
+	addressIDs, err := collectIDs(rows)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET deleted_at = NOW(), updated_at = NOW() WHERE id = $1", id); err != nil {
+		return nil, err
+	}
+	return addressIDs, tx.Commit()
+}
+
+func (sqlUserRepository) Merge(ctx context.Context, id, duplicateID int, actor string) (User, []int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return User{}, nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock both users in a consistent order so concurrent merges can't deadlock.
+	var locked int
+	if err := tx.QueryRowContext(ctx,
+		"SELECT count(*) FROM (SELECT id FROM users WHERE id = ANY($1) AND deleted_at IS NULL ORDER BY id FOR UPDATE) u",
+		[]int{id, duplicateID},
+	).Scan(&locked); err != nil {
+		return User{}, nil, err
+	}
+	if locked != 2 {
+		return User{}, nil, errNotFound
+	}
+	// Drop the duplicate's addresses that the survivor already has, as moving
+	// them would duplicate them. Both users are locked, so none can be added
+	// concurrently.
+	if !cfg.AllowDuplicateAddresses {
+		if _, err := tx.ExecContext(ctx,
+			`DELETE FROM addresses d USING addresses s
+			 WHERE d.user_id = $2 AND s.user_id = $1
+			   AND d.street = s.street AND d.city = s.city AND d.country = s.country`,
+			id, duplicateID,
+		); err != nil {
+			return User{}, nil, err
+		}
+	}
+	rows, err := tx.QueryContext(ctx, "UPDATE addresses SET user_id = $1 WHERE user_id = $2 RETURNING id", id, duplicateID)
+	if err != nil {
+		return User{}, nil, err
+	}
+	moved, err := collectIDs(rows)
+	if err != nil {
+		return User{}, nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM users WHERE id = $1", duplicateID); err != nil {
+		return User{}, nil, err
+	}
+	if err := audit(ctx, tx, actor, "merge", "user", id, map[string]any{
+		"duplicate_id":    duplicateID,
+		"addresses_moved": len(moved),
+	}); err != nil {
+		return User{}, nil, err
+	}
+	var u User
+	if err := tx.QueryRowContext(ctx,
+		"SELECT "+userColumns+" FROM users WHERE id = $1", id,
+	).Scan(u.fields()...); err != nil {
+		return User{}, nil, err
+	}
+	return u, moved, tx.Commit()
+}
+
+// lockUser reads a user for update within tx.
+func lockUser(ctx context.Context, tx *sql.Tx, id int) (User, error) {
+	var u User
+	err := tx.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id).Scan(u.fields()...)
+	if err == sql.ErrNoRows {
+		return u, errNotFound
+	}
+	return u, err
+}
+
+// sqlAddressRepository is the AddressRepository of the database.
+type sqlAddressRepository struct{}
+
+func (sqlAddressRepository) Create(ctx context.Context, a *Address) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Locking the user serializes concurrent creates for it, so the count
+	// below can't be raced past the limit.
+	err = tx.QueryRowContext(ctx, "SELECT id FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", a.UserID).Scan(&a.UserID)
+	if err == sql.ErrNoRows {
+		return fieldErrors{"user_id": "does not exist"}.err()
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkDuplicateAddress(ctx, tx, *a); err != nil {
+		return err
+	}
+	err = tx.QueryRowContext(ctx,
+		// New addresses go last in the user's order. The user lock makes the
+		// position race-free.
+		`INSERT INTO addresses (user_id, street, city, country, postal_code, latitude, longitude, position)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, (SELECT COALESCE(max(position), 0) + 1 FROM addresses WHERE user_id = $1))
+		 RETURNING `+addressColumns,
+		a.UserID, a.Street, a.City, a.Country, a.PostalCode, a.Latitude, a.Longitude,
+	).Scan(a.fields()...)
+	if err != nil {
+		return err
+	}
+	var count int
+	if err := tx.QueryRowContext(ctx, "SELECT count(*) FROM addresses WHERE user_id = $1", a.UserID).Scan(&count); err != nil {
+		return err
+	}
+	if count > cfg.MaxAddressesPerUser {
+		return errAddressLimit
+	}
+	return tx.Commit()
+}
+
+// Get reads from the primary, as getAddress caches the address.
+func (sqlAddressRepository) Get(ctx context.Context, id int) (Address, error) {
+	var a Address
+	err := primaryQueryRowContext(ctx,
+		"SELECT "+addressColumns+" FROM addresses WHERE id = $1", id,
+	).Scan(a.fields()...)
+	return a, err
+}
+
+func (sqlAddressRepository) IDs(ctx context.Context, uuids []uuid) (map[uuid]int, error) {
+	return lookupUUIDs(ctx,
+		`SELECT uuid, id FROM addresses WHERE uuid = ANY($1::uuid[])
+		 UNION SELECT address_uuid, address_id FROM address_history WHERE address_uuid = ANY($1::uuid[])`,
+		uuids,
+	)
+}
+
+func (sqlAddressRepository) List(ctx context.Context, f addressFilter) ([]Address, int, error) {
+	var where whereClause
+	if f.UserID != 0 {
+		where.and("user_id = " + where.arg(f.UserID))
+	}
+	if len(f.Countries) > 0 {
+		where.and("country = ANY(" + where.arg(f.Countries) + ")")
+	}
+	if f.ActiveUsers {
+		where.and("user_id IN (SELECT id FROM users WHERE active)")
+	}
+	f.Created.and(&where, "created_at")
+	var total int
+	if err := queryRowContext(ctx, "SELECT count(*) FROM addresses"+where.String(), where.args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	query := "SELECT " + addressColumns + " FROM addresses" + where.String() + f.Sort.String() +
+		" LIMIT " + where.arg(f.Page.Limit) + " OFFSET " + where.arg(f.Page.Offset)
+	rows, err := queryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	addresses, err := scanAll(rows, scanAddress)
+	return addresses, total, err
+}
+
+func (sqlAddressRepository) ListByUsers(ctx context.Context, userIDs []int) ([]Address, error) {
+	rows, err := queryContext(ctx,
+		"SELECT "+addressColumns+" FROM addresses WHERE user_id = ANY($1) ORDER BY position, id", userIDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanAll(rows, scanAddress)
+}
+
+func (sqlAddressRepository) Latest(ctx context.Context, userID int) (*Address, int, error) {
+	var a Address
+	var count int
+	err := queryRowContext(ctx,
+		"SELECT count(*) OVER (), "+addressColumns+" FROM addresses WHERE user_id = $1 ORDER BY created_at DESC, id DESC LIMIT 1", userID,
+	).Scan(append([]any{&count}, a.fields()...)...)
+	if err == sql.ErrNoRows {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return &a, count, nil
+}
+
+func (sqlAddressRepository) Update(ctx context.Context, id int, actor string, update func(*Address) error) (Address, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Address{}, err
+	}
+	defer tx.Rollback()
+	a, err := lockAddressAndUser(ctx, tx, id)
+	if err != nil {
+		return a, err
+	}
+	before := a
+	if err := update(&a); err != nil {
+		return a, err
+	}
+	if err := checkDuplicateAddress(ctx, tx, a); err != nil {
+		return a, err
+	}
+	// Every field is written by one statement, so the address is never seen
+	// partially updated.
+	err = tx.QueryRowContext(ctx,
+		`UPDATE addresses SET street = $2, city = $3, country = $4, postal_code = $5, latitude = $6, longitude = $7,
+		   updated_at = NOW()
+		 WHERE id = $1 RETURNING `+addressColumns,
+		id, a.Street, a.City, a.Country, a.PostalCode, a.Latitude, a.Longitude,
+	).Scan(a.fields()...)
+	if err != nil {
+		return a, err
+	}
+	if err := recordAddressChanges(ctx, tx, actor, before, a); err != nil {
+		return a, err
+	}
+	return a, tx.Commit()
+}
+
+func (sqlAddressRepository) Reorder(ctx context.Context, userID int, order []int, check func(User) error) ([]Address, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	u, err := lockUser(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := check(u); err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM addresses WHERE user_id = $1 FOR UPDATE", userID)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := collectIDs(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAddressOrder(order, ids); err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx,
+		`UPDATE addresses SET position = o.position
+		 FROM unnest($1::int[]) WITH ORDINALITY AS o(id, position) WHERE addresses.id = o.id`,
+		order,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rows, err = tx.QueryContext(ctx, "SELECT "+addressColumns+" FROM addresses WHERE user_id = $1 ORDER BY position, id", userID)
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := scanAll(rows, scanAddress)
+	if err != nil {
+		return nil, err
+	}
+	return addresses, tx.Commit()
+}
+
+func (sqlAddressRepository) Delete(ctx context.Context, id int, check func(Address) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	a, err := lockAddress(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if err := check(a); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM addresses WHERE id = $1", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// lockAddress reads an address for update within tx.
+func lockAddress(ctx context.Context, tx *sql.Tx, id int) (Address, error) {
+	var a Address
+	err := tx.QueryRowContext(ctx, "SELECT "+addressColumns+" FROM addresses WHERE id = $1 FOR UPDATE", id).Scan(a.fields()...)
+	if err == sql.ErrNoRows {
+		return a, errNotFound
+	}
+	return a, err
+}
+
+// lockAddressAndUser is lockAddress, but first locks the address's user, as
+// creating an address, deleting a user and merging users do, so that checks
+// across the user's addresses are race-free and can't deadlock with them.
+func lockAddressAndUser(ctx context.Context, tx *sql.Tx, id int) (Address, error) {
+	var userID int
+	err := tx.QueryRowContext(ctx,
+		"SELECT u.id FROM users u JOIN addresses a ON a.user_id = u.id WHERE a.id = $1 FOR UPDATE OF u", id,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return Address{}, errNotFound
+	}
+	if err != nil {
+		return Address{}, err
+	}
+	a, err := lockAddress(ctx, tx, id)
+	if err == nil && a.UserID != userID {
+		// A merge moved the address to another user while waiting for the
+		// lock.
+		return a, errAddressMoved
+	}
+	return a, err
+}
+
+// checkDuplicateAddress returns errDuplicateAddress if a's user has another
+// address with the same street, city and country, unless
+// cfg.AllowDuplicateAddresses is set. The user must be locked by tx, so that
+// the duplicate can't be added concurrently after the check.
+func checkDuplicateAddress(ctx context.Context, tx *sql.Tx, a Address) error {
+	if cfg.AllowDuplicateAddresses {
+		return nil
+	}
+	var exists bool
+	err := tx.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM addresses
+		 WHERE user_id = $1 AND street = $2 AND city = $3 AND country = $4 AND id <> $5)`,
+		a.UserID, a.Street, a.City, a.Country, a.ID,
+	).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errDuplicateAddress
+	}
+	return nil
+}
+
+// lookupUUIDs runs query, which selects the UUIDs and ids of the rows with
+// the UUIDs in its argument. It reads from the primary, so that rows just
+// created are found.
+func lookupUUIDs(ctx context.Context, query string, uuids []uuid) (map[uuid]int, error) {
+	var rows *sql.Rows
+	err := retry(ctx, func() (err error) {
+		rows, err = db.QueryContext(ctx, query, uuidStrings(uuids))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make(map[uuid]int, len(uuids))
+	for rows.Next() {
+		var u uuid
+		var id int
+		if err := rows.Scan(&u, &id); err != nil {
+			return nil, err
+		}
+		ids[u] = id
+	}
+	return ids, rows.Err()
+}
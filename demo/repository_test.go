@@ -0,0 +1,690 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore holds the users and addresses of the in-memory repositories,
+// which behave like the database ones for the handlers' purposes.
+type memoryStore struct {
+	mu        sync.Mutex
+	lastID    int
+	users     map[int]User
+	deleted   map[int]bool
+	addresses map[int]Address
+	// positions orders each user's addresses.
+	positions map[int]int
+}
+
+type (
+	memoryUsers     struct{ *memoryStore }
+	memoryAddresses struct{ *memoryStore }
+)
+
+// useMemoryRepositories replaces the repositories with empty in-memory ones
+// for the duration of the test. Their ids and UUIDs are only unique to the
+// store, so cached UUIDs are dropped.
+func useMemoryRepositories(t *testing.T) *memoryStore {
+	t.Helper()
+	savedUsers, savedAddresses, savedCache, savedIDs := userRepo, addressRepo, userCache, idCache
+	t.Cleanup(func() { userRepo, addressRepo, userCache, idCache = savedUsers, savedAddresses, savedCache, savedIDs })
+	idCache = newLRUCache[collectionUUID, int](idCacheSize, 0)
+	s := &memoryStore{
+		users:     map[int]User{},
+		deleted:   map[int]bool{},
+		addresses: map[int]Address{},
+		positions: map[int]int{},
+	}
+	userRepo, addressRepo, userCache = memoryUsers{s}, memoryAddresses{s}, nil
+	return s
+}
+
+func (s *memoryStore) nextID() int {
+	s.lastID++
+	return s.lastID
+}
+
+// uuidOf returns the UUID of the row with id. Users and addresses share ids,
+// so it's unique to the row.
+func (s *memoryStore) uuidOf(id int) uuid {
+	var u uuid
+	u[6] = 0x40
+	binary.BigEndian.PutUint64(u[8:], uint64(id))
+	return u
+}
+
+// now returns the current time as the database stores it.
+func (s *memoryStore) now() timestamp {
+	return timestamp{time.Now().UTC().Truncate(time.Microsecond)}
+}
+
+// liveUser returns a user that hasn't been deleted.
+func (s *memoryStore) liveUser(id int) (User, bool) {
+	u, ok := s.users[id]
+	return u, ok && !s.deleted[id]
+}
+
+// userWithEmail returns the live user with email, if any, other than id.
+func (s *memoryStore) userWithEmail(email string, id int) (User, bool) {
+	for _, u := range s.users {
+		if u.ID != id && !s.deleted[u.ID] && strings.EqualFold(u.Email, email) {
+			return u, true
+		}
+	}
+	return User{}, false
+}
+
+// addressesOf returns a user's addresses in their order.
+func (s *memoryStore) addressesOf(userID int) []Address {
+	var addresses []Address
+	for _, a := range s.addresses {
+		if a.UserID == userID {
+			addresses = append(addresses, a)
+		}
+	}
+	slices.SortFunc(addresses, func(a, b Address) int {
+		return cmp.Or(cmp.Compare(s.positions[a.ID], s.positions[b.ID]), cmp.Compare(a.ID, b.ID))
+	})
+	return addresses
+}
+
+func (s memoryUsers) Create(_ context.Context, u *User, upsert bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.userWithEmail(u.Email, 0); ok {
+		if !upsert {
+			return false, errEmailTaken
+		}
+		existing.Name = u.Name
+		s.users[existing.ID] = existing
+		*u = existing
+		return false, nil
+	}
+	u.ID, u.Active = s.nextID(), true
+	u.UUID = s.uuidOf(u.ID)
+	u.CreatedAt, u.UpdatedAt = s.now(), s.now()
+	s.users[u.ID] = *u
+	return true, nil
+}
+
+func (s memoryUsers) Get(_ context.Context, id int) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.liveUser(id)
+	if !ok {
+		return User{}, sql.ErrNoRows
+	}
+	return u, nil
+}
+
+func (s memoryUsers) IDs(_ context.Context, uuids []uuid) (map[uuid]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := map[uuid]int{}
+	for _, u := range s.users {
+		if slices.Contains(uuids, u.UUID) {
+			ids[u.UUID] = u.ID
+		}
+	}
+	return ids, nil
+}
+
+func (s memoryUsers) GetByEmail(_ context.Context, email string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.userWithEmail(email, 0)
+	if !ok {
+		return User{}, sql.ErrNoRows
+	}
+	return u, nil
+}
+
+func (s memoryUsers) EmailExists(_ context.Context, email string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.userWithEmail(email, 0)
+	return ok, nil
+}
+
+func (s memoryUsers) List(_ context.Context, f userFilter) ([]User, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	contains := func(s, substr string) bool { return strings.Contains(strings.ToLower(s), strings.ToLower(substr)) }
+	users := []User{}
+	for _, u := range s.users {
+		countries := map[string]bool{}
+		for _, a := range s.addresses {
+			if a.UserID == u.ID {
+				countries[a.Country] = true
+			}
+		}
+		switch {
+		case s.deleted[u.ID], !u.Active && !f.Inactive:
+		case f.Search != "" && !contains(u.Name, f.Search) && !contains(u.Email, f.Search):
+		case !strings.HasPrefix(strings.ToLower(u.Name), strings.ToLower(f.NamePrefix)):
+		case !contains(u.Email, f.EmailContains):
+		case !f.Created.contains(u.CreatedAt.Time):
+		case f.HasAddresses != nil && *f.HasAddresses != (len(countries) > 0):
+		case len(f.Countries) > 0 && !slices.ContainsFunc(f.Countries, func(c string) bool { return countries[c] }):
+		case f.AfterID >= 0 && u.ID <= f.AfterID:
+		default:
+			users = append(users, u)
+		}
+	}
+	if f.AfterID >= 0 {
+		slices.SortFunc(users, func(a, b User) int { return cmp.Compare(a.ID, b.ID) })
+		return users[:min(len(users), f.Page.Limit)], -1, nil
+	}
+	slices.SortFunc(users, func(a, b User) int {
+		var c int
+		switch f.Sort.Column {
+		case "name":
+			c = strings.Compare(a.Name, b.Name)
+		case "email":
+			c = strings.Compare(a.Email, b.Email)
+		case "created_at":
+			c = a.CreatedAt.Compare(b.CreatedAt.Time)
+		}
+		return sortResult(f.Sort, c, a.ID, b.ID)
+	})
+	return pageOf(users, f.Page), len(users), nil
+}
+
+func (s memoryUsers) Update(_ context.Context, id int, update func(*User) error) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.liveUser(id)
+	if !ok {
+		return u, errNotFound
+	}
+	if err := update(&u); err != nil {
+		return u, err
+	}
+	if _, ok := s.userWithEmail(u.Email, id); ok {
+		return u, errEmailTaken
+	}
+	u.ID, u.UpdatedAt = id, s.now()
+	s.users[id] = u
+	return u, nil
+}
+
+func (s memoryUsers) SetActive(_ context.Context, id int, active bool, _ string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.liveUser(id)
+	if !ok {
+		return u, errNotFound
+	}
+	u.Active = active
+	s.users[id] = u
+	return u, nil
+}
+
+func (s memoryUsers) Delete(_ context.Context, id int, check func(User) error) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.liveUser(id)
+	if !ok {
+		return nil, errNotFound
+	}
+	if err := check(u); err != nil {
+		return nil, err
+	}
+	var addressIDs []int
+	for _, a := range s.addresses {
+		if a.UserID == id {
+			addressIDs = append(addressIDs, a.ID)
+			delete(s.addresses, a.ID)
+		}
+	}
+	s.deleted[id] = true
+	return addressIDs, nil
+}
+
+func (s memoryUsers) Merge(_ context.Context, id, duplicateID int, _ string) (User, []int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.liveUser(id)
+	if _, dupOK := s.liveUser(duplicateID); !ok || !dupOK {
+		return User{}, nil, errNotFound
+	}
+	var moved []int
+	for _, a := range s.addresses {
+		if a.UserID != duplicateID {
+			continue
+		}
+		a.UserID, a.UserUUID = id, u.UUID
+		if s.checkDuplicate(a) != nil {
+			delete(s.addresses, a.ID)
+			continue
+		}
+		s.addresses[a.ID] = a
+		moved = append(moved, a.ID)
+	}
+	delete(s.users, duplicateID)
+	return u, moved, nil
+}
+
+// checkDuplicate fails with errDuplicateAddress if a's user has another
+// address with the same street, city and country, unless
+// cfg.AllowDuplicateAddresses is set.
+func (s *memoryStore) checkDuplicate(a Address) error {
+	if cfg.AllowDuplicateAddresses {
+		return nil
+	}
+	for _, other := range s.addresses {
+		if other.ID != a.ID && other.UserID == a.UserID && other.Street == a.Street && other.City == a.City && other.Country == a.Country {
+			return errDuplicateAddress
+		}
+	}
+	return nil
+}
+
+func (s memoryAddresses) Create(_ context.Context, a *Address) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.liveUser(a.UserID); !ok {
+		return fieldErrors{"user_id": "does not exist"}.err()
+	}
+	if err := s.checkDuplicate(*a); err != nil {
+		return err
+	}
+	existing := s.addressesOf(a.UserID)
+	if len(existing) >= cfg.MaxAddressesPerUser {
+		return errAddressLimit
+	}
+	position := 0
+	if len(existing) > 0 {
+		position = s.positions[existing[len(existing)-1].ID]
+	}
+	a.ID = s.nextID()
+	a.UUID, a.UserUUID = s.uuidOf(a.ID), s.users[a.UserID].UUID
+	a.CreatedAt, a.UpdatedAt = s.now(), s.now()
+	s.addresses[a.ID] = *a
+	s.positions[a.ID] = position + 1
+	return nil
+}
+
+func (s memoryAddresses) Get(_ context.Context, id int) (Address, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.addresses[id]
+	if !ok {
+		return a, sql.ErrNoRows
+	}
+	return a, nil
+}
+
+func (s memoryAddresses) IDs(_ context.Context, uuids []uuid) (map[uuid]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := map[uuid]int{}
+	for _, a := range s.addresses {
+		if slices.Contains(uuids, a.UUID) {
+			ids[a.UUID] = a.ID
+		}
+	}
+	return ids, nil
+}
+
+func (s memoryAddresses) List(_ context.Context, f addressFilter) ([]Address, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addresses := []Address{}
+	for _, a := range s.addresses {
+		switch {
+		case f.UserID != 0 && a.UserID != f.UserID:
+		case len(f.Countries) > 0 && !slices.Contains(f.Countries, a.Country):
+		case f.ActiveUsers && !s.users[a.UserID].Active:
+		case !f.Created.contains(a.CreatedAt.Time):
+		default:
+			addresses = append(addresses, a)
+		}
+	}
+	slices.SortFunc(addresses, func(a, b Address) int {
+		var c int
+		switch f.Sort.Column {
+		case "position":
+			c = cmp.Compare(s.positions[a.ID], s.positions[b.ID])
+		case "street":
+			c = strings.Compare(a.Street, b.Street)
+		case "city":
+			c = strings.Compare(a.City, b.City)
+		case "country":
+			c = strings.Compare(a.Country, b.Country)
+		case "created_at":
+			c = a.CreatedAt.Compare(b.CreatedAt.Time)
+		}
+		return sortResult(f.Sort, c, a.ID, b.ID)
+	})
+	return pageOf(addresses, f.Page), len(addresses), nil
+}
+
+func (s memoryAddresses) ListByUsers(_ context.Context, userIDs []int) ([]Address, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addresses []Address
+	for _, id := range userIDs {
+		addresses = append(addresses, s.addressesOf(id)...)
+	}
+	return addresses, nil
+}
+
+func (s memoryAddresses) Latest(_ context.Context, userID int) (*Address, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addresses := s.addressesOf(userID)
+	if len(addresses) == 0 {
+		return nil, 0, nil
+	}
+	latest := slices.MaxFunc(addresses, func(a, b Address) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt.Time), cmp.Compare(a.ID, b.ID))
+	})
+	return &latest, len(addresses), nil
+}
+
+func (s memoryAddresses) Update(_ context.Context, id int, _ string, update func(*Address) error) (Address, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.addresses[id]
+	if !ok {
+		return a, errNotFound
+	}
+	if err := update(&a); err != nil {
+		return a, err
+	}
+	if err := s.checkDuplicate(a); err != nil {
+		return a, err
+	}
+	a.UpdatedAt = s.now()
+	s.addresses[id] = a
+	return a, nil
+}
+
+func (s memoryAddresses) Reorder(_ context.Context, userID int, order []int, check func(User) error) ([]Address, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.liveUser(userID)
+	if !ok {
+		return nil, errNotFound
+	}
+	if err := check(u); err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, a := range s.addressesOf(userID) {
+		ids = append(ids, a.ID)
+	}
+	if err := checkAddressOrder(order, ids); err != nil {
+		return nil, err
+	}
+	for i, id := range order {
+		s.positions[id] = i + 1
+	}
+	return s.addressesOf(userID), nil
+}
+
+func (s memoryAddresses) Delete(_ context.Context, id int, check func(Address) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.addresses[id]
+	if !ok {
+		return errNotFound
+	}
+	if err := check(a); err != nil {
+		return err
+	}
+	delete(s.addresses, id)
+	return nil
+}
+
+// sortResult orders two rows as s does, given the comparison of its column
+// and their ids, which break ties.
+func sortResult(s sortOrder, c int, a, b int) int {
+	if c == 0 {
+		c = cmp.Compare(a, b)
+	}
+	if s.Desc {
+		return -c
+	}
+	return c
+}
+
+// pageOf returns the page p of items.
+func pageOf[T any](items []T, p page) []T {
+	start := min(p.Offset, len(items))
+	return items[start:min(start+p.Limit, len(items))]
+}
+
+// callHandler calls h with a request for method and target, with an optional
+// JSON body and path values given as name, value pairs.
+func callHandler(h http.HandlerFunc, method, target, body string, pathValues ...string) *httptest.ResponseRecorder {
+	r := jsonRequest(method, target, body)
+	for i := 0; i+1 < len(pathValues); i += 2 {
+		r.SetPathValue(pathValues[i], pathValues[i+1])
+	}
+	return serve(h, r)
+}
+
+// responseAs decodes a JSON response body.
+func responseAs[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body, err)
+	}
+	return v
+}
+
+func TestUserHandlersWithMemoryRepository(t *testing.T) {
+	useMemoryRepositories(t)
+	create := func(name, email string) User {
+		t.Helper()
+		w := callHandler(createUser, "POST", "/users", `{"name": "`+name+`", "email": "`+email+`"}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create %s: got %d %s", name, w.Code, w.Body)
+		}
+		return responseAs[User](t, w)
+	}
+
+	ada := create("Ada", "Ada@Example.com")
+	if ada.Email != "ada@example.com" || !ada.Active {
+		t.Errorf("created %+v", ada)
+	}
+	w := callHandler(createUser, "POST", "/users", `{"name": "Other Ada", "email": "ada@example.com"}`)
+	if w.Code != http.StatusConflict || responseAs[errorBody](t, w).Error.Code != "email_taken" {
+		t.Errorf("duplicate email: got %d %s", w.Code, w.Body)
+	}
+	bob := create("Bob", "bob@example.com")
+	id := strconv.Itoa(ada.ID)
+
+	w = callHandler(listUsers, "GET", "/users?q=bo", "")
+	if got := responseAs[[]User](t, w); len(got) != 1 || got[0].ID != bob.ID {
+		t.Errorf("search: got %d %s", w.Code, w.Body)
+	}
+	w = callHandler(listUsers, "GET", "/users?sort=-name", "")
+	if got := responseAs[[]User](t, w); len(got) != 2 || got[0].ID != bob.ID || w.Header().Get("X-Total-Count") != "2" {
+		t.Errorf("sorted: got %d %s", w.Code, w.Body)
+	}
+	w = callHandler(getUserByEmail, "GET", "/users/by-email/ADA@example.com", "", "email", "ADA@example.com")
+	if w.Code != http.StatusOK || responseAs[User](t, w).ID != ada.ID {
+		t.Errorf("by email: got %d %s", w.Code, w.Body)
+	}
+	for email, want := range map[string]int{"bob@example.com": http.StatusOK, "carol@example.com": http.StatusNotFound} {
+		if w := callHandler(checkEmailExists, "HEAD", "/users/by-email/"+email, "", "email", email); w.Code != want {
+			t.Errorf("HEAD %s: got %d, want %d", email, w.Code, want)
+		}
+	}
+
+	w = callHandler(updateUser, "PATCH", "/users/"+id, `{"name": "Ada Lovelace"}`, "id", id)
+	if w.Code != http.StatusOK || responseAs[User](t, w).Name != "Ada Lovelace" {
+		t.Errorf("update: got %d %s", w.Code, w.Body)
+	}
+	w = callHandler(updateUser, "PATCH", "/users/"+id, `{"email": "BOB@example.com"}`, "id", id)
+	if w.Code != http.StatusConflict || responseAs[errorBody](t, w).Error.Code != "email_taken" {
+		t.Errorf("update to a taken email: got %d %s", w.Code, w.Body)
+	}
+	w = callHandler(updateUser, "PATCH", "/users/999", `{"name": "Nobody"}`, "id", "999")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("update missing user: got %d %s", w.Code, w.Body)
+	}
+
+	w = callHandler(setUserActive(false), "POST", "/users/"+id+"/deactivate", "", "id", id)
+	if w.Code != http.StatusOK || responseAs[User](t, w).Active {
+		t.Errorf("deactivate: got %d %s", w.Code, w.Body)
+	}
+	w = callHandler(listUsers, "GET", "/users", "")
+	if got := responseAs[[]User](t, w); len(got) != 1 || got[0].ID != bob.ID {
+		t.Errorf("list without the inactive user: got %d %s", w.Code, w.Body)
+	}
+	// Writes are hidden from non-admins as reads are.
+	if w := callHandler(updateUser, "PATCH", "/users/"+id, `{"name": "Ada"}`, "id", id); w.Code != http.StatusNotFound {
+		t.Errorf("update inactive: got %d %s", w.Code, w.Body)
+	}
+	callHandler(setUserActive(true), "POST", "/users/"+id+"/activate", "", "id", id)
+
+	w = callHandler(deleteUser, "DELETE", "/users/"+id, "", "id", id)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete: got %d %s", w.Code, w.Body)
+	}
+	if _, err := userRepo.Get(t.Context(), ada.ID); err != sql.ErrNoRows {
+		t.Errorf("get after delete: got %v", err)
+	}
+	// The email is free again.
+	create("Ada", "ada@example.com")
+}
+
+func TestAddressHandlersWithMemoryRepository(t *testing.T) {
+	setConfig(t, func(c *config) {
+		c.MaxAddressesPerUser = 3
+		c.AllowDuplicateAddresses = false
+	})
+	useMemoryRepositories(t)
+	u := User{Name: "Ada", Email: "ada@example.com"}
+	if _, err := userRepo.Create(t.Context(), &u, false); err != nil {
+		t.Fatal(err)
+	}
+	userID := strconv.Itoa(u.ID)
+	create := func(street, city, country string) Address {
+		t.Helper()
+		w := callHandler(createAddress, "POST", "/addresses",
+			`{"user_id": `+userID+`, "street": "`+street+`", "city": "`+city+`", "country": "`+country+`"}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create %s: got %d %s", street, w.Code, w.Body)
+		}
+		return responseAs[Address](t, w)
+	}
+
+	w := callHandler(createAddress, "POST", "/addresses", `{"user_id": 999, "street": "1 Main St", "city": "Springfield", "country": "US"}`)
+	if w.Code != http.StatusUnprocessableEntity || responseAs[errorBody](t, w).Error.Fields["user_id"] == "" {
+		t.Errorf("missing user: got %d %s", w.Code, w.Body)
+	}
+	home := create("1 Main St", "Springfield", "US")
+	w = callHandler(createAddress, "POST", "/addresses", `{"user_id": `+userID+`, "street": "1 Main St", "city": "Springfield", "country": "us"}`)
+	if w.Code != http.StatusConflict || responseAs[errorBody](t, w).Error.Code != "duplicate_address" {
+		t.Errorf("duplicate: got %d %s", w.Code, w.Body)
+	}
+	work := create("10 Downing St", "London", "GB")
+	holiday := create("1 Rue de Rivoli", "Paris", "FR")
+	w = callHandler(createAddress, "POST", "/addresses", `{"user_id": `+userID+`, "street": "1 Unter den Linden", "city": "Berlin", "country": "DE"}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("over the limit: got %d %s", w.Code, w.Body)
+	}
+
+	w = callHandler(listAddresses, "GET", "/addresses?country=GB", "")
+	if got := responseAs[[]Address](t, w); len(got) != 1 || got[0].ID != work.ID {
+		t.Errorf("by country: got %d %s", w.Code, w.Body)
+	}
+	if latest, count, err := addressRepo.Latest(t.Context(), u.ID); err != nil || count != 3 || latest == nil || latest.ID != holiday.ID {
+		t.Errorf("latest: got %+v, %d, %v", latest, count, err)
+	}
+
+	order := `[` + strconv.Itoa(holiday.ID) + `, ` + strconv.Itoa(home.ID) + `, ` + strconv.Itoa(work.ID) + `]`
+	w = callHandler(reorderUserAddresses, "PUT", "/users/"+userID+"/addresses/order", order, "id", userID)
+	if got := responseAs[[]Address](t, w); w.Code != http.StatusOK || len(got) != 3 || got[0].ID != holiday.ID {
+		t.Errorf("reorder: got %d %s", w.Code, w.Body)
+	}
+	w = callHandler(reorderUserAddresses, "PUT", "/users/"+userID+"/addresses/order", `[`+strconv.Itoa(home.ID)+`]`, "id", userID)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("partial reorder: got %d %s", w.Code, w.Body)
+	}
+	if got, err := addressRepo.ListByUsers(t.Context(), []int{u.ID}); err != nil || len(got) != 3 || got[0].ID != holiday.ID || got[2].ID != work.ID {
+		t.Errorf("list in order: got %+v, %v", got, err)
+	}
+
+	homeID := strconv.Itoa(home.ID)
+	w = callHandler(updateAddress, "PATCH", "/addresses/"+homeID, `{"postal_code": "SW1A 2AA"}`, "id", homeID)
+	if w.Code != http.StatusUnprocessableEntity || responseAs[errorBody](t, w).Error.Fields["postal_code"] == "" {
+		t.Errorf("postal code for another country: got %d %s", w.Code, w.Body)
+	}
+	w = callHandler(updateAddress, "PATCH", "/addresses/"+homeID, `{"street": "10 Downing St", "city": "London", "country": "GB"}`, "id", homeID)
+	if w.Code != http.StatusConflict {
+		t.Errorf("update to a duplicate: got %d %s", w.Code, w.Body)
+	}
+	w = callHandler(updateAddress, "PATCH", "/addresses/"+homeID, `{"postal_code": "62704"}`, "id", homeID)
+	if w.Code != http.StatusOK || responseAs[Address](t, w).PostalCode != "62704" {
+		t.Errorf("update: got %d %s", w.Code, w.Body)
+	}
+
+	r := httptest.NewRequest("DELETE", "/addresses/"+homeID, nil)
+	r.SetPathValue("id", homeID)
+	r.Header.Set("If-Unmodified-Since", home.CreatedAt.Add(-time.Hour).UTC().Format(http.TimeFormat))
+	w = httptest.NewRecorder()
+	if deleteAddress(w, r); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale delete: got %d %s", w.Code, w.Body)
+	}
+	if w := callHandler(deleteAddress, "DELETE", "/addresses/"+homeID, "", "id", homeID); w.Code != http.StatusNoContent {
+		t.Errorf("delete: got %d %s", w.Code, w.Body)
+	}
+	if _, err := addressRepo.Get(t.Context(), home.ID); err != sql.ErrNoRows {
+		t.Errorf("get after delete: got %v", err)
+	}
+}
+
+func TestMergeUsersWithMemoryRepository(t *testing.T) {
+	s := useMemoryRepositories(t)
+	ctx := t.Context()
+	ada, duplicate := User{Name: "Ada", Email: "ada@example.com"}, User{Name: "Ada", Email: "ada@example.org"}
+	for _, u := range []*User{&ada, &duplicate} {
+		if _, err := userRepo.Create(ctx, u, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, a := range []Address{
+		{UserID: ada.ID, Street: "1 Main St", City: "Springfield", Country: "US"},
+		{UserID: duplicate.ID, Street: "1 Main St", City: "Springfield", Country: "US"},
+		{UserID: duplicate.ID, Street: "10 Downing St", City: "London", Country: "GB"},
+	} {
+		if err := addressRepo.Create(ctx, &a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id := strconv.Itoa(ada.ID)
+	w := callHandler(mergeUsers, "POST", "/users/"+id+"/merge", `{"duplicate_id": `+strconv.Itoa(duplicate.ID)+`}`, "id", id)
+	if w.Code != http.StatusOK {
+		t.Fatalf("merge: got %d %s", w.Code, w.Body)
+	}
+	if _, ok := s.liveUser(duplicate.ID); ok {
+		t.Error("duplicate still exists")
+	}
+	if got := s.addressesOf(ada.ID); len(got) != 2 {
+		t.Errorf("addresses after merge: %+v", got)
+	}
+	w = callHandler(mergeUsers, "POST", "/users/"+id+"/merge", `{"duplicate_id": `+strconv.Itoa(duplicate.ID)+`}`, "id", id)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("merge a missing duplicate: got %d %s", w.Code, w.Body)
+	}
+}
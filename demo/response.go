@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// apiError is an error with enough detail to render either of the supported
+// error formats.
+//
+// Client errors use 400 Bad Request when the request can't be parsed:
+// malformed JSON, JSON values of the wrong type, and unparseable path or query
+// parameters. Requests that parse but are semantically invalid, such as a bad
+// email address or a reference to a missing user, use 422 Unprocessable
+// Entity.
+type apiError struct {
+	// Status is the HTTP status code.
+	Status int
+	// Code is a stable, machine-readable identifier such as "not_found".
+	Code string
+	// Message is a human-readable explanation specific to this occurrence.
+	Message string
+	// Fields maps invalid request fields to what is wrong with them.
+	Fields map[string]string
+}
+
+func newError(status int, code, message string) *apiError {
+	return &apiError{Status: status, Code: code, Message: message}
+}
+
+func (e *apiError) Error() string { return e.Message }
+
+var (
+	errNotFound           = newError(http.StatusNotFound, "not_found", "not found")
+	errInvalidID          = newError(http.StatusBadRequest, "invalid_id", "invalid id")
+	errAddressLimit       = newError(http.StatusUnprocessableEntity, "address_limit_reached", "the user has the maximum number of addresses")
+	errDuplicateAddress   = newError(http.StatusConflict, "duplicate_address", "the user already has this address")
+	errAddressMoved       = newError(http.StatusConflict, "address_moved", "the address was moved to another user; retry the request")
+	errPreconditionFailed = newError(http.StatusPreconditionFailed, "precondition_failed", "the resource has been modified since If-Unmodified-Since")
+	errEmailTaken         = newError(http.StatusConflict, "email_taken", "a user with this email already exists")
+	errEmptyBody          = newError(http.StatusBadRequest, "empty_body", "request body is required")
+	errTooDeep            = newError(http.StatusBadRequest, "json_too_deep", "JSON nesting is too deep")
+	errInternal           = newError(http.StatusInternalServerError, "internal", "internal server error")
+	errUnsupportedType    = newError(http.StatusUnsupportedMediaType, "unsupported_media_type", "Content-Type must be application/json or application/x-www-form-urlencoded")
+)
+
+// Values of cfg.ErrorDetail.
+const (
+	// errorDetailMinimal gives clients only a generic message for internal
+	// errors.
+	errorDetailMinimal = "minimal"
+	// errorDetailVerbose adds the underlying error, and its SQLSTATE if it
+	// came from Postgres. It is meant for debugging outside production.
+	errorDetailVerbose = "verbose"
+)
+
+// errorBody is the default error format:
+//
+//	{"error": {"code": "not_found", "message": "not found"}}
+type errorBody struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	// RequestID correlates the error with the server's logs.
+	RequestID string `json:"request_id"`
+	// Detail and SQLState describe internal errors when cfg.ErrorDetail is
+	// verbose.
+	Detail   string `json:"detail,omitempty"`
+	SQLState string `json:"sqlstate,omitempty"`
+}
+
+// problemDetails is the RFC 7807 error format, used when the client accepts
+// application/problem+json.
+type problemDetails struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance"`
+	// Errors is an extension member carrying apiError.Fields.
+	Errors map[string]string `json:"errors,omitempty"`
+	// RequestID and SQLState are extension members as in errorDetail.
+	RequestID string `json:"request_id"`
+	SQLState  string `json:"sqlstate,omitempty"`
+}
+
+// writeError responds with err, which is reported as an internal error unless
+// it is an *apiError. What an internal error was is only logged, unless
+// cfg.ErrorDetail is verbose.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var apiErr *apiError
+	var detail, sqlState string
+	if errors.Is(err, context.DeadlineExceeded) {
+		apiErr = errTimeout
+	} else if isStatementTimeout(err) {
+		log.Printf("%s %s request_id=%s: %v", r.Method, r.URL.Path, requestID(r), err)
+		w.Header().Set("Retry-After", strconv.Itoa(int(queryTimeoutRetryAfter.Seconds())))
+		apiErr = errQueryTimeout
+	} else if !errors.As(err, &apiErr) {
+		log.Printf("%s %s request_id=%s: %v", r.Method, r.URL.Path, requestID(r), err)
+		apiErr = errInternal
+		if cfg.ErrorDetail == errorDetailVerbose {
+			detail = err.Error()
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) {
+				sqlState = pgErr.Code
+			}
+		}
+	}
+	if acceptsProblemJSON(r) {
+		if detail == "" {
+			detail = apiErr.Message
+		}
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(apiErr.Status)
+		json.NewEncoder(w).Encode(problemDetails{
+			Type:      "urn:proctor-demo:problem:" + apiErr.Code,
+			Title:     http.StatusText(apiErr.Status),
+			Status:    apiErr.Status,
+			Detail:    detail,
+			Instance:  r.URL.Path,
+			Errors:    apiErr.Fields,
+			RequestID: requestID(r),
+			SQLState:  sqlState,
+		})
+		return
+	}
+	writeJSON(w, apiErr.Status, errorBody{Error: errorDetail{
+		Code:      apiErr.Code,
+		Message:   apiErr.Message,
+		Fields:    apiErr.Fields,
+		RequestID: requestID(r),
+		Detail:    detail,
+		SQLState:  sqlState,
+	}})
+}
+
+func acceptsProblemJSON(r *http.Request) bool {
+	for accept := range strings.SplitSeq(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accept); err == nil && mediaType == "application/problem+json" {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeJSON decodes the request body, which must be a single JSON value, into
+// v. Fields v doesn't have are ignored.
+//
+// Numbers are decoded as json.Number rather than float64, so that integer
+// fields can reject fractional values with fieldErrors.integer instead of
+// silently truncating them.
+//
+// Bodies nested more than cfg.MaxJSONDepth deep are rejected.
+func decodeJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(newDepthLimitReader(r.Body, cfg.MaxJSONDepth))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return jsonError(err)
+	}
+	if dec.More() {
+		return newError(http.StatusBadRequest, "invalid_json", "unexpected data after the JSON value")
+	}
+	return nil
+}
+
+// contentType returns the media type of the request body, without parameters,
+// or "" if it has none.
+func contentType(r *http.Request) string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType
+}
+
+// isJSONType reports whether mediaType is JSON, such as application/json or
+// application/merge-patch+json.
+func isJSONType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// jsonError converts an error decoding a request body to an apiError.
+func jsonError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return errBodyTooLarge
+	}
+	if errors.Is(err, errJSONTooDeep) {
+		return errTooDeep
+	}
+	if err == io.EOF {
+		// Nothing but whitespace.
+		return errEmptyBody
+	}
+	return newError(http.StatusBadRequest, "invalid_json", err.Error())
+}
+
+// writeCreated writes the resource v, with ID id, that a request created or
+// updated. It honors an RFC 7240 "Prefer: return=minimal" by writing only the
+// ID.
+func writeCreated(w http.ResponseWriter, r *http.Request, status int, id, v any) {
+	switch pref := preferredReturn(r); pref {
+	case "minimal":
+		w.Header().Set("Preference-Applied", "return="+pref)
+		writeJSON(w, status, struct {
+			ID any `json:"id"`
+		}{id})
+	case "representation":
+		w.Header().Set("Preference-Applied", "return="+pref)
+		fallthrough
+	default:
+		writeJSON(w, status, v)
+	}
+}
+
+// preferredReturn returns the value of the return preference in the request's
+// Prefer headers, if any.
+func preferredReturn(r *http.Request) string {
+	for _, header := range r.Header.Values("Prefer") {
+		for pref := range strings.SplitSeq(header, ",") {
+			// Preferences may have parameters after a semicolon.
+			pref, _, _ = strings.Cut(pref, ";")
+			if v, ok := strings.CutPrefix(strings.TrimSpace(pref), "return="); ok {
+				return strings.Trim(strings.TrimSpace(v), `"`)
+			}
+		}
+	}
+	return ""
+}
+
+// envelope wraps successful responses when cfg.ResponseEnvelope is set.
+type envelope struct {
+	Data     any       `json:"data"`
+	Warnings []warning `json:"warnings,omitempty"`
+}
+
+// enveloped returns v wrapped in an envelope if cfg.ResponseEnvelope is set
+// and the response is successful.
+func enveloped(w http.ResponseWriter, status int, v any) any {
+	if !cfg.ResponseEnvelope || status >= 400 {
+		return v
+	}
+	return envelope{Data: v, Warnings: responseWarnings(w)}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	v = enveloped(w, status, v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONWithETag encodes v with an ETag derived from its content.
+func writeJSONWithETag(w http.ResponseWriter, r *http.Request, v any) {
+	data, err := json.Marshal(enveloped(w, http.StatusOK, v))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag(data))
+	w.Write(append(data, '\n'))
+}
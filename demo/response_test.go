@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeError(w, httptest.NewRequest("GET", "/users/1", nil), errNotFound)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type %q", got)
+	}
+	body := responseAs[errorBody](t, w)
+	if body.Error.Code != "not_found" || body.Error.Message != "not found" {
+		t.Errorf("got %+v", body)
+	}
+}
+
+func TestWriteErrorProblemDetails(t *testing.T) {
+	r := httptest.NewRequest("POST", "/users", nil)
+	r.Header.Set("Accept", "application/json, application/problem+json;q=0.9")
+	w := httptest.NewRecorder()
+	writeError(w, r, fieldErrors{"email": "is not a valid email address"}.err())
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/problem+json" {
+		t.Errorf("Content-Type %q", got)
+	}
+	p := responseAs[problemDetails](t, w)
+	if p.Type != "urn:proctor-demo:problem:validation_failed" || p.Title != "Unprocessable Entity" ||
+		p.Status != http.StatusUnprocessableEntity || p.Instance != "/users" || p.Detail == "" {
+		t.Errorf("got %+v", p)
+	}
+	if p.Errors["email"] == "" {
+		t.Errorf("field errors missing: %+v", p)
+	}
+}
+
+func TestClientErrorStatuses(t *testing.T) {
+	// None of these reach the database, of which there is none.
+	h := newHandler(newMux())
+	tests := []struct {
+		name string
+		r    *http.Request
+		want int
+	}{
+		{"malformed JSON", jsonRequest("POST", "/users", `{"name":`), http.StatusBadRequest},
+		{"trailing data", jsonRequest("POST", "/users", `{"name":"Alice"} {}`), http.StatusBadRequest},
+		{"wrong JSON type", jsonRequest("POST", "/users", `{"name":1,"email":"alice@example.com"}`), http.StatusBadRequest},
+		{"malformed update", jsonRequest("PATCH", "/users/1", `{"email":`), http.StatusBadRequest},
+		{"non-numeric user_id", jsonRequest("POST", "/addresses", `{"user_id":"one","street":"1 Main St","city":"Springfield","country":"US"}`), http.StatusBadRequest},
+		{"invalid path id", httptest.NewRequest("GET", "/users/abc", nil), http.StatusBadRequest},
+		{"invalid query parameter", httptest.NewRequest("GET", "/users?limit=many", nil), http.StatusBadRequest},
+		{"invalid email", jsonRequest("POST", "/users", `{"name":"Alice","email":"alice"}`), http.StatusUnprocessableEntity},
+		{"missing fields", jsonRequest("POST", "/addresses", `{"user_id":1}`), http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		if w := serve(h, tt.r); w.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.name, w.Code, w.Body, tt.want)
+		}
+	}
+}
+
+func TestWriteCreatedPreferReturn(t *testing.T) {
+	tests := []struct {
+		prefer, applied, body string
+	}{
+		{"", "", `{"id":7,"name":"Alice","email":"alice@example.com","active":true}`},
+		{"return=representation", "return=representation", `{"id":7,"name":"Alice","email":"alice@example.com","active":true}`},
+		{"return=minimal", "return=minimal", `{"id":7}`},
+		{"respond-async, return=minimal; x=y", "return=minimal", `{"id":7}`},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/users", nil)
+		if tt.prefer != "" {
+			r.Header.Set("Prefer", tt.prefer)
+		}
+		w := httptest.NewRecorder()
+		writeCreated(w, r, http.StatusCreated, 7, User{ID: 7, Name: "Alice", Email: "alice@example.com", Active: true})
+		if w.Code != http.StatusCreated || w.Header().Get("Preference-Applied") != tt.applied || strings.TrimSpace(w.Body.String()) != tt.body {
+			t.Errorf("%q: %d, Preference-Applied %q, %s", tt.prefer, w.Code, w.Header().Get("Preference-Applied"), w.Body)
+		}
+	}
+}
+
+func TestEmptyBody(t *testing.T) {
+	// The body is decoded before the database, of which there is none, is used.
+	h := newHandler(newMux())
+	for _, target := range []string{"POST /users", "POST /users/batch", "PATCH /users/1", "POST /addresses"} {
+		method, path, _ := strings.Cut(target, " ")
+		for _, body := range []string{"", " \n\t"} {
+			w := serve(h, jsonRequest(method, path, body))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s %q: got %d %s, want 400", target, body, w.Code, w.Body)
+				continue
+			}
+			if e := responseAs[errorBody](t, w).Error; e.Code != "empty_body" || e.Message != "request body is required" {
+				t.Errorf("%s %q: got %+v", target, body, e)
+			}
+		}
+	}
+}
+
+func TestErrorDetail(t *testing.T) {
+	errDB := &pgconn.PgError{Severity: "ERROR", Code: "42P01", Message: "relation addresses does not exist"}
+	fakeDB(t, scriptedDriver{func(query string) *scriptedRows {
+		return &scriptedRows{columns: strings.Split(addressColumns, ", "), err: errDB}
+	}})
+	h := newHandler(newMux())
+	for _, detail := range []string{errorDetailMinimal, errorDetailVerbose} {
+		setConfig(t, func(c *config) { c.ErrorDetail = detail })
+		verbose := detail == errorDetailVerbose
+		request := func(accept string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("GET", "/addresses", nil)
+			r.Header.Set("X-Request-ID", "req-1")
+			r.Header.Set("Accept", accept)
+			w := serve(h, r)
+			if w.Code != http.StatusInternalServerError {
+				t.Fatalf("%s: got %d %s", detail, w.Code, w.Body)
+			}
+			if leaked := strings.Contains(w.Body.String(), errDB.Message); leaked != verbose {
+				t.Errorf("%s: database error shown is %v: %s", detail, leaked, w.Body)
+			}
+			return w
+		}
+
+		e := responseAs[errorBody](t, request("application/json")).Error
+		if e.Code != "internal" || e.Message != "internal server error" || e.RequestID != "req-1" {
+			t.Errorf("%s: got %+v", detail, e)
+		}
+		if verbose && (!strings.Contains(e.Detail, errDB.Message) || e.SQLState != "42P01") {
+			t.Errorf("%s: got detail %q, sqlstate %q", detail, e.Detail, e.SQLState)
+		}
+
+		p := responseAs[problemDetails](t, request("application/problem+json"))
+		if p.RequestID != "req-1" || verbose != (p.SQLState == "42P01") {
+			t.Errorf("%s: got %+v", detail, p)
+		}
+		if !verbose && p.Detail != "internal server error" {
+			t.Errorf("%s: got detail %q", detail, p.Detail)
+		}
+	}
+}
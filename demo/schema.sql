@@ -14,3 +14,76 @@ CREATE TABLE IF NOT EXISTS addresses (
     created_at TIMESTAMP DEFAULT NOW(),
     UNIQUE (user_id, street, city, country)
 );
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor TEXT NOT NULL,
+    action TEXT NOT NULL,
+    resource TEXT NOT NULL,
+    resource_id INTEGER NOT NULL,
+    detail JSONB,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Emails are unique regardless of case.
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON users (lower(email));
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT TRUE;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT NOW();
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT NOW();
+
+-- Field-level changes to addresses. Not a foreign key, so that history
+-- outlives the address.
+CREATE TABLE IF NOT EXISTS address_history (
+    id BIGSERIAL PRIMARY KEY,
+    address_id INTEGER NOT NULL,
+    field TEXT NOT NULL,
+    old_value TEXT,
+    new_value TEXT,
+    actor TEXT NOT NULL,
+    changed_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS address_history_address_id_idx ON address_history (address_id, changed_at, id);
+
+-- Whether a user may have identical addresses is configurable
+-- (ALLOW_DUPLICATE_ADDRESSES), so it's enforced by the server rather than by a
+-- unique constraint. The index on the same columns serves that check, and
+-- lookups of a user's addresses.
+ALTER TABLE addresses DROP CONSTRAINT IF EXISTS addresses_user_id_street_city_country_key;
+CREATE INDEX IF NOT EXISTS addresses_user_id_street_city_country_idx ON addresses (user_id, street, city, country);
+
+-- Deleted users are kept, and only live users' emails must be unique, so that
+-- an email can be reused after its account is deleted.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_key;
+DROP INDEX IF EXISTS users_email_lower_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_live_idx ON users (lower(email)) WHERE deleted_at IS NULL;
+
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS postal_code TEXT NOT NULL DEFAULT '';
+
+-- Coordinates are optional, so are NULL rather than zero when unknown.
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS latitude DOUBLE PRECISION;
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS longitude DOUBLE PRECISION;
+
+-- The order of a user's addresses, chosen by the user. Ties, such as between
+-- addresses created before ordering was added, are broken by id.
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS position INTEGER NOT NULL DEFAULT 0;
+
+-- With ENCRYPTION_KEY set, emails are encrypted, so the lower(email) index no
+-- longer enforces uniqueness. A keyed hash of each email does instead. It's
+-- NULL until the email is encrypted, which happens at startup.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_hash BYTEA;
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_hash_live_idx ON users (email_hash) WHERE deleted_at IS NULL;
+
+-- With ID_TYPE=uuid, users and addresses are identified to clients by UUIDs.
+-- The int ids remain the primary keys, so foreign keys, ordering and keyset
+-- pagination are unchanged, and the server translates between the two.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS uuid UUID NOT NULL DEFAULT gen_random_uuid();
+CREATE UNIQUE INDEX IF NOT EXISTS users_uuid_idx ON users (uuid);
+ALTER TABLE addresses ADD COLUMN IF NOT EXISTS uuid UUID NOT NULL DEFAULT gen_random_uuid();
+CREATE UNIQUE INDEX IF NOT EXISTS addresses_uuid_idx ON addresses (uuid);
+
+-- History outlives its address, so it's found by the address's UUID too.
+ALTER TABLE address_history ADD COLUMN IF NOT EXISTS address_uuid UUID;
+CREATE INDEX IF NOT EXISTS address_history_address_uuid_idx ON address_history (address_uuid);
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// statsCache is nil unless cfg.StatsMaxStaleness is set.
+var statsCache *statsRefresher
+
+// computeStats counts users and addresses, as of now.
+func computeStats(ctx context.Context, now time.Time) (stats, error) {
+	s := stats{ComputedAt: timestamp{now.UTC()}}
+	err := queryRowContext(ctx,
+		`SELECT count(*), count(*) FILTER (WHERE active), (SELECT count(*) FROM addresses)
+		 FROM users WHERE deleted_at IS NULL`,
+	).Scan(&s.Users, &s.ActiveUsers, &s.Addresses)
+	return s, err
+}
+
+// statsRefresher holds the last computed stats in memory. Once they're older
+// than statsMaxAge they're still served, for up to cfg.StatsMaxStaleness
+// longer, while run recomputes them.
+type statsRefresher struct {
+	mu      sync.Mutex
+	current *stats
+	// refresh asks run to recompute the stats. It holds at most one request,
+	// so requests made while one is pending are merged.
+	refresh chan struct{}
+	// flight merges concurrent recomputations by requests.
+	flight singleflight.Group
+	// now is time.Now, replaceable for testing.
+	now func() time.Time
+}
+
+func newStatsRefresher() *statsRefresher {
+	return &statsRefresher{refresh: make(chan struct{}, 1), now: time.Now}
+}
+
+// get returns the current stats, recomputing them first if there are none or
+// they're too stale to serve.
+func (s *statsRefresher) get(ctx context.Context) (stats, error) {
+	s.mu.Lock()
+	current := s.current
+	s.mu.Unlock()
+	if current != nil {
+		age := s.now().Sub(current.ComputedAt.Time)
+		if age < statsMaxAge {
+			return *current, nil
+		}
+		if age < statsMaxAge+cfg.StatsMaxStaleness {
+			select {
+			case s.refresh <- struct{}{}:
+			default:
+			}
+			return *current, nil
+		}
+	}
+	v, err, _ := s.flight.Do("stats", func() (any, error) {
+		// Shared by every waiting request, so not cancelled by any one.
+		return s.compute(context.WithoutCancel(ctx))
+	})
+	if err != nil {
+		return stats{}, err
+	}
+	return v.(stats), nil
+}
+
+// compute recomputes the stats and keeps them, unless newer ones were kept
+// meanwhile.
+func (s *statsRefresher) compute(ctx context.Context) (stats, error) {
+	st, err := computeStats(ctx, s.now())
+	if err != nil {
+		return st, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil || st.ComputedAt.After(s.current.ComputedAt.Time) {
+		s.current = &st
+	}
+	return st, nil
+}
+
+// run recomputes the stats each time a refresh is requested, until ctx is
+// cancelled.
+func (s *statsRefresher) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.refresh:
+		}
+		if _, err := s.compute(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("refresh stats: %v", err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStatsStaleWhileRevalidate(t *testing.T) {
+	setConfig(t, func(c *config) { c.StatsMaxStaleness = 10 * time.Minute })
+	// Each count finds one more user than the last.
+	var counts atomic.Int64
+	fakeDB(t, scriptedDriver{func(query string) *scriptedRows {
+		n := counts.Add(1)
+		return &scriptedRows{columns: []string{"count", "count", "count"}, values: [][]driver.Value{{n, n, int64(0)}}}
+	}})
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var clock atomic.Int64
+	s := newStatsRefresher()
+	s.now = func() time.Time { return start.Add(time.Duration(clock.Load())) }
+	saved := statsCache
+	t.Cleanup(func() { statsCache = saved })
+	statsCache = s
+	h := newHandler(newMux())
+
+	get := func(after time.Duration, users int64, computedAt time.Duration) {
+		t.Helper()
+		clock.Store(int64(after))
+		w := serve(h, httptest.NewRequest("GET", "/stats", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("after %v: got %d %s", after, w.Code, w.Body)
+		}
+		got := responseAs[stats](t, w)
+		if got.Users != users || !got.ComputedAt.Equal(start.Add(computedAt)) {
+			t.Errorf("after %v: got %d users computed at %v, want %d at %v", after, got.Users, got.ComputedAt, users, start.Add(computedAt))
+		}
+	}
+
+	// The first request waits for the counts, which are then fresh for a
+	// minute.
+	get(0, 1, 0)
+	get(30*time.Second, 1, 0)
+	if len(s.refresh) != 0 {
+		t.Error("refresh requested while fresh")
+	}
+
+	// Once they expire they're served stale, without waiting for a count,
+	// and a refresh is requested, once however many requests see them.
+	get(2*time.Minute, 1, 0)
+	get(3*time.Minute, 1, 0)
+	if n := counts.Load(); n != 1 {
+		t.Errorf("stale requests counted %d times", n-1)
+	}
+	if len(s.refresh) != 1 {
+		t.Fatal("no refresh requested")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	refreshed := func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.current.Users == 2
+	}
+	for deadline := time.Now().Add(5 * time.Second); !refreshed(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("stats weren't refreshed")
+		}
+	}
+	get(3*time.Minute+time.Second, 2, 3*time.Minute)
+
+	// Past the maximum staleness, a request waits for the counts again.
+	get(3*time.Minute+statsMaxAge+10*time.Minute, 3, 3*time.Minute+statsMaxAge+10*time.Minute)
+}
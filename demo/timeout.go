@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+var errTimeout = newError(http.StatusServiceUnavailable, "timeout", "the request took too long")
+
+// errQueryTimeout is a query cancelled by the database's statement_timeout,
+// rather than by the request's own timeout.
+var errQueryTimeout = newError(http.StatusServiceUnavailable, "query_timeout", "a database query took too long")
+
+// queryTimeoutRetryAfter is the Retry-After sent with errQueryTimeout.
+const queryTimeoutRetryAfter = 5 * time.Second
+
+// defaultRouteTimeouts are the per-route timeouts used unless overridden by
+// ROUTE_TIMEOUTS. Zero disables the timeout.
+var defaultRouteTimeouts = map[string]time.Duration{
+	"GET /events":                     0,
+	"GET /admin/export":               5 * time.Minute,
+	"GET /admin/export/users.csv":     5 * time.Minute,
+	"GET /admin/export/addresses.csv": 5 * time.Minute,
+	"POST /admin/import":              5 * time.Minute,
+	"POST /admin/reindex":             30 * time.Minute,
+	"POST /users/batch":               time.Minute,
+}
+
+// withTimeout cancels each request's context after its route's entry in
+// cfg.RouteTimeouts, or cfg.RequestTimeout for routes without one. Handlers
+// observe the deadline through the database calls they make with the
+// context.
+func withTimeout(next http.Handler) http.Handler {
+	timeouts := map[string]time.Duration{}
+	for pattern, timeout := range cfg.RouteTimeouts {
+		timeouts[route(pattern)] = timeout
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout, ok := timeouts[routePattern(r)]
+		if !ok {
+			timeout = cfg.RequestTimeout
+		}
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
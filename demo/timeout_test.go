@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestWithTimeout(t *testing.T) {
+	setConfig(t, func(c *config) {
+		c.BasePath = "/api"
+		c.RequestTimeout = 20 * time.Millisecond
+		c.RouteTimeouts = map[string]time.Duration{
+			"GET /admin/export": time.Minute,
+			"GET /events":       0,
+		}
+	})
+	// Each handler outlives the global timeout, unless its context is
+	// cancelled first.
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			writeError(w, r, r.Context().Err())
+		case <-time.After(200 * time.Millisecond):
+			if _, ok := r.Context().Deadline(); !ok && routePattern(r) != route("GET /events") {
+				t.Errorf("%s: no deadline", r.URL.Path)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+	mux := http.NewServeMux()
+	for _, pattern := range []string{"GET /users/{id}", "GET /admin/export", "GET /events"} {
+		mux.HandleFunc(route(pattern), slow)
+	}
+	h := newHandler(mux)
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/api/users/1", http.StatusServiceUnavailable},
+		{"/api/admin/export", http.StatusNoContent},
+		{"/api/events", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		w := serve(h, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d %s, want %d", tt.path, w.Code, w.Body, tt.want)
+		}
+		if w.Code == http.StatusServiceUnavailable {
+			if code := responseAs[errorBody](t, w).Error.Code; code != "timeout" {
+				t.Errorf("%s: got code %q", tt.path, code)
+			}
+		}
+	}
+}
+
+func TestStatementTimeout(t *testing.T) {
+	fakeDB(t, scriptedDriver{func(query string) *scriptedRows {
+		return &scriptedRows{
+			columns: strings.Split(addressColumns, ", "),
+			err:     &pgconn.PgError{Severity: "ERROR", Code: "57014", Message: "canceling statement due to statement timeout"},
+		}
+	}})
+	w := serve(newHandler(newMux()), httptest.NewRequest("GET", "/addresses", nil))
+	if w.Code != http.StatusServiceUnavailable || responseAs[errorBody](t, w).Error.Code != "query_timeout" {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Retry-After"); got != "5" {
+		t.Errorf("Retry-After %q", got)
+	}
+}
+
+func TestStatementTimeoutQuery(t *testing.T) {
+	testDB(t)
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "SET statement_timeout = '50ms'"); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.ExecContext(ctx, "RESET statement_timeout")
+
+	_, err = conn.ExecContext(ctx, "SELECT pg_sleep(1)")
+	if !isStatementTimeout(err) {
+		t.Fatalf("got %v, want a statement timeout", err)
+	}
+	w := httptest.NewRecorder()
+	writeError(w, httptest.NewRequest("GET", "/users", nil), err)
+	if w.Code != http.StatusServiceUnavailable || responseAs[errorBody](t, w).Error.Code != "query_timeout" || w.Header().Get("Retry-After") == "" {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+
+	// A query cancelled by the request's own timeout is a timeout instead.
+	reqCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = db.ExecContext(reqCtx, "SELECT pg_sleep(1)")
+	w = httptest.NewRecorder()
+	writeError(w, httptest.NewRequest("GET", "/users", nil), err)
+	if w.Code != http.StatusServiceUnavailable || responseAs[errorBody](t, w).Error.Code != "timeout" {
+		t.Errorf("request timeout: got %d %s (%v)", w.Code, w.Body, err)
+	}
+}
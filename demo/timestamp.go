@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Values of cfg.TimeFormat.
+const (
+	timeFormatRFC3339 = "rfc3339"
+	timeFormatUnixMs  = "unix_ms"
+	timeFormatUnix    = "unix"
+)
+
+// timestamp is a time.Time that is encoded to JSON in cfg.TimeFormat.
+type timestamp struct {
+	time.Time
+}
+
+func (t timestamp) MarshalJSON() ([]byte, error) {
+	switch cfg.TimeFormat {
+	case timeFormatUnixMs:
+		return strconv.AppendInt(nil, t.UnixMilli(), 10), nil
+	case timeFormatUnix:
+		return strconv.AppendInt(nil, t.Unix(), 10), nil
+	default:
+		return t.Time.MarshalJSON()
+	}
+}
+
+// UnmarshalJSON accepts any format MarshalJSON produces under the current
+// configuration. null leaves t unchanged.
+func (t *timestamp) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		return t.Time.UnmarshalJSON(data)
+	}
+	var n int64
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	if cfg.TimeFormat == timeFormatUnix {
+		t.Time = time.Unix(n, 0).UTC()
+	} else {
+		t.Time = time.UnixMilli(n).UTC()
+	}
+	return nil
+}
+
+// Scan implements sql.Scanner.
+func (t *timestamp) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		t.Time = time.Time{}
+	case time.Time:
+		t.Time = v
+	default:
+		return fmt.Errorf("cannot scan %T into timestamp", src)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTimestampFormats(t *testing.T) {
+	ts := timestamp{time.Date(2024, 3, 1, 12, 30, 15, 250e6, time.UTC)}
+	tests := []struct {
+		format, want string
+	}{
+		{timeFormatRFC3339, `"2024-03-01T12:30:15.25Z"`},
+		{timeFormatUnixMs, `1709296215250`},
+		{timeFormatUnix, `1709296215`},
+	}
+	for _, tt := range tests {
+		setConfig(t, func(c *config) { c.TimeFormat = tt.format })
+		data, err := json.Marshal(ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.format, data, tt.want)
+		}
+		var back timestamp
+		if err := json.Unmarshal(data, &back); err != nil {
+			t.Fatal(err)
+		}
+		want := ts.Time
+		if tt.format == timeFormatUnix {
+			want = want.Truncate(time.Second)
+		}
+		if !back.Equal(want) {
+			t.Errorf("%s: round trip gave %v", tt.format, back)
+		}
+	}
+}
+
+func TestTimestampOmittedWhenZero(t *testing.T) {
+	data, err := json.Marshal(User{Name: "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	json.Unmarshal(data, &fields)
+	if _, ok := fields["created_at"]; ok {
+		t.Errorf("zero created_at encoded: %s", data)
+	}
+}
+
+func TestLoadConfigRejectsUnknownTimeFormat(t *testing.T) {
+	t.Setenv("TIME_FORMAT", "iso")
+	if _, err := loadConfig(); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Values of cfg.IDType.
+const (
+	idTypeInt  = "int"
+	idTypeUUID = "uuid"
+)
+
+// uuidIDs reports whether users and addresses are identified to clients by
+// UUIDs rather than by their int ids (ID_TYPE=uuid).
+//
+// The int ids remain the primary keys, so every query and cache is still
+// keyed by them. UUIDs are translated at the edges: pathID and resolveIDs
+// look up the ids of those in requests, and User and Address encode theirs in
+// place of their ids.
+func uuidIDs() bool {
+	return cfg.IDType == idTypeUUID
+}
+
+// uuid is a UUID, such as one generated by Postgres's gen_random_uuid(). It
+// is encoded in the canonical form, 36 lower-case hex digits and hyphens.
+type uuid [16]byte
+
+var errInvalidUUID = errors.New("invalid UUID")
+
+// parseUUID parses the canonical form of a UUID, in either case.
+func parseUUID(s string) (uuid, error) {
+	var u uuid
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return u, errInvalidUUID
+	}
+	digits := s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:]
+	if _, err := hex.Decode(u[:], []byte(digits)); err != nil {
+		return u, errInvalidUUID
+	}
+	return u, nil
+}
+
+func (u uuid) String() string {
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf[:])
+}
+
+func (u uuid) MarshalText() ([]byte, error) {
+	return []byte(u.String()), nil
+}
+
+func (u *uuid) UnmarshalText(text []byte) error {
+	v, err := parseUUID(string(text))
+	if err != nil {
+		return err
+	}
+	*u = v
+	return nil
+}
+
+// Scan implements sql.Scanner. pgx returns uuid columns as strings.
+func (u *uuid) Scan(src any) error {
+	switch v := src.(type) {
+	case string:
+		return u.UnmarshalText([]byte(v))
+	case []byte:
+		return u.UnmarshalText(v)
+	default:
+		return fmt.Errorf("cannot scan %T into a UUID", src)
+	}
+}
+
+// Value implements driver.Valuer. The zero UUID is NULL, so that a UUID that
+// isn't known is left to the column's default.
+func (u uuid) Value() (driver.Value, error) {
+	if u == (uuid{}) {
+		return nil, nil
+	}
+	return u.String(), nil
+}
+
+// uuidStrings converts UUIDs to strings, for use as a uuid[] query argument.
+func uuidStrings(uuids []uuid) []string {
+	s := make([]string, len(uuids))
+	for i, u := range uuids {
+		s[i] = u.String()
+	}
+	return s
+}
+
+// publicID returns the id clients know u by: its int id, or with
+// ID_TYPE=uuid, its UUID.
+func (u User) publicID() any {
+	if uuidIDs() {
+		return u.UUID
+	}
+	return u.ID
+}
+
+func (a Address) publicID() any {
+	if uuidIDs() {
+		return a.UUID
+	}
+	return a.ID
+}
+
+// idCacheSize is how many UUIDs' ids are cached per collection.
+const idCacheSize = 10000
+
+// idCache holds the ids of the UUIDs in recent requests. A row's UUID never
+// changes, so entries don't expire.
+var idCache = newLRUCache[collectionUUID, int](idCacheSize, 0)
+
+type collectionUUID struct {
+	collection string
+	uuid       uuid
+}
+
+// lookupIDs returns the ids of the users or addresses, as collection names,
+// with the given UUIDs, omitting UUIDs no row has.
+func lookupIDs(ctx context.Context, collection string, uuids []uuid) (map[uuid]int, error) {
+	ids := make(map[uuid]int, len(uuids))
+	var missing []uuid
+	for _, u := range uuids {
+		if id, ok := idCache.Get(collectionUUID{collection, u}); ok {
+			ids[u] = id
+		} else {
+			missing = append(missing, u)
+		}
+	}
+	if len(missing) == 0 {
+		return ids, nil
+	}
+	gen := idCache.Generation()
+	lookup := userRepo.IDs
+	if collection == "addresses" {
+		lookup = addressRepo.IDs
+	}
+	found, err := lookup(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	for u, id := range found {
+		ids[u] = id
+		idCache.Set(collectionUUID{collection, u}, id, gen)
+	}
+	return ids, nil
+}
+
+// lookupID returns the id of the user or address identified to clients by s:
+// the id itself, or with ID_TYPE=uuid, the row's UUID. It's errInvalidID if s
+// isn't one, and with ID_TYPE=uuid, errNotFound if no row has the UUID.
+func lookupID(ctx context.Context, collection, s string) (int, error) {
+	if !uuidIDs() {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, errInvalidID
+		}
+		return id, nil
+	}
+	u, err := parseUUID(s)
+	if err != nil {
+		return 0, errInvalidID
+	}
+	ids, err := lookupIDs(ctx, collection, []uuid{u})
+	if err != nil {
+		return 0, err
+	}
+	id, ok := ids[u]
+	if !ok {
+		return 0, errNotFound
+	}
+	return id, nil
+}
+
+// pathID returns the id of the user or address in the request's {id} path
+// parameter, as lookupID does.
+func pathID(r *http.Request, collection string) (int, error) {
+	return lookupID(r.Context(), collection, r.PathValue("id"))
+}
+
+// bodyID is the id of a user or address in a request body: a JSON number,
+// or with ID_TYPE=uuid, a UUID string. resolveIDs replaces UUIDs with the
+// ids of their rows, so that either is then converted by
+// fieldErrors.integer.
+type bodyID json.Number
+
+func (id *bodyID) UnmarshalJSON(data []byte) error {
+	if !uuidIDs() {
+		return json.Unmarshal(data, (*json.Number)(id))
+	}
+	var u uuid
+	if err := json.Unmarshal(data, &u); err != nil {
+		return fmt.Errorf("%s is not a UUID", data)
+	}
+	*id = bodyID(u.String())
+	return nil
+}
+
+// unknownID is what resolveIDs replaces a UUID no row has with. No row has
+// it either, so it's then handled as an unknown id would be.
+const unknownID = -1
+
+// resolveIDs replaces the UUIDs among ids, with ID_TYPE=uuid, with the ids of
+// the users or addresses, as collection names, that have them. Absent ids are
+// left as they are.
+func resolveIDs(ctx context.Context, collection string, ids ...*bodyID) error {
+	if !uuidIDs() {
+		return nil
+	}
+	uuids := make([]uuid, 0, len(ids))
+	for _, id := range ids {
+		if u, err := parseUUID(string(*id)); err == nil {
+			uuids = append(uuids, u)
+		}
+	}
+	found, err := lookupIDs(ctx, collection, uuids)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		u, err := parseUUID(string(*id))
+		if err != nil {
+			continue
+		}
+		n, ok := found[u]
+		if !ok {
+			n = unknownID
+		}
+		*id = bodyID(strconv.Itoa(n))
+	}
+	return nil
+}
+
+// resolveIDList resolves a list of ids, as resolveIDs does, and converts
+// them, reporting any that aren't integers as invalid values of field.
+func resolveIDList(ctx context.Context, collection, field string, ids []bodyID) ([]int, error) {
+	ptrs := make([]*bodyID, len(ids))
+	for i := range ids {
+		ptrs[i] = &ids[i]
+	}
+	if err := resolveIDs(ctx, collection, ptrs...); err != nil {
+		return nil, err
+	}
+	errs := fieldErrors{}
+	ints := make([]int, len(ids))
+	for i, id := range ids {
+		ints[i] = errs.integer(field, json.Number(id))
+	}
+	return ints, errs.err()
+}
+
+// storedUser and storedAddress encode users and addresses with both their
+// ids and UUIDs, whatever ID_TYPE shows clients, for the shared cache and
+// exports, which are decoded back into them.
+type (
+	storedUser    User
+	storedAddress Address
+)
+
+func (u storedUser) MarshalJSON() ([]byte, error) {
+	type plain User
+	return json.Marshal(struct {
+		plain
+		UUID uuid `json:"uuid,omitzero"`
+	}{plain(u), u.UUID})
+}
+
+func (u *storedUser) UnmarshalJSON(data []byte) error {
+	type plain User
+	return json.Unmarshal(data, &struct {
+		*plain
+		UUID *uuid `json:"uuid"`
+	}{(*plain)(u), &u.UUID})
+}
+
+func (a storedAddress) MarshalJSON() ([]byte, error) {
+	type plain Address
+	return json.Marshal(struct {
+		plain
+		UUID     uuid `json:"uuid,omitzero"`
+		UserUUID uuid `json:"user_uuid,omitzero"`
+	}{plain(a), a.UUID, a.UserUUID})
+}
+
+func (a *storedAddress) UnmarshalJSON(data []byte) error {
+	type plain Address
+	return json.Unmarshal(data, &struct {
+		*plain
+		UUID     *uuid `json:"uuid"`
+		UserUUID *uuid `json:"user_uuid"`
+	}{(*plain)(a), &a.UUID, &a.UserUUID})
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseUUID(t *testing.T) {
+	const canonical = "0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d90"
+	u, err := parseUUID(canonical)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.String(); got != canonical {
+		t.Errorf("String() = %q, want %q", got, canonical)
+	}
+	if upper, err := parseUUID(strings.ToUpper(canonical)); err != nil || upper != u {
+		t.Errorf("upper case: got %v, %v", upper, err)
+	}
+	for _, s := range []string{
+		"",
+		"0190a8f27c4e4b1a9f3d2e5c6b7a8d90",
+		"{0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d90}",
+		"0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d9",
+		"0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d9g",
+		"0190a8f2+7c4e-4b1a-9f3d-2e5c6b7a8d90",
+		"42",
+	} {
+		if _, err := parseUUID(s); err == nil {
+			t.Errorf("parseUUID(%q) succeeded", s)
+		}
+	}
+}
+
+func TestUUIDJSON(t *testing.T) {
+	want, _ := parseUUID("0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d90")
+	data, err := json.Marshal(want)
+	if err != nil || string(data) != `"0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d90"` {
+		t.Fatalf("Marshal: got %s, %v", data, err)
+	}
+	var got uuid
+	if err := json.Unmarshal(data, &got); err != nil || got != want {
+		t.Errorf("Unmarshal: got %v, %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(`"not-a-uuid"`), &got); err == nil {
+		t.Error("Unmarshal of an invalid UUID succeeded")
+	}
+}
+
+func TestUUIDsReplaceIDsInJSON(t *testing.T) {
+	userUUID, _ := parseUUID("0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d90")
+	addressUUID, _ := parseUUID("0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d91")
+	a := Address{ID: 7, UserID: 3, Street: "1 Main St", UUID: addressUUID, UserUUID: userUUID}
+	u := User{ID: 3, Name: "Ada", UUID: userUUID, Addresses: []Address{a}}
+
+	for _, nullEmpty := range []bool{false, true} {
+		setConfig(t, func(c *config) { c.NullEmpty, c.IDType = nullEmpty, idTypeInt })
+		data, _ := json.Marshal(u)
+		if !strings.HasPrefix(string(data), `{"id":3,`) || strings.Contains(string(data), userUUID.String()) {
+			t.Errorf("int ids, null empty %v: got %s", nullEmpty, data)
+		}
+
+		setConfig(t, func(c *config) { c.IDType = idTypeUUID })
+		data, err := json.Marshal(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got struct {
+			ID        string `json:"id"`
+			Name      string `json:"name"`
+			Addresses []struct {
+				ID     string `json:"id"`
+				UserID string `json:"user_id"`
+			} `json:"addresses"`
+		}
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("decoding %s: %v", data, err)
+		}
+		if got.ID != userUUID.String() || got.Name != "Ada" || len(got.Addresses) != 1 ||
+			got.Addresses[0].ID != addressUUID.String() || got.Addresses[0].UserID != userUUID.String() {
+			t.Errorf("UUIDs, null empty %v: got %s", nullEmpty, data)
+		}
+		if strings.Count(string(data), `"id"`) != 2 {
+			t.Errorf("UUIDs, null empty %v: the int id is encoded too: %s", nullEmpty, data)
+		}
+	}
+}
+
+func TestStoredUsersKeepBothIDs(t *testing.T) {
+	setConfig(t, func(c *config) { c.IDType = idTypeUUID })
+	userUUID, _ := parseUUID("0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d90")
+	addressUUID, _ := parseUUID("0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d91")
+
+	u := User{ID: 3, Name: "Ada", UUID: userUUID}
+	data, err := json.Marshal(storedUser(u))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotUser User
+	if err := json.Unmarshal(data, (*storedUser)(&gotUser)); err != nil || gotUser.ID != u.ID || gotUser.UUID != u.UUID {
+		t.Errorf("user: got %+v, %v from %s", gotUser, err, data)
+	}
+
+	a := Address{ID: 7, UserID: 3, UUID: addressUUID, UserUUID: userUUID}
+	data, err = json.Marshal(storedAddress(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotAddress Address
+	if err := json.Unmarshal(data, (*storedAddress)(&gotAddress)); err != nil || gotAddress != a {
+		t.Errorf("address: got %+v, %v from %s", gotAddress, err, data)
+	}
+}
+
+func TestUUIDIDsWithMemoryRepository(t *testing.T) {
+	setConfig(t, func(c *config) { c.IDType = idTypeUUID })
+	useMemoryRepositories(t)
+	type resource struct {
+		ID     string `json:"id"`
+		UserID string `json:"user_id"`
+	}
+	addUser := func(name, email string) resource {
+		t.Helper()
+		w := callHandler(createUser, "POST", "/users", `{"name": "`+name+`", "email": "`+email+`"}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create %s: got %d %s", name, w.Code, w.Body)
+		}
+		u := responseAs[resource](t, w)
+		if _, err := parseUUID(u.ID); err != nil || w.Header().Get("Location") != "/users/"+u.ID {
+			t.Fatalf("create %s: got %s, Location %q", name, w.Body, w.Header().Get("Location"))
+		}
+		return u
+	}
+	ada, duplicate := addUser("Ada", "ada@example.com"), addUser("Ada", "ada@example.org")
+
+	w := callHandler(updateUser, "PATCH", "/users/"+ada.ID, `{"name": "Ada Lovelace"}`, "id", ada.ID)
+	if w.Code != http.StatusOK || responseAs[resource](t, w).ID != ada.ID {
+		t.Errorf("update by UUID: got %d %s", w.Code, w.Body)
+	}
+	for id, want := range map[string]int{
+		"1":                                    http.StatusBadRequest,
+		"not-a-uuid":                           http.StatusBadRequest,
+		"0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d90": http.StatusNotFound,
+	} {
+		if w := callHandler(updateUser, "PATCH", "/users/"+id, `{"name": "Nobody"}`, "id", id); w.Code != want {
+			t.Errorf("update %s: got %d, want %d", id, w.Code, want)
+		}
+	}
+
+	addAddress := func(userID, street string) resource {
+		t.Helper()
+		w := callHandler(createAddress, "POST", "/addresses",
+			`{"user_id": "`+userID+`", "street": "`+street+`", "city": "Springfield", "country": "US"}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create %s: got %d %s", street, w.Code, w.Body)
+		}
+		return responseAs[resource](t, w)
+	}
+	first := addAddress(duplicate.ID, "1 Main St")
+	second := addAddress(duplicate.ID, "2 Main St")
+	if first.UserID != duplicate.ID {
+		t.Errorf("address user_id: got %q, want %q", first.UserID, duplicate.ID)
+	}
+	w = callHandler(createAddress, "POST", "/addresses",
+		`{"user_id": "0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d90", "street": "1 Main St", "city": "Springfield", "country": "US"}`)
+	if w.Code != http.StatusUnprocessableEntity || responseAs[errorBody](t, w).Error.Fields["user_id"] != "does not exist" {
+		t.Errorf("unknown user: got %d %s", w.Code, w.Body)
+	}
+	w = callHandler(createAddress, "POST", "/addresses", `{"user_id": 1, "street": "1 Main St", "city": "Springfield", "country": "US"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("int user_id: got %d %s", w.Code, w.Body)
+	}
+
+	w = callHandler(reorderUserAddresses, "PUT", "/users/"+duplicate.ID+"/addresses/order",
+		`["`+second.ID+`", "`+first.ID+`"]`, "id", duplicate.ID)
+	if got := responseAs[[]resource](t, w); w.Code != http.StatusOK || len(got) != 2 || got[0].ID != second.ID {
+		t.Errorf("reorder: got %d %s", w.Code, w.Body)
+	}
+
+	w = callHandler(mergeUsers, "POST", "/users/"+ada.ID+"/merge", `{"duplicate_id": "`+duplicate.ID+`"}`, "id", ada.ID)
+	if w.Code != http.StatusOK || responseAs[resource](t, w).ID != ada.ID {
+		t.Errorf("merge: got %d %s", w.Code, w.Body)
+	}
+	w = callHandler(mergeUsers, "POST", "/users/"+ada.ID+"/merge", `{"duplicate_id": "0190a8f2-7c4e-4b1a-9f3d-2e5c6b7a8d90"}`, "id", ada.ID)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("merge an unknown duplicate: got %d %s", w.Code, w.Body)
+	}
+
+	w = callHandler(deleteAddress, "DELETE", "/addresses/"+first.ID, "", "id", first.ID)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("delete address: got %d %s", w.Code, w.Body)
+	}
+	if w := callHandler(deleteAddress, "DELETE", "/addresses/"+first.ID, "", "id", first.ID); w.Code != http.StatusNotFound {
+		t.Errorf("delete address again: got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+// Length limits for fields without a configurable limit.
+const (
+	// maxEmailLength is the longest address permitted by RFC 5321.
+	maxEmailLength  = 254
+	maxStreetLength = 255
+	maxCityLength   = 255
+)
+
+// fieldErrors collects validation failures keyed by JSON field name.
+type fieldErrors map[string]string
+
+// err returns a 422 error listing every failure, or nil if there were none.
+func (f fieldErrors) err() error {
+	if len(f) == 0 {
+		return nil
+	}
+	return &apiError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    "validation_failed",
+		Message: "validation failed",
+		Fields:  f,
+	}
+}
+
+// merge adds the field errors in err, if any, to f, keeping those already in
+// f. It returns other errors unchanged.
+func (f fieldErrors) merge(err error) error {
+	apiErr, ok := err.(*apiError)
+	if !ok || apiErr.Fields == nil {
+		return err
+	}
+	for field, msg := range apiErr.Fields {
+		if _, ok := f[field]; !ok {
+			f[field] = msg
+		}
+	}
+	return nil
+}
+
+// text checks that a required text field is present and at most max
+// characters long.
+func (f fieldErrors) text(field, value string, max int) {
+	switch {
+	case value == "":
+		f[field] = "is required"
+	case utf8.RuneCountInString(value) > max:
+		f[field] = fmt.Sprintf("must be at most %d characters", max)
+	}
+}
+
+// integer converts a JSON number to an int. Integral values such as 5.0 are
+// accepted, but anything with a fractional part or out of range is an error
+// rather than being truncated. An absent number is 0.
+func (f fieldErrors) integer(field string, n json.Number) int {
+	if n == "" {
+		return 0
+	}
+	if i, err := n.Int64(); err == nil && i >= math.MinInt && i <= math.MaxInt {
+		return int(i)
+	}
+	if v, err := n.Float64(); err == nil && v == math.Trunc(v) && v >= math.MinInt && v < math.MaxInt {
+		return int(v)
+	}
+	f[field] = "must be an integer"
+	return 0
+}
+
+func (f fieldErrors) email(field, value string) {
+	f.text(field, value, maxEmailLength)
+	if _, ok := f[field]; ok {
+		return
+	}
+	if addr, err := mail.ParseAddress(value); err != nil || addr.Address != value {
+		f[field] = "must be a valid email address"
+	}
+}
+
+// prepareUser normalizes u's fields, then validates it. Emails are compared
+// case-insensitively, so they are stored lower-cased.
+func prepareUser(u *User) error {
+	u.Name = strings.TrimSpace(u.Name)
+	u.Email = normalizeEmail(u.Email)
+	return validateUser(*u)
+}
+
+// normalizeEmail returns the form of an email address used for storage and
+// lookups.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func validateUser(u User) error {
+	errs := fieldErrors{}
+	errs.text("name", u.Name, cfg.MaxNameLength)
+	errs.email("email", u.Email)
+	return errs.err()
+}
+
+// prepareAddress trims surrounding whitespace from a's text fields, so that
+// whitespace-only values are rejected as missing, and upper-cases the country
+// and postal codes, then validates it. Every
+// handler writing an address must call this before persisting it.
+func prepareAddress(a *Address) error {
+	a.Street = strings.TrimSpace(a.Street)
+	a.City = strings.TrimSpace(a.City)
+	a.Country = strings.ToUpper(strings.TrimSpace(a.Country))
+	a.PostalCode = strings.ToUpper(strings.TrimSpace(a.PostalCode))
+	return validateAddress(*a)
+}
+
+func validateAddress(a Address) error {
+	errs := fieldErrors{}
+	if a.UserID == 0 {
+		errs["user_id"] = "is required"
+	}
+	errs.text("street", a.Street, maxStreetLength)
+	errs.text("city", a.City, maxCityLength)
+	switch {
+	case a.Country == "":
+		errs["country"] = "is required"
+	case !isCountry(a.Country):
+		errs["country"] = "must be an ISO 3166-1 alpha-2 country code"
+	case a.PostalCode != "" && !validPostalCode(a.Country, a.PostalCode):
+		errs["postal_code"] = "is not a valid postal code for " + a.Country
+	}
+	switch {
+	case (a.Latitude == nil) != (a.Longitude == nil):
+		errs["latitude"] = "must be given with longitude"
+	case a.Latitude != nil && (*a.Latitude < -90 || *a.Latitude > 90):
+		errs["latitude"] = "must be between -90 and 90"
+	case a.Longitude != nil && (*a.Longitude < -180 || *a.Longitude > 180):
+		errs["longitude"] = "must be between -180 and 180"
+	}
+	return errs.err()
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPrepareUser(t *testing.T) {
+	setConfig(t, func(c *config) { c.MaxNameLength = 10 })
+	long := strings.Repeat("a", 250) + "@example.com"
+	tests := []struct {
+		name, email string
+		want        map[string]string
+	}{
+		{"Alice", "alice@example.com", nil},
+		{"  Alice  ", "  Alice@Example.com ", nil},
+		{"", "alice@example.com", map[string]string{"name": "is required"}},
+		{"   ", "alice@example.com", map[string]string{"name": "is required"}},
+		{"Alexandrina", "alice@example.com", map[string]string{"name": "must be at most 10 characters"}},
+		// Characters, not bytes, are counted.
+		{"Ålëxändrïä", "alice@example.com", nil},
+		{"Alice", "", map[string]string{"email": "is required"}},
+		{"Alice", "alice", map[string]string{"email": "must be a valid email address"}},
+		{"Alice", long, map[string]string{"email": "must be at most 254 characters"}},
+		{"", "", map[string]string{"name": "is required", "email": "is required"}},
+	}
+	for _, tt := range tests {
+		u := User{Name: tt.name, Email: tt.email}
+		checkFieldErrors(t, tt.name+" "+tt.email, prepareUser(&u), tt.want)
+	}
+}
+
+func TestPrepareUserNormalizes(t *testing.T) {
+	u := User{Name: "  Alice ", Email: " Alice@Example.COM "}
+	if err := prepareUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "Alice" || u.Email != "alice@example.com" {
+		t.Errorf("got %+v", u)
+	}
+}
+
+func TestPrepareAddress(t *testing.T) {
+	lat, lng, far := 51.5, -0.1, 200.0
+	long := strings.Repeat("x", 256)
+	valid := func(change func(*Address)) Address {
+		a := Address{UserID: 1, Street: "1 Main St", City: "Springfield", Country: "us", PostalCode: "12345"}
+		change(&a)
+		return a
+	}
+	tests := []struct {
+		name string
+		a    Address
+		want map[string]string
+	}{
+		{"valid", valid(func(a *Address) {}), nil},
+		{"coordinates", valid(func(a *Address) { a.Latitude, a.Longitude = &lat, &lng }), nil},
+		{"no user", valid(func(a *Address) { a.UserID = 0 }), map[string]string{"user_id": "is required"}},
+		{"blank street", valid(func(a *Address) { a.Street = "  " }), map[string]string{"street": "is required"}},
+		{"long street", valid(func(a *Address) { a.Street = long }), map[string]string{"street": "must be at most 255 characters"}},
+		{"long city", valid(func(a *Address) { a.City = long }), map[string]string{"city": "must be at most 255 characters"}},
+		{"no country", valid(func(a *Address) { a.Country = "" }), map[string]string{"country": "is required"}},
+		{"bad country", valid(func(a *Address) { a.Country = "XX" }), map[string]string{"country": "must be an ISO 3166-1 alpha-2 country code"}},
+		{"bad postal code", valid(func(a *Address) { a.PostalCode = "ABC" }), map[string]string{"postal_code": "is not a valid postal code for US"}},
+		{"postal code of another country", valid(func(a *Address) { a.Country = "gb" }), map[string]string{"postal_code": "is not a valid postal code for GB"}},
+		{"lower case postal code", valid(func(a *Address) { a.Country, a.PostalCode = "GB", "sw1a 1aa" }), nil},
+		{"postal code without a known format", valid(func(a *Address) { a.Country, a.PostalCode = "NZ", "anything" }), nil},
+		{"latitude alone", valid(func(a *Address) { a.Latitude = &lat }), map[string]string{"latitude": "must be given with longitude"}},
+		{"latitude range", valid(func(a *Address) { a.Latitude, a.Longitude = &far, &lng }), map[string]string{"latitude": "must be between -90 and 90"}},
+		{"longitude range", valid(func(a *Address) { a.Latitude, a.Longitude = &lat, &far }), map[string]string{"longitude": "must be between -180 and 180"}},
+	}
+	for _, tt := range tests {
+		checkFieldErrors(t, tt.name, prepareAddress(&tt.a), tt.want)
+	}
+}
+
+// checkFieldErrors checks that err is nil if want is, and otherwise a 422
+// with exactly the field errors in want.
+func checkFieldErrors(t *testing.T, name string, err error, want map[string]string) {
+	t.Helper()
+	if want == nil {
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		return
+	}
+	apiErr, ok := err.(*apiError)
+	if !ok || apiErr.Status != http.StatusUnprocessableEntity {
+		t.Errorf("%s: got %v, want a 422", name, err)
+		return
+	}
+	got, _ := json.Marshal(apiErr.Fields)
+	wantJSON, _ := json.Marshal(want)
+	if string(got) != string(wantJSON) {
+		t.Errorf("%s: got %s, want %s", name, got, wantJSON)
+	}
+}
+
+func TestCreateUserValidatesBeforeQuerying(t *testing.T) {
+	// There is no database, so this would fail with a 500 if it were
+	// queried.
+	h := newHandler(newMux())
+	w := serve(h, jsonRequest("POST", "/users", `{"name":"`+strings.Repeat("a", 256)+`","email":"alice@example.com"}`))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	if fields := responseAs[errorBody](t, w).Error.Fields; fields["name"] != "must be at most 255 characters" {
+		t.Errorf("got %v", fields)
+	}
+}
+
+func TestCreateAddressRejectsBlankFields(t *testing.T) {
+	h := newHandler(newMux())
+	for _, body := range []string{
+		`{"user_id":1,"street":"","city":"","country":"US"}`,
+		`{"user_id":1,"street":"   ","city":"\t","country":"US"}`,
+	} {
+		w := serve(h, jsonRequest("POST", "/addresses", body))
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("%s: %d %s", body, w.Code, w.Body)
+		}
+		fields := responseAs[errorBody](t, w).Error.Fields
+		if fields["street"] != "is required" || fields["city"] != "is required" {
+			t.Errorf("%s: got %v", body, fields)
+		}
+	}
+}
+
+func TestAddressWhitespaceIsTrimmed(t *testing.T) {
+	testDB(t)
+	h := newHandler(newMux())
+	u := createTestUser(t, h, "Alice", "alice@example.com")
+	a := createTestAddress(t, h, u.ID, "  1 Main St ", " Seattle ", " us ")
+	if a.Street != "1 Main St" || a.City != "Seattle" || a.Country != "US" {
+		t.Errorf("created %+v", a)
+	}
+	path := "/addresses/" + strconv.Itoa(a.ID)
+	w := serve(h, jsonRequest("PATCH", path, `{"city":" Tacoma "}`))
+	if got := responseAs[Address](t, w); got.City != "Tacoma" {
+		t.Errorf("updated %+v", got)
+	}
+	w = serve(h, jsonRequest("PATCH", path, `{"city":"  "}`))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("blank city: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestNewAddressDefaultCountry(t *testing.T) {
+	in := addressInput{UserID: "1", Street: "1 Main St", City: "Springfield"}
+	r := httptest.NewRequest("POST", "/addresses", nil)
+	_, err := newAddress(r, in)
+	checkFieldErrors(t, "no default", err, map[string]string{"country": "is required"})
+
+	setConfig(t, func(c *config) { c.DefaultCountry = "GB" })
+	tests := []struct{ country, want string }{
+		{"", "GB"},
+		{"  ", "GB"},
+		{"us", "US"},
+	}
+	for _, tt := range tests {
+		in.Country = tt.country
+		a, err := newAddress(r, in)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.country, err)
+		}
+		if a.Country != tt.want {
+			t.Errorf("%q: country %q, want %q", tt.country, a.Country, tt.want)
+		}
+	}
+}
+
+func TestAddressUserIDMustBeInteger(t *testing.T) {
+	tests := []struct {
+		userID string
+		want   int
+		err    int
+	}{
+		{`5`, 5, 0},
+		{`5.0`, 5, 0},
+		{`5e0`, 5, 0},
+		{`5.5`, 0, http.StatusUnprocessableEntity},
+		{`1e100`, 0, http.StatusUnprocessableEntity},
+		{`"5"`, 5, 0},
+		{`"five"`, 0, http.StatusBadRequest},
+		{`true`, 0, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		var in addressInput
+		err := decodeJSON(jsonRequest("POST", "/addresses", `{"user_id":`+tt.userID+`}`), &in)
+		var a Address
+		if err == nil {
+			a, err = in.address()
+		}
+		status := 0
+		if e, ok := err.(*apiError); ok {
+			status = e.Status
+		} else if err != nil {
+			t.Fatalf("%s: %v", tt.userID, err)
+		}
+		if status != tt.err || a.UserID != tt.want {
+			t.Errorf("%s: got %d, status %d; want %d, status %d", tt.userID, a.UserID, status, tt.want, tt.err)
+		}
+	}
+}
+
+func TestValidateAddressInput(t *testing.T) {
+	// There is no database, so this would fail with a 500 if it were
+	// queried.
+	h := newHandler(newMux())
+	tests := []struct {
+		body string
+		want map[string]string
+	}{
+		{`{"user_id":1,"street":"1 Main St","city":"Springfield","country":"us","postal_code":"62701"}`, nil},
+		{`{"user_id":1,"street":"1 Main St","city":"Springfield","country":"US","latitude":39.8,"longitude":-89.6}`, nil},
+		{`{"user_id":1,"street":" ","city":"Springfield","country":"XX"}`, map[string]string{
+			"street":  "is required",
+			"country": "must be an ISO 3166-1 alpha-2 country code",
+		}},
+		{`{"street":"1 Main St","city":"Springfield","country":"US","postal_code":"ABC","latitude":91}`, map[string]string{
+			"user_id":     "is required",
+			"postal_code": "is not a valid postal code for US",
+			"latitude":    "must be given with longitude",
+		}},
+		{`{"user_id":1.5,"street":"1 Main St","city":"Springfield","country":"US"}`, map[string]string{
+			"user_id": "must be an integer",
+		}},
+	}
+	for _, tt := range tests {
+		w := serve(h, jsonRequest("POST", "/addresses/validate", tt.body))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got %d %s", tt.body, w.Code, w.Body)
+			continue
+		}
+		got := responseAs[addressValidation](t, w)
+		if got.Valid != (tt.want == nil) {
+			t.Errorf("%s: got valid=%v", tt.body, got.Valid)
+		}
+		gotJSON, _ := json.Marshal(got.Errors)
+		wantJSON, _ := json.Marshal(tt.want)
+		if tt.want != nil && string(gotJSON) != string(wantJSON) {
+			t.Errorf("%s: got %s, want %s", tt.body, gotJSON, wantJSON)
+		}
+	}
+	if w := serve(h, jsonRequest("POST", "/addresses/validate", `{"street":`)); w.Code != http.StatusBadRequest {
+		t.Errorf("malformed: got %d %s, want 400", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// warning is a non-fatal adjustment the server made to a request, such as
+// clamping a page size.
+type warning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type warningCollector struct {
+	mu       sync.Mutex
+	warnings []warning
+}
+
+func (c *warningCollector) list() []warning {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.warnings
+}
+
+// addWarning records a warning to report in the response to r.
+func addWarning(r *http.Request, code, message string) {
+	c, ok := r.Context().Value(warningsKey).(*warningCollector)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.warnings = append(c.warnings, warning{Code: code, Message: message})
+}
+
+// withWarnings collects the warnings added while handling each request. They
+// are reported in the "warnings" member of the response envelope if
+// cfg.ResponseEnvelope is set, and as Warning headers otherwise.
+//
+// This must wrap the mux directly, so that writeJSON can find the collector
+// from the ResponseWriter.
+func withWarnings(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := &warningCollector{}
+		ww := &warningWriter{ResponseWriter: w, warnings: c}
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), warningsKey, c)))
+	})
+}
+
+// responseWarnings returns the warnings collected for the response written to
+// w.
+func responseWarnings(w http.ResponseWriter) []warning {
+	for {
+		switch rw := w.(type) {
+		case *warningWriter:
+			return rw.warnings.list()
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// warningWriter adds Warning headers (RFC 9111) just before the response
+// header is sent, unless warnings go in the response envelope.
+type warningWriter struct {
+	http.ResponseWriter
+	warnings    *warningCollector
+	wroteHeader bool
+}
+
+func (w *warningWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if !cfg.ResponseEnvelope {
+			for _, warn := range w.warnings.list() {
+				w.Header().Add("Warning", "199 - "+strconv.Quote(warn.Code+": "+warn.Message))
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *warningWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *warningWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// pageHandler responds with the page parsed from the request.
+func pageHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /items", func(w http.ResponseWriter, r *http.Request) {
+		p, err := parsePage(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+	})
+	return newHandler(mux)
+}
+
+func TestPageSizeClampedWarningHeader(t *testing.T) {
+	setConfig(t, func(c *config) { c.ResponseEnvelope = false })
+	h := pageHandler()
+	w := serve(h, httptest.NewRequest("GET", "/items?limit=1000", nil))
+	if got := responseAs[page](t, w); got.Limit != maxPageSize {
+		t.Errorf("got limit %d, want %d", got.Limit, maxPageSize)
+	}
+	want := `199 - "page_size_clamped: limit was reduced to the maximum of 100"`
+	if got := w.Header().Values("Warning"); len(got) != 1 || got[0] != want {
+		t.Errorf("got Warning %q, want %q", got, want)
+	}
+
+	w = serve(h, httptest.NewRequest("GET", "/items?limit=10", nil))
+	if got := w.Header().Values("Warning"); len(got) != 0 {
+		t.Errorf("unclamped: got Warning %q", got)
+	}
+}
+
+func TestPageSizeClampedWarningEnvelope(t *testing.T) {
+	setConfig(t, func(c *config) { c.ResponseEnvelope = true })
+	h := pageHandler()
+	w := serve(h, httptest.NewRequest("GET", "/items?limit=1000", nil))
+	got := responseAs[struct {
+		Data     page      `json:"data"`
+		Warnings []warning `json:"warnings"`
+	}](t, w)
+	if got.Data.Limit != maxPageSize {
+		t.Errorf("got limit %d, want %d", got.Data.Limit, maxPageSize)
+	}
+	if len(got.Warnings) != 1 || got.Warnings[0].Code != "page_size_clamped" {
+		t.Errorf("got warnings %+v", got.Warnings)
+	}
+	if h := w.Header().Values("Warning"); len(h) != 0 {
+		t.Errorf("got Warning %q alongside the envelope", h)
+	}
+
+	// Errors aren't enveloped.
+	w = serve(h, httptest.NewRequest("GET", "/items?limit=none", nil))
+	if code := responseAs[errorBody](t, w).Error.Code; w.Code != http.StatusBadRequest || code != "invalid_limit" {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+}
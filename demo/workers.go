@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// workerGroup runs background goroutines that may use the database outside of
+// any request, so that shutdown can stop them and wait for them to finish
+// before the pool is closed.
+type workerGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var workers = newWorkerGroup()
+
+func newWorkerGroup() *workerGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &workerGroup{ctx: ctx, cancel: cancel}
+}
+
+// Go runs fn in a goroutine. fn must return promptly once ctx is cancelled.
+func (g *workerGroup) Go(name string, fn func(ctx context.Context)) {
+	g.wg.Go(func() {
+		fn(g.ctx)
+		log.Printf("Worker %s stopped", name)
+	})
+}
+
+// Stop cancels every worker and waits for them to return, or for ctx to be
+// done.
+func (g *workerGroup) Stop(ctx context.Context) error {
+	g.cancel()
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdown stops srv taking requests, then stops g's workers, and only then
+// closes pools, so that nothing loses its connection mid-query. Each stage
+// waits at most timeout.
+func shutdown(srv *http.Server, g *workerGroup, timeout time.Duration, pools ...io.Closer) {
+	log.Println("Shutting down: draining requests")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	log.Println("Shutting down: stopping background workers")
+	workersCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := g.Stop(workersCtx); err != nil {
+		log.Printf("shutdown: background workers: %v", err)
+	}
+	log.Println("Shutting down: closing database pool")
+	for _, pool := range pools {
+		if err := pool.Close(); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// closerFunc is an io.Closer calling itself.
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+func TestShutdownWaitsForWorkersBeforeClosing(t *testing.T) {
+	g := newWorkerGroup()
+	var finished atomic.Bool
+	g.Go("fake", func(ctx context.Context) {
+		<-ctx.Done()
+		// Finishing up, as with a query in flight, takes a while after
+		// being told to stop.
+		time.Sleep(20 * time.Millisecond)
+		finished.Store(true)
+	})
+	closed := false
+	shutdown(&http.Server{}, g, time.Second, closerFunc(func() error {
+		if !finished.Load() {
+			t.Error("pool closed before the worker finished")
+		}
+		closed = true
+		return nil
+	}))
+	if !closed {
+		t.Error("pool not closed")
+	}
+}
+
+func TestShutdownClosesAfterWorkerTimeout(t *testing.T) {
+	g := newWorkerGroup()
+	release := make(chan struct{})
+	defer close(release)
+	// The worker ignores being told to stop.
+	g.Go("stuck", func(context.Context) { <-release })
+	start := time.Now()
+	closed := false
+	shutdown(&http.Server{}, g, 20*time.Millisecond, closerFunc(func() error {
+		closed = true
+		return nil
+	}))
+	if !closed {
+		t.Error("pool not closed")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown took %v", elapsed)
+	}
+}